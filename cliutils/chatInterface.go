@@ -2,22 +2,35 @@ package cliutils
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/DrewRoss5/courier/peerutils"
+	"golang.org/x/term"
 )
 
 // a struct that provides an interface to chatrooms. In future versions, this will be very useful for managing multiple chats
 type ChatInterface struct {
-	room *peerutils.Chatroom
+	session  *peerutils.Session
+	room     *peerutils.Chatroom
+	cfg      *Config
+	screen   *screen // the full-screen interface, nil when the terminal doesn't support one
+	in       *bufio.Reader
+	finished chan struct{} // closed once the chat has ended and every event has been shown
+	// plain mode state
+	shown    uint32 // the id of the first message that hasn't been printed yet
+	plainMut sync.Mutex
 }
 
 // clears the terminal and displays all messages
-func (ci ChatInterface) Display() {
+func (ci *ChatInterface) Display() {
 	// determine if we're running on windows, which uses a different clear command
 	clearCommand := "clear"
 	if runtime.GOOS == "windows" {
@@ -26,64 +39,142 @@ func (ci ChatInterface) Display() {
 	cmd := exec.Command(clearCommand)
 	cmd.Stdout = os.Stdout
 	cmd.Run()
-	fmt.Printf("Chat with %v%v%v%v:\n", peerutils.Bold, ci.room.Tunnel.Peer.Color, ci.room.Tunnel.Peer.Name, peerutils.ColorReset)
+	peer := ci.room.Tunnel().Peer
+	fmt.Printf("Chat with %v%v%v%v", peerutils.Bold, peer.Color, peer.Name, peerutils.ColorReset)
+	if ci.room.Ttl() != 0 {
+		fmt.Printf(" %v(disappearing messages: %v)%v", peerutils.Yellow, ci.room.Ttl(), peerutils.ColorReset)
+	}
+	if ci.room.Active.Load() && ci.room.Unresponsive() {
+		fmt.Printf(" %v(peer unresponsive)%v", peerutils.Red, peerutils.ColorReset)
+	}
+	fmt.Println(":")
 	ci.room.DisplayMessages(os.Stdout)
 }
 
-// awaits a message and displays it (along with all other messages) once recieved
-func (ci *ChatInterface) AwaitMessage() {
-	for ci.room.Active {
-		err := ci.room.AwaitMessage()
+// redraws the chat whenever it changes, until it ends
+func (ci *ChatInterface) watchEvents() {
+	for event := range ci.session.Events() {
+		if ci.cfg.Bell && event.Type == peerutils.EVENT_MESSAGE && event.Sender.Id == ci.room.Tunnel().Peer.Id {
+			fmt.Print("\a")
+		}
+		// plain mode only prints messages, so changes to the peer's status are printed as they happen
+		if ci.cfg.Plain && event.Type == peerutils.EVENT_STATUS {
+			if event.Unresponsive {
+				ci.write(fmt.Sprintf("%v%v is unresponsive%v\n", peerutils.Yellow, ci.room.Tunnel().Peer.Name, peerutils.ColorReset))
+			} else {
+				ci.write(fmt.Sprintf("%v%v is responding again%v\n", peerutils.Gray, ci.room.Tunnel().Peer.Name, peerutils.ColorReset))
+			}
+		}
+		ci.refresh()
+	}
+	close(ci.finished)
+}
+
+// shows the chat after it changes: redrawing it, or in plain mode, printing what's new
+func (ci *ChatInterface) refresh() {
+	switch {
+	case ci.screen != nil:
+		ci.screen.draw()
+	case ci.cfg.Plain:
+		ci.printNew()
+	default:
 		ci.Display()
-		fmt.Printf("%v%v%v%v: ", ci.room.Tunnel.User.Color, peerutils.Bold, ci.room.Tunnel.User.Name, peerutils.ColorReset)
-		if err != nil {
-			fmt.Printf("%vChat closed.\n%v", peerutils.Gray, peerutils.ColorReset)
-			ci.room.Active = false
+		if ci.room.Active.Load() {
+			user := ci.room.Tunnel().User
+			fmt.Printf("%v%v%v%v: ", user.Color, peerutils.Bold, user.Name, peerutils.ColorReset)
 		}
 	}
 }
 
 // awaits user input, and handles it if it's a command, or sends it if it is a message
+// the chat is redrawn by watchEvents once the input takes effect
 func (ci *ChatInterface) AwaitInput() {
-	fmt.Printf("%v%v%v%v: ", ci.room.Tunnel.User.Color, peerutils.Bold, ci.room.Tunnel.User.Name, peerutils.ColorReset)
-	in := bufio.NewReader(os.Stdin)
-	input, err := in.ReadString('\n')
+	input, err := ci.in.ReadString('\n')
+	// the end of input leaves the chat, rather than waiting on input that will never arrive
+	if err == io.EOF {
+		if ci.room.Active.Load() {
+			ci.room.HandleCommand(">disconnect", nil)
+		}
+		return
+	}
 	if err != nil {
 		fmt.Printf("%vError: %v%v\n", peerutils.Red, err.Error(), peerutils.ColorReset)
 		return
 	}
-	if ci.room.Active {
-		// determine if the input is a command or a message, and handle it appropriately
-		if input[0] == '>' {
-			// run the input as a command
-			input = strings.Replace(input, "\n", "", -1)
-			tmp := strings.Split(input, " ")
-			command := tmp[0]
-			var args []string = nil
-			if len(tmp) > 1 {
-				args = tmp[1:]
-			}
-			ci.room.HandleCommand(command, args)
-		} else {
-			ci.room.SendMessage(&input)
+	if !ci.room.Active.Load() {
+		return
+	}
+	// determine if the input is a command or a message, and handle it appropriately
+	if input[0] == '>' {
+		// run the input as a command
+		input = strings.Replace(input, "\n", "", -1)
+		tmp := strings.Split(input, " ")
+		var args []string = nil
+		if len(tmp) > 1 {
+			args = tmp[1:]
 		}
-		ci.Display()
+		ci.handleCommand(tmp[0], args)
+	} else {
+		ci.session.Send(input)
 	}
 }
 
-// begins a chat session
+// runs a chat command, handling the ones that affect the application rather than the chat itself
+func (ci *ChatInterface) handleCommand(command string, args []string) {
+	if command == ">exit" {
+		// severs the connection and exits the application
+		ci.session.Close()
+		if ci.screen != nil {
+			ci.screen.restore()
+		}
+		os.Exit(0)
+	}
+	ci.room.HandleCommand(command, args)
+}
+
+// begins a chat session, using the full-screen interface when running in a terminal, unless plain mode is on
 func (ci *ChatInterface) Run() {
-	ci.Display()
-	go ci.AwaitMessage()
-	for ci.room.Active {
+	if !ci.cfg.Plain && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) {
+		err := ci.runScreen()
+		if err == nil {
+			fmt.Printf("%vConnection terminated%v\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+	}
+	if ci.cfg.Plain {
+		peer := ci.room.Tunnel().Peer
+		ci.write(fmt.Sprintf("Chat with %v%v%v%v\n", peerutils.Bold, peer.Color, peer.Name, peerutils.ColorReset))
+		var previous bytes.Buffer
+		ci.room.DisplayPrevious(&previous)
+		ci.write(previous.String())
+	}
+	ci.refresh()
+	go ci.watchEvents()
+	for ci.room.Active.Load() {
 		ci.AwaitInput()
 	}
+	<-ci.finished
+	if ci.cfg.Plain {
+		ci.write(fmt.Sprintf("%vConnection terminated%v\n", peerutils.Red, peerutils.ColorReset))
+		return
+	}
 	fmt.Printf("%vConnection terminated%v\n", peerutils.Red, peerutils.ColorReset)
 }
 
-// initializes a ChatInterface, given the tunnel
-func NewChatInterface(tunnel *peerutils.Tunnel) *ChatInterface {
-	chatroom := peerutils.Chatroom{Tunnel: *tunnel, Active: true, MaxId: 0, Messages: make(map[uint32]peerutils.Message)}
-	ci := ChatInterface{&chatroom}
+// prompts for a password on the terminal
+func promptPassword(prompt string) ([]byte, error) {
+	fmt.Print(prompt)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return password, err
+}
+
+// initializes a ChatInterface, given the tunnel and the options to run its chat with
+func NewChatInterface(tunnel *peerutils.Tunnel, cfg *Config, opts peerutils.SessionOptions) *ChatInterface {
+	session := peerutils.NewSession(context.Background(), tunnel, opts)
+	room := session.Chatroom()
+	room.ArchiveDir = cfg.ArchiveDir
+	room.ReadPassword = promptPassword
+	ci := ChatInterface{session: session, room: room, cfg: cfg, in: bufio.NewReader(os.Stdin), finished: make(chan struct{})}
 	return &ci
 }
@@ -3,46 +3,89 @@ package cliutils
 import (
 	"bufio"
 	"crypto/rsa"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/DrewRoss5/courier/cryptoutils"
 	"github.com/DrewRoss5/courier/peerutils"
 	"golang.org/x/term"
 )
 
+// a logged in user and their keys
+type identity struct {
+	prvKey rsa.PrivateKey
+	pubKey rsa.PublicKey
+	user   peerutils.User
+}
+
 // there aren't real accounts, but this creates a user for "login"
-func login() (rsa.PrivateKey, rsa.PublicKey, peerutils.User) {
+// values set in the configuration are used as-is, and anything missing is prompted for
+// the private key password is only prompted for if password is nil
+func login(cfg *Config, password []byte) identity {
 
 	// read the user's key
-	var keyPath string
-	fmt.Print("Key path: ")
-	fmt.Scanf("%s", &keyPath)
-	fmt.Print("Private key password: ")
-	keyPassword, _ := term.ReadPassword(syscall.Stdin)
-	fmt.Println("\nImporting RSA keys...")
+	keyPath := readKeyPath(cfg)
+	keyPassword := password
+	if keyPassword == nil {
+		fmt.Print("Private key password: ")
+		keyPassword, _ = term.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+	}
+	fmt.Println("Importing RSA keys...")
 	prvKey, pubKey, err := cryptoutils.ImportRsa(keyPath, keyPassword)
+	if errors.Is(err, cryptoutils.ErrDecrypt) {
+		fmt.Println("Failed to import RSA keys, the password may be incorrect. Exiting...")
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Println("Failed to import RSA keys. Exiting...")
 		os.Exit(1)
 	}
 	fmt.Println("Keys read.")
+	// peers need the statements linking the user's earlier keys to this one to recognize them after a rotation
+	chain, err := cryptoutils.ImportSuccession(keyPath)
+	if err == nil {
+		err = cryptoutils.VerifySuccession(chain, &pubKey)
+	}
+	if err != nil {
+		fmt.Printf("%vWarning:%v ignoring your key succession statements: %v\n", peerutils.Yellow, peerutils.ColorReset, err.Error())
+		chain = nil
+	}
+	peerutils.SetSuccession(chain)
+	// the configuration was validated as it was loaded, so its padding, heartbeat and cover traffic policies are always valid
+	policy, _ := cfg.paddingPolicy()
+	peerutils.SetPadding(policy)
+	peerutils.SetHeartbeat(cfg.heartbeatPolicy())
+	cover, _ := cfg.coverPolicy()
+	peerutils.SetCover(cover)
+	// connections a listener turns away are logged, so that an exposed listener's offenders can be seen
+	peerutils.SetRejectLog(func(addr string, reason error) {
+		fmt.Printf("%vwarning:%v rejected a connection from %v: %v\n", peerutils.Yellow, peerutils.ColorReset, addr, reason.Error())
+		verificationFailed(cfg, reason)
+	})
 	// request the user's username
-	fmt.Print("Username: ")
-	var username string
-	fmt.Scanf("%s", &username)
+	username := cfg.Name
+	if username == "" {
+		fmt.Print("Username: ")
+		fmt.Scanf("%s", &username)
+	}
 	if len(username) > 64 {
 		fmt.Printf("%vError:%v Invalid username\n", peerutils.Red, peerutils.ColorReset)
 		os.Exit(1)
 	}
 	// request the user's color
-	fmt.Print("Color (leave blank for gray): ")
-	var color string
-	fmt.Scanf("%s", &color)
+	color := cfg.Color
+	if color == "" {
+		fmt.Print("Color (leave blank for gray): ")
+		fmt.Scanf("%s", &color)
+	}
 	color, err = peerutils.ParseColor(color)
 	if err != nil {
 		fmt.Printf("%vError:%v Invalid color. Exiting...\n", peerutils.Red, peerutils.ColorReset)
@@ -55,15 +98,285 @@ func login() (rsa.PrivateKey, rsa.PublicKey, peerutils.User) {
 		os.Exit(1)
 	}
 	user := peerutils.User{Name: username, Color: color, Id: id}
-	return prvKey, pubKey, user
+	return identity{prvKey: prvKey, pubKey: pubKey, user: user}
+}
+
+// reads a password from a file descriptor or an environment variable, returning nil if neither is given
+// a negative fd means no file descriptor was given
+func ReadPasswordSource(fd int, env string) ([]byte, error) {
+	if fd >= 0 {
+		file := os.NewFile(uintptr(fd), "password")
+		if file == nil {
+			return nil, errors.New("invalid password file descriptor")
+		}
+		defer file.Close()
+		line, err := bufio.NewReader(file).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, errors.New("the environment variable " + env + " is not set")
+		}
+		return []byte(value), nil
+	}
+	return nil, nil
+}
+
+// prints an error in the standard format, and returns it
+func printError(err error) error {
+	fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+	return err
+}
+
+// returns advice on what to do about an error from connecting to or chatting with a peer, empty if there's none
+func errorHint(err error) string {
+	switch {
+	case errors.Is(err, peerutils.ErrPinMismatch):
+		return "If they've replaced their key, confirm the new fingerprint with them some other way, then update it with `courier contacts edit --fingerprint`."
+	case errors.Is(err, peerutils.ErrPeerIdentityInvalid):
+		return "They couldn't prove they own the key they sent, somebody may be impersonating them."
+	case errors.Is(err, peerutils.ErrIdentityChanged):
+		return "The peer came back with a different key, so the chat wasn't resumed."
+	case errors.Is(err, peerutils.ErrSignature), errors.Is(err, peerutils.ErrDecrypt):
+		return "A message failed verification, the connection may have been tampered with."
+	case errors.Is(err, peerutils.ErrHandshake):
+		return "Somebody between you and the peer may be tampering with the connection."
+	case errors.Is(err, peerutils.ErrIncompatible):
+		return "Whichever of you has the older version of courier needs to update."
+	case errors.Is(err, peerutils.ErrHandshakeRejected), errors.Is(err, peerutils.ErrMalformed):
+		return "Check that the peer is running a compatible version of courier."
+	case errors.Is(err, peerutils.ErrTimeout):
+		return "Check that the peer is still online, and that nothing blocks the two ports above the base port."
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "Nobody is listening at that address, check the address and that the peer has run `courier listen`."
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "Another program is using the port, choose a different one with the listen_port setting."
+	}
+	return ""
+}
+
+// prints an error from connecting to a peer, along with any advice on it, and runs the verification_failed hooks
+func connectionFailed(cfg *Config, err error) error {
+	printError(err)
+	if hint := errorHint(err); hint != "" {
+		fmt.Println(hint)
+	}
+	verificationFailed(cfg, err)
+	return err
+}
+
+// runs the verification_failed hooks if err was caused by a peer failing verification
+func verificationFailed(cfg *Config, err error) {
+	if peerutils.IsVerificationError(err) {
+		runHooks(cfg, peerutils.HookEvent{Event: peerutils.HOOK_VERIFICATION_FAILED, Error: err.Error(), Time: time.Now()})
+	}
+}
+
+// runs the configured hooks for an event, printing any errors
+func runHooks(cfg *Config, event peerutils.HookEvent) {
+	err := cfg.Hooks.Run(event)
+	if err != nil {
+		printError(err)
+	}
+}
+
+// checks that a command was given an acceptable number of arguments
+func checkArgs(args []string, min int, max int) error {
+	if len(args) >= min && (max < 0 || len(args) <= max) {
+		return nil
+	}
+	switch {
+	case min == max && min == 1:
+		return printError(errors.New("This command takes exactly one argument"))
+	case min == max:
+		return printError(fmt.Errorf("This command takes exactly %v arguments", min))
+	case max < 0:
+		return printError(fmt.Errorf("This command takes at least %v arguments", min))
+	default:
+		return printError(fmt.Errorf("This command takes between %v and %v arguments", min, max))
+	}
+}
+
+// awaits an incoming connection and runs the chatroom
+func runListen(cfg *Config, id identity, args []string) error {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return err
+	}
+	fmt.Println("Listening...")
+	tunnel, err := peerutils.AwaitPeer(cfg.listenPort(), id.pubKey, id.prvKey, id.user)
+	if err != nil {
+		return connectionFailed(cfg, err)
+	}
+	applyContact(tunnel, "")
+	NewChatInterface(tunnel, cfg, sessionOptions(cfg, id, tunnel)).Run()
+	return nil
+}
+
+// connects to a peer, given their address or the alias of a contact, and runs the chatroom
+func runConnect(cfg *Config, id identity, args []string) error {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return err
+	}
+	addr := strings.Replace(string(args[0]), "\n", "", 1)
+	// the argument may be the alias of a contact, in which case their key must match the pinned fingerprint
+	alias := ""
+	pinned := ""
+	book, err := loadContacts()
+	if err != nil {
+		return err
+	}
+	if contact, ok := book.Get(addr); ok {
+		alias = contact.Alias
+		addr = contact.Address
+		pinned = contact.Fingerprint
+	}
+	fmt.Println("Connecting...")
+	tunnel, err := peerutils.ConnectPeer(cfg.dialAddr(addr), pinned, id.pubKey, id.prvKey, id.user)
+	if err != nil {
+		return connectionFailed(cfg, err)
+	}
+	applyContact(tunnel, alias)
+	NewChatInterface(tunnel, cfg, sessionOptions(cfg, id, tunnel)).Run()
+	return nil
+}
+
+// connects to or awaits a peer through a relay, and runs the chatroom
+// an optional third argument names the peer expected, by the alias of a contact or their key fingerprint
+func runRelay(cfg *Config, id identity, args []string, initiate bool) error {
+	if err := checkArgs(args, 2, 3); err != nil {
+		return err
+	}
+	alias := ""
+	pinned := ""
+	if len(args) == 3 {
+		var err error
+		alias, pinned, err = expectedPeer(args[2])
+		if err != nil {
+			return err
+		}
+	}
+	var tunnel *peerutils.Tunnel
+	var err error
+	if initiate {
+		fmt.Println("Connecting through relay...")
+		tunnel, err = peerutils.ConnectRelay(args[0], args[1], pinned, id.pubKey, id.prvKey, id.user)
+	} else {
+		fmt.Println("Waiting for peer on relay...")
+		tunnel, err = peerutils.AwaitRelay(args[0], args[1], pinned, id.pubKey, id.prvKey, id.user)
+	}
+	if err != nil {
+		return connectionFailed(cfg, err)
+	}
+	applyContact(tunnel, alias)
+	NewChatInterface(tunnel, cfg, sessionOptions(cfg, id, tunnel)).Run()
+	return nil
 }
 
-func MainLoop() {
+// leaves a message for an offline peer at a mailbox, the peer is named by the alias of a contact or the path to their key
+func runDrop(id identity, args []string) error {
+	if err := checkArgs(args, 3, -1); err != nil {
+		return err
+	}
+	recipientPub, err := recipientKey(args[1])
+	if err != nil {
+		return err
+	}
+	text := strings.Join(args[2:], " ") + "\n"
+	err = peerutils.DepositMessage(args[0], recipientPub, text, id.pubKey, id.prvKey, id.user)
+	if err != nil {
+		return printError(err)
+	}
+	fmt.Println("Message left in the mailbox.")
+	return nil
+}
+
+// collects and displays the messages left for the user at a mailbox
+func runCollect(cfg *Config, id identity, args []string) error {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return err
+	}
+	messages, rejected, err := peerutils.CollectMessages(args[0], id.pubKey, id.prvKey)
+	if err != nil {
+		return printError(err)
+	}
+	if len(messages) == 0 {
+		fmt.Printf("%v%vNo messages to display%v\n", peerutils.Italic, peerutils.Gray, peerutils.ColorReset)
+	}
+	// senders are shown by their alias if they're contacts, the messages are still shown if the contacts can't be read
+	book, _ := loadContacts()
+	for _, message := range messages {
+		name, sender := senderLabel(book, message)
+		fmt.Printf("%v%v%v @ %v%v%v%v (%v): %v", peerutils.Bold, name, peerutils.ColorReset, peerutils.Italic, peerutils.Yellow, message.Sent.Format("2006-01-02 15:04:05"), peerutils.ColorReset, sender, message.Text)
+	}
+	if rejected != 0 {
+		fmt.Printf("%vWarning:%v %v message(s) failed verification and were discarded\n", peerutils.Yellow, peerutils.ColorReset, rejected)
+		runHooks(cfg, peerutils.HookEvent{Event: peerutils.HOOK_VERIFICATION_FAILED, Error: fmt.Sprintf("%v mailbox message(s) failed verification", rejected), Time: time.Now()})
+	}
+	return nil
+}
+
+// decrypts and displays a chat archive, prompting for its password if one isn't given
+func runReadArchive(args []string, password []byte) error {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return err
+	}
+	if password == nil {
+		fmt.Print("Password: ")
+		var err error
+		password, err = term.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		if err != nil {
+			return printError(errors.New("failed to read password"))
+		}
+	}
+	archive, err := peerutils.DecryptArchive(args[0], password)
+	if err != nil {
+		return printError(err)
+	}
+	fmt.Printf("%v\n", archive)
+	return nil
+}
+
+// runs a single top-level command non-interactively, logging in first if the command needs an identity
+// password is the private key or archive password, and is prompted for if nil
+func RunCommand(cfg *Config, password []byte, command string, args []string) error {
+	switch command {
+	case "archive":
+		if len(args) == 0 || args[0] != "read" {
+			return printError(errors.New("Expected: archive read <file>"))
+		}
+		return runReadArchive(args[1:], password)
+	case "rotate-keys":
+		return runRotateKeys(cfg, password, args)
+	case "connect", "listen", "relay-connect", "relay-await", "drop", "collect":
+	default:
+		return printError(errors.New("Unrecognized command"))
+	}
+	id := login(cfg, password)
+	switch command {
+	case "connect":
+		return runConnect(cfg, id, args)
+	case "listen":
+		return runListen(cfg, id, args)
+	case "relay-connect", "relay-await":
+		return runRelay(cfg, id, args, command == "relay-connect")
+	case "drop":
+		return runDrop(id, args)
+	default:
+		return runCollect(cfg, id, args)
+	}
+}
+
+func MainLoop(cfg *Config, password []byte) {
 	// log the user in and begin the program loop
-	prvKey, pubKey, user := login()
+	id := login(cfg, password)
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Printf("%v%v%v%v > ", peerutils.Bold, user.Color, user.Name, peerutils.ColorReset)
+		fmt.Printf("%v%v%v%v > ", peerutils.Bold, id.user.Color, id.user.Name, peerutils.ColorReset)
 		input, _ := reader.ReadString('\n')
 		input = strings.Replace(input, "\n", "", -1)
 		tmp := strings.Split(input, " ")
@@ -71,46 +384,17 @@ func MainLoop() {
 		commandArgs := tmp[1:]
 		switch command {
 		case "await":
-			// await an incoming connection and run the chatroomd
-			fmt.Println("Listening...")
-			tunnel, err := peerutils.AwaitPeer(pubKey, prvKey, user)
-			if err != nil {
-				fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
-				continue
-			}
-			chat := NewChatInterface(tunnel)
-			chat.Run()
+			runListen(cfg, id, commandArgs)
 		case "connect":
-			if len(commandArgs) != 1 {
-				fmt.Printf("%verror:%v This command takes exactly one argument\n", peerutils.Red, peerutils.ColorReset)
-				continue
-			}
-			fmt.Println("Connecting...")
-			addr := strings.Replace(string(commandArgs[0]), "\n", "", 1)
-			tunnel, err := peerutils.ConnectPeer(addr, pubKey, prvKey, user)
-			if err != nil {
-				fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
-				continue
-			}
-			chat := NewChatInterface(tunnel)
-			chat.Run()
+			runConnect(cfg, id, commandArgs)
+		case "relay-connect", "relay-await":
+			runRelay(cfg, id, commandArgs, command == "relay-connect")
+		case "drop":
+			runDrop(id, commandArgs)
+		case "collect":
+			runCollect(cfg, id, commandArgs)
 		case "read-archive":
-			if len(commandArgs) != 1 {
-				fmt.Printf("%verror:%v This command takes exactly one argument\n", peerutils.Red, peerutils.ColorReset)
-				continue
-			}
-			fmt.Print("Password: ")
-			password, err := term.ReadPassword(int(syscall.Stdin))
-			if err != nil {
-				fmt.Printf("%vError:%v failed to read password\n", peerutils.Red, peerutils.ColorReset)
-				continue
-			}
-			archive, err := peerutils.DecryptArchive(commandArgs[0], password)
-			if err != nil {
-				fmt.Printf("%vError:%v %v", peerutils.Red, peerutils.ColorReset, err.Error())
-				continue
-			}
-			fmt.Printf("\n%v\n", archive)
+			runReadArchive(commandArgs, nil)
 		case "clear":
 			// determine if we're running on windows, which uses a different clear command
 			clearCommand := "clear"
@@ -0,0 +1,305 @@
+package cliutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// the user's persistent settings, any value left unset is prompted for or defaulted
+type Config struct {
+	KeyPath          string          `json:"key_path"`
+	Name             string          `json:"name"`
+	Color            string          `json:"color"`
+	ListenPort       int             `json:"listen_port"` // the base port to await peers on
+	DialPort         int             `json:"dial_port"`   // the base port to connect to when an address doesn't specify one
+	ArchiveDir       string          `json:"archive_dir"` // where >archive saves chats when no path is given
+	Proxy            string          `json:"proxy"`
+	Bell             bool            `json:"bell"`              // ring the terminal bell when a message arrives
+	Plain            bool            `json:"plain"`             // print new events one per line instead of redrawing the screen
+	NoAnsi           bool            `json:"no_ansi"`           // remove all escape sequences from plain mode output
+	Hooks            peerutils.Hooks `json:"hooks"`             // commands run on chat events, only editable in the file itself
+	History          bool            `json:"history"`           // save chats, encrypted, and show them again in later chats with the same peer
+	HistoryLimit     int             `json:"history_limit"`     // the most messages saved per peer, zero for no limit
+	HistoryDays      int             `json:"history_days"`      // how many days saved messages are kept for, zero to keep them forever
+	RekeyMessages    int             `json:"rekey_messages"`    // the most messages sent before the chat's key is replaced, zero for the default
+	RekeyBytes       int             `json:"rekey_bytes"`       // the most bytes sent before the chat's key is replaced, zero for the default
+	RekeyMinutes     int             `json:"rekey_minutes"`     // the most minutes before the chat's key is replaced, zero for the default
+	Padding          string          `json:"padding"`           // how messages are padded to hide their length: none, pow2 or block
+	PaddingBlock     int             `json:"padding_block"`     // the block size for the block padding mode, zero for the default
+	HeartbeatSeconds int             `json:"heartbeat_seconds"` // how often heartbeats are sent to peers, zero for the default
+	HeartbeatLimit   int             `json:"heartbeat_limit"`   // how many heartbeats a peer can miss before the chat is closed, zero for the default
+	CoverTraffic     bool            `json:"cover_traffic"`     // send fixed size frames at a constant rate, so that an observer can't tell when messages are sent
+	CoverIntervalMs  int             `json:"cover_interval_ms"` // how often a cover traffic frame is sent, in milliseconds, zero for the default
+	CoverSize        int             `json:"cover_size"`        // the size cover traffic frames are padded to, zero for the default
+	path             string
+	unreadable       bool // set when the file exists but couldn't be parsed, so saving moves it aside rather than losing it
+}
+
+// returns the default location of the configuration file, inside the user's configuration directory
+func DefaultConfigPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "courier", "config.json"), nil
+}
+
+// reads the configuration file, returning an empty configuration if it doesn't exist yet
+// an empty path reads the file from its default location
+// a file that can't be parsed or holds invalid values is still returned alongside the error, as an empty configuration
+// or with the values as they were read, so that the config command can repair it
+func LoadConfig(path string) (*Config, error) {
+	var err error
+	if path == "" {
+		path, err = DefaultConfigPath()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg := Config{path: path}
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, &cfg)
+	if err != nil {
+		return &Config{path: path, unreadable: true}, errors.New("config: invalid configuration file")
+	}
+	return &cfg, cfg.validate()
+}
+
+// writes the configuration back to the file it was loaded from
+// a file that couldn't be parsed is kept beside it, with .invalid appended to its name
+func (c *Config) Save() error {
+	err := os.MkdirAll(filepath.Dir(c.path), 0700)
+	if err != nil {
+		return err
+	}
+	if c.unreadable {
+		err = os.Rename(c.path, c.path+".invalid")
+		if err != nil {
+			return err
+		}
+		c.unreadable = false
+	}
+	contents, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, contents, 0600)
+}
+
+// ensures all configured values are usable
+func (c *Config) validate() error {
+	if len(c.Name) > 64 {
+		return errors.New("config: names must be at most 64 characters long")
+	}
+	if _, err := peerutils.ParseColor(c.Color); err != nil {
+		return errors.New("config: invalid color")
+	}
+	for _, port := range []int{c.ListenPort, c.DialPort} {
+		if port < 0 || port > 65533 {
+			return errors.New("config: invalid port")
+		}
+	}
+	if c.HistoryLimit < 0 || c.HistoryDays < 0 {
+		return errors.New("config: history limits can't be negative")
+	}
+	if c.RekeyMessages < 0 || c.RekeyBytes < 0 || c.RekeyMinutes < 0 {
+		return errors.New("config: rekey limits can't be negative")
+	}
+	if _, err := c.paddingPolicy(); err != nil {
+		return errors.New("config: " + err.Error())
+	}
+	if c.HeartbeatSeconds < 0 || c.HeartbeatLimit < 0 {
+		return errors.New("config: heartbeat settings can't be negative")
+	}
+	if err := c.heartbeatPolicy().Validate(); err != nil {
+		return errors.New("config: " + err.Error())
+	}
+	if c.CoverIntervalMs < 0 || c.CoverSize < 0 {
+		return errors.New("config: cover traffic settings can't be negative")
+	}
+	if _, err := c.coverPolicy(); err != nil {
+		return errors.New("config: " + err.Error())
+	}
+	for _, hook := range c.Hooks {
+		if err := hook.Validate(); err != nil {
+			return errors.New("config: " + err.Error())
+		}
+	}
+	if c.Proxy != "" {
+		_, err := peerutils.ParseProxy(c.Proxy)
+		if err != nil {
+			return errors.New("config: invalid proxy")
+		}
+	}
+	return nil
+}
+
+// returns when chats replace their keys, leaving unset limits to the defaults
+func (c *Config) rekeyPolicy() peerutils.RekeyPolicy {
+	return peerutils.RekeyPolicy{Messages: c.RekeyMessages, Bytes: int64(c.RekeyBytes), Interval: time.Duration(c.RekeyMinutes) * time.Minute}
+}
+
+// returns how the user asks for messages to be padded
+func (c *Config) paddingPolicy() (peerutils.PaddingPolicy, error) {
+	return peerutils.ParsePadding(c.Padding, c.PaddingBlock)
+}
+
+// returns how often peers are asked for heartbeats, and how many they can miss
+func (c *Config) heartbeatPolicy() peerutils.HeartbeatPolicy {
+	return peerutils.HeartbeatPolicy{Interval: time.Duration(c.HeartbeatSeconds) * time.Second, Limit: c.HeartbeatLimit}
+}
+
+// returns the cover traffic the user asks for, which is disabled unless cover_traffic is set
+func (c *Config) coverPolicy() (peerutils.CoverPolicy, error) {
+	if !c.CoverTraffic {
+		return peerutils.CoverPolicy{}, nil
+	}
+	return peerutils.ParseCover(time.Duration(c.CoverIntervalMs)*time.Millisecond, c.CoverSize)
+}
+
+// returns the base port to await peers on
+func (c *Config) listenPort() int {
+	if c.ListenPort == 0 {
+		return peerutils.DEFAULT_PORT
+	}
+	return c.ListenPort
+}
+
+// appends the configured dial port to an address that doesn't specify one
+func (c *Config) dialAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil || c.DialPort == 0 {
+		return addr
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(c.DialPort))
+}
+
+// returns the struct field of the configuration with the given key
+func (c *Config) field(key string) (reflect.Value, error) {
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if value.Type().Field(i).Tag.Get("json") == key {
+			return value.Field(i), nil
+		}
+	}
+	return reflect.Value{}, errors.New("config: unrecognized key " + key)
+}
+
+// returns the string representation of the value with the given key
+func (c *Config) Get(key string) (string, error) {
+	field, err := c.field(key)
+	if err != nil {
+		return "", err
+	}
+	if field.Kind() == reflect.Slice {
+		encoded, err := json.Marshal(field.Interface())
+		return string(encoded), err
+	}
+	return fmt.Sprint(field.Interface()), nil
+}
+
+// parses and sets the value with the given key, an empty value unsets the key
+func (c *Config) Set(key string, value string) error {
+	field, err := c.field(key)
+	if err != nil {
+		return err
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		parsed := 0
+		if value != "" {
+			parsed, err = strconv.Atoi(value)
+			if err != nil {
+				return errors.New("config: " + key + " must be a number")
+			}
+		}
+		field.SetInt(int64(parsed))
+	case reflect.Bool:
+		parsed := false
+		if value != "" {
+			parsed, err = strconv.ParseBool(value)
+			if err != nil {
+				return errors.New("config: " + key + " must be true or false")
+			}
+		}
+		field.SetBool(parsed)
+	default:
+		return errors.New("config: " + key + " can only be changed in the configuration file")
+	}
+	return c.validate()
+}
+
+// returns the keys of all configuration values, in the order they're declared
+func (c *Config) Keys() []string {
+	var keys []string
+	configType := reflect.TypeOf(*c)
+	for i := 0; i < configType.NumField(); i++ {
+		if key := configType.Field(i).Tag.Get("json"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// handles the config subcommand: courier config get [key] | courier config set <key> [value]
+func ConfigCommand(cfg *Config, args []string) {
+	if len(args) == 0 || (args[0] != "get" && args[0] != "set") {
+		fmt.Printf("%verror:%v Expected one of: get, set\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	if args[0] == "get" {
+		if len(args) > 2 {
+			fmt.Printf("%verror:%v This command takes at most one argument\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		keys := cfg.Keys()
+		if len(args) == 2 {
+			keys = []string{args[1]}
+		}
+		for _, key := range keys {
+			value, err := cfg.Get(key)
+			if err != nil {
+				fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+				return
+			}
+			fmt.Printf("%v = %v\n", key, value)
+		}
+		return
+	}
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Printf("%verror:%v This command takes between one and two arguments\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	value := ""
+	if len(args) == 3 {
+		value = args[2]
+	}
+	unreadable := cfg.unreadable
+	err := cfg.Set(args[1], value)
+	if err == nil {
+		err = cfg.Save()
+	}
+	if err != nil {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		return
+	}
+	if unreadable {
+		fmt.Printf("The configuration file couldn't be read, so it was moved to %v and replaced\n", cfg.path+".invalid")
+	}
+}
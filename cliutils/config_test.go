@@ -0,0 +1,116 @@
+package cliutils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestConfigSetAndGet(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		want  string // the value get returns afterwards, when set succeeds
+		fails bool
+	}{
+		{name: "string", key: "name", value: "alice", want: "alice"},
+		{name: "int", key: "listen_port", value: "7000", want: "7000"},
+		{name: "bool", key: "bell", value: "true", want: "true"},
+		{name: "unset int", key: "dial_port", value: "", want: "0"},
+		{name: "unset bool", key: "bell", value: "", want: "false"},
+		{name: "not a number", key: "listen_port", value: "seven", fails: true},
+		{name: "not a bool", key: "bell", value: "sometimes", fails: true},
+		{name: "invalid port", key: "dial_port", value: "70000", fails: true},
+		{name: "invalid color", key: "color", value: "mauve", fails: true},
+		{name: "unrecognized key", key: "nickname", value: "al", fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{}
+			err := cfg.Set(test.key, test.value)
+			if (err != nil) != test.fails {
+				t.Fatalf("got error %v", err)
+			}
+			if test.fails {
+				return
+			}
+			value, err := cfg.Get(test.key)
+			if err != nil || value != test.want {
+				t.Fatalf("got %q, %v", value, err)
+			}
+		})
+	}
+}
+
+func TestConfigKeys(t *testing.T) {
+	keys := (&Config{}).Keys()
+	for _, key := range keys {
+		if _, err := (&Config{}).Get(key); err != nil {
+			t.Fatalf("can't get %v: %v", key, err)
+		}
+	}
+	if !slices.Contains(keys, "key_path") || slices.Contains(keys, "") {
+		t.Fatalf("got keys %v", keys)
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "courier", "config.json")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Set("name", "alice")
+	cfg.Set("listen_port", "7000")
+	err = cfg.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Name != "alice" || loaded.ListenPort != 7000 {
+		t.Fatalf("loaded %+v", loaded)
+	}
+}
+
+func TestConfigCommandRepairsBrokenFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		kept     bool // whether the broken file is moved aside, rather than being repaired in place
+	}{
+		{name: "invalid value", contents: `{"name": "alice", "color": "mauve"}`},
+		{name: "unparsable", contents: `{"name": `, kept: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			err := os.WriteFile(path, []byte(test.contents), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err == nil || cfg == nil {
+				t.Fatalf("loaded the broken file as %+v, %v", cfg, err)
+			}
+			if _, err = cfg.Get("color"); err != nil {
+				t.Fatalf("couldn't get a value from the broken file: %v", err)
+			}
+			ConfigCommand(cfg, []string{"set", "color", "cyan"})
+			loaded, err := LoadConfig(path)
+			if err != nil || loaded.Color != "cyan" {
+				t.Fatalf("loaded the repaired file as %+v, %v", loaded, err)
+			}
+			if !test.kept && loaded.Name != "alice" {
+				t.Fatal("repairing a value lost the others")
+			}
+			if _, err = os.Stat(path + ".invalid"); (err == nil) != test.kept {
+				t.Fatalf("the broken file was kept: %v", err == nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package cliutils
+
+import (
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// loads the user's contact book, printing an error if it can't be read
+func loadContacts() (*peerutils.ContactBook, error) {
+	path, err := peerutils.DefaultContactsPath()
+	if err != nil {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		return nil, err
+	}
+	book, err := peerutils.LoadContacts(path)
+	if err != nil {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		return nil, err
+	}
+	return book, nil
+}
+
+// applies the user's contact book to a newly established tunnel: the peer is shown in the contact's preferred color,
+// a contact without a pinned key has the peer's key pinned on first use, and a contact pinned to a key the peer has
+// since rotated away from is rolled forward to their new key
+// the pinned key itself is kept too, so that messages can be left for the contact at a mailbox
+func applyContact(tunnel *peerutils.Tunnel, alias string) {
+	book, err := loadContacts()
+	if err != nil {
+		return
+	}
+	fingerprint := cryptoutils.Fingerprint(&tunnel.PeerPubKey)
+	contact, ok := book.Get(alias)
+	if !ok {
+		contact, ok = book.FindByFingerprint(fingerprint)
+	}
+	// the peer may be a contact pinned to one of their earlier keys
+	for i := len(tunnel.PeerSuccession) - 1; i >= 0 && !ok; i-- {
+		contact, ok = book.FindByFingerprint(tunnel.PeerSuccession[i].OldFingerprint())
+	}
+	if !ok {
+		return
+	}
+	pubKey := string(cryptoutils.ExportRsaPub(&tunnel.PeerPubKey))
+	switch {
+	case contact.Fingerprint == "":
+		contact.Fingerprint = fingerprint
+		contact.PublicKey = pubKey
+		err = saveContact(book, contact)
+		if err != nil {
+			fmt.Printf("%verror:%v failed to pin %v's key: %v\n", peerutils.Red, peerutils.ColorReset, contact.Alias, err.Error())
+		} else {
+			fmt.Printf("Pinned %v's key fingerprint %v\n", contact.Alias, fingerprint)
+		}
+	case contact.Fingerprint != fingerprint && tunnel.SucceededFrom(contact.Fingerprint):
+		previous := contact.Fingerprint
+		contact.Fingerprint = fingerprint
+		contact.PublicKey = pubKey
+		err = saveContact(book, contact)
+		if err != nil {
+			fmt.Printf("%verror:%v failed to update %v's key: %v\n", peerutils.Red, peerutils.ColorReset, contact.Alias, err.Error())
+		} else {
+			fmt.Printf("%v%v rotated their key%v, signed by their previous key\n  old: %v\n  new: %v\n", peerutils.Yellow, contact.Alias, peerutils.ColorReset, previous, fingerprint)
+		}
+	case contact.Fingerprint == fingerprint && contact.PublicKey == "":
+		// contacts pinned by fingerprint alone learn the key the first time they're connected to
+		contact.PublicKey = pubKey
+		saveContact(book, contact)
+	}
+	if contact.Color != "" {
+		tunnel.Peer.Color, _ = peerutils.ParseColor(contact.Color)
+	}
+}
+
+// resolves the alias of a contact, or a key fingerprint, naming the peer expected at the other end of a connection
+// returns the contact's alias if it's one, and the fingerprint the peer's key must match, which is empty for a contact
+// whose key hasn't been pinned yet
+func expectedPeer(peer string) (string, string, error) {
+	book, err := loadContacts()
+	if err != nil {
+		return "", "", err
+	}
+	if contact, ok := book.Get(peer); ok {
+		return contact.Alias, contact.Fingerprint, nil
+	}
+	fingerprint := strings.ToLower(peer)
+	if !peerutils.ValidFingerprint(fingerprint) {
+		return "", "", printError(fmt.Errorf("%v is neither a contact nor a key fingerprint", peer))
+	}
+	return "", fingerprint, nil
+}
+
+// resolves the recipient of a mailbox message, given either the alias of a contact or the path to their public key
+// a contact's key is the one pinned when they were last connected to
+func recipientKey(recipient string) (rsa.PublicKey, error) {
+	book, err := loadContacts()
+	if err != nil {
+		return rsa.PublicKey{}, err
+	}
+	if contact, ok := book.Get(recipient); ok {
+		if contact.PublicKey == "" {
+			return rsa.PublicKey{}, printError(fmt.Errorf("%v's key isn't known yet, chat with them once or give the path to their pub.pem instead", contact.Alias))
+		}
+		pubKey, err := cryptoutils.ImportRsaPub([]byte(contact.PublicKey))
+		if err != nil {
+			return rsa.PublicKey{}, printError(err)
+		}
+		return pubKey, nil
+	}
+	pubPem, err := os.ReadFile(recipient)
+	if err != nil {
+		return rsa.PublicKey{}, printError(fmt.Errorf("%v is neither a contact nor a readable key file", recipient))
+	}
+	pubKey, err := cryptoutils.ImportRsaPub(pubPem)
+	if err != nil {
+		return rsa.PublicKey{}, printError(err)
+	}
+	return pubKey, nil
+}
+
+// returns how the sender of a mailbox message is shown: by their alias and preferred color if they're a contact,
+// otherwise by their own name and color along with their key fingerprint
+func senderLabel(book *peerutils.ContactBook, message peerutils.DroppedMessage) (string, string) {
+	if book != nil {
+		if contact, ok := book.FindByFingerprint(message.Fingerprint); ok {
+			color := message.Sender.Color
+			if contact.Color != "" {
+				color, _ = peerutils.ParseColor(contact.Color)
+			}
+			return color + message.Sender.Name, contact.Alias
+		}
+	}
+	return message.Sender.Color + message.Sender.Name, message.Fingerprint
+}
+
+// adds or replaces a contact, and saves the contact book
+func saveContact(book *peerutils.ContactBook, contact peerutils.Contact) error {
+	err := book.Set(contact)
+	if err != nil {
+		return err
+	}
+	return book.Save()
+}
+
+// handles the contacts subcommand: courier contacts add|list|rm|edit
+func ContactsCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Printf("%verror:%v Expected one of: add, list, rm, edit\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	book, err := loadContacts()
+	if err != nil {
+		return
+	}
+	flags := flag.NewFlagSet("contacts "+args[0], flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	address := flags.String("address", "", "the contact's address")
+	fingerprint := flags.String("fingerprint", "", "the contact's key fingerprint")
+	notes := flags.String("notes", "", "notes about the contact")
+	color := flags.String("color", "", "the color to display the contact in")
+	err = flags.Parse(args[1:])
+	if err != nil {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		return
+	}
+	positional := flags.Args()
+	switch args[0] {
+	case "add":
+		if len(positional) != 2 {
+			fmt.Printf("%verror:%v Usage: courier contacts add [--fingerprint fp] [--notes text] [--color color] <alias> <address>\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		if _, ok := book.Get(positional[0]); ok {
+			fmt.Printf("%verror:%v A contact with that alias already exists\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		err = book.Set(peerutils.Contact{Alias: positional[0], Address: positional[1], Fingerprint: *fingerprint, Notes: *notes, Color: *color})
+	case "edit":
+		if len(positional) != 1 {
+			fmt.Printf("%verror:%v Usage: courier contacts edit [--address addr] [--fingerprint fp] [--notes text] [--color color] <alias>\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		contact, ok := book.Get(positional[0])
+		if !ok {
+			fmt.Printf("%verror:%v No such contact\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		// only overwrite the fields that were provided
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "address":
+				contact.Address = *address
+			case "fingerprint":
+				// the stored key belonged to the previous fingerprint
+				contact.Fingerprint = *fingerprint
+				contact.PublicKey = ""
+			case "notes":
+				contact.Notes = *notes
+			case "color":
+				contact.Color = *color
+			}
+		})
+		err = book.Set(contact)
+	case "rm":
+		if len(positional) != 1 {
+			fmt.Printf("%verror:%v This command takes exactly one argument\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		if !book.Remove(positional[0]) {
+			fmt.Printf("%verror:%v No such contact\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+	case "list":
+		contacts := book.List()
+		if len(contacts) == 0 {
+			fmt.Printf("%v%vNo contacts to display%v\n", peerutils.Italic, peerutils.Gray, peerutils.ColorReset)
+		}
+		for _, contact := range contacts {
+			color, _ := peerutils.ParseColor(contact.Color)
+			fingerprint := contact.Fingerprint
+			if fingerprint == "" {
+				fingerprint = "(not pinned)"
+			}
+			fmt.Printf("%v%v%v%v @ %v\n  %v\n", peerutils.Bold, color, contact.Alias, peerutils.ColorReset, contact.Address, fingerprint)
+			if contact.Notes != "" {
+				fmt.Printf("  %v%v%v\n", peerutils.Italic, contact.Notes, peerutils.ColorReset)
+			}
+		}
+		return
+	default:
+		fmt.Printf("%verror:%v Expected one of: add, list, rm, edit\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	if err == nil {
+		err = book.Save()
+	}
+	if err != nil {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+	}
+}
@@ -0,0 +1,183 @@
+package cliutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// points the user's configuration directory at a temporary one, returning an empty contact book stored there
+func testContacts(t *testing.T) *peerutils.ContactBook {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	book, err := loadContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return book
+}
+
+// generates a new key pair
+func testKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, cryptoutils.RSA_KEY_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// returns a tunnel whose peer has a newly generated key
+func testPeer(t *testing.T) *peerutils.Tunnel {
+	t.Helper()
+	return &peerutils.Tunnel{PeerPubKey: testKey(t).PublicKey, Peer: peerutils.User{Name: "peer", Color: peerutils.Red}}
+}
+
+func TestApplyContactPinsFirstContact(t *testing.T) {
+	book := testContacts(t)
+	tunnel := testPeer(t)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1"})
+	book.Save()
+	applyContact(tunnel, "alice")
+	book, _ = loadContacts()
+	contact, _ := book.Get("alice")
+	if contact.Fingerprint != cryptoutils.Fingerprint(&tunnel.PeerPubKey) {
+		t.Fatalf("pinned %q", contact.Fingerprint)
+	}
+}
+
+func TestApplyContactFindsPeerByFingerprint(t *testing.T) {
+	book := testContacts(t)
+	tunnel := testPeer(t)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: cryptoutils.Fingerprint(&tunnel.PeerPubKey), Color: "cyan"})
+	book.Save()
+	// a peer that connects to us isn't known by alias, only by their key
+	applyContact(tunnel, "")
+	if tunnel.Peer.Color != peerutils.Cyan {
+		t.Fatal("the contact's color wasn't applied")
+	}
+}
+
+func TestApplyContactIgnoresStrangers(t *testing.T) {
+	book := testContacts(t)
+	tunnel := testPeer(t)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1"})
+	book.Save()
+	applyContact(tunnel, "")
+	book, _ = loadContacts()
+	contact, _ := book.Get("alice")
+	if contact.Fingerprint != "" || tunnel.Peer.Color != peerutils.Red {
+		t.Fatal("a stranger was treated as a contact")
+	}
+}
+
+func TestApplyContactRollsForwardRotatedKey(t *testing.T) {
+	book := testContacts(t)
+	oldKey, newKey := testKey(t), testKey(t)
+	statement, err := cryptoutils.NewSuccession(oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: cryptoutils.Fingerprint(&oldKey.PublicKey)})
+	book.Save()
+	tunnel := &peerutils.Tunnel{PeerPubKey: newKey.PublicKey, PeerSuccession: []cryptoutils.Succession{statement}}
+	applyContact(tunnel, "")
+	book, _ = loadContacts()
+	contact, _ := book.Get("alice")
+	if contact.Fingerprint != cryptoutils.Fingerprint(&newKey.PublicKey) {
+		t.Fatal("the contact wasn't moved to their new key")
+	}
+}
+
+func TestApplyContactKeepsPinWithoutSuccession(t *testing.T) {
+	book := testContacts(t)
+	pinned := cryptoutils.Fingerprint(&testKey(t).PublicKey)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: pinned})
+	book.Save()
+	// a different key connecting under the contact's alias, with nothing linking it to the pinned key
+	applyContact(testPeer(t), "alice")
+	book, _ = loadContacts()
+	contact, _ := book.Get("alice")
+	if contact.Fingerprint != pinned {
+		t.Fatal("the pin was replaced by an unrelated key")
+	}
+}
+
+func TestExpectedPeer(t *testing.T) {
+	book := testContacts(t)
+	key := testKey(t)
+	fingerprint := cryptoutils.Fingerprint(&key.PublicKey)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: fingerprint})
+	book.Save()
+	alias, pinned, err := expectedPeer("alice")
+	if err != nil || alias != "alice" || pinned != fingerprint {
+		t.Fatalf("resolved alice as %q, %q, %v", alias, pinned, err)
+	}
+	alias, pinned, err = expectedPeer(strings.ToUpper(fingerprint))
+	if err != nil || alias != "" || pinned != fingerprint {
+		t.Fatalf("resolved the fingerprint as %q, %q, %v", alias, pinned, err)
+	}
+	if _, _, err = expectedPeer("bob"); err == nil {
+		t.Fatal("resolved an unknown alias")
+	}
+}
+
+func TestApplyContactKeepsPinnedKey(t *testing.T) {
+	book := testContacts(t)
+	tunnel := testPeer(t)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: cryptoutils.Fingerprint(&tunnel.PeerPubKey)})
+	book.Save()
+	applyContact(tunnel, "alice")
+	book, _ = loadContacts()
+	contact, _ := book.Get("alice")
+	if contact.PublicKey != string(cryptoutils.ExportRsaPub(&tunnel.PeerPubKey)) {
+		t.Fatal("the contact's key wasn't kept")
+	}
+}
+
+func TestRecipientKey(t *testing.T) {
+	book := testContacts(t)
+	alice, bob := testKey(t), testKey(t)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: cryptoutils.Fingerprint(&alice.PublicKey), PublicKey: string(cryptoutils.ExportRsaPub(&alice.PublicKey))})
+	book.Set(peerutils.Contact{Alias: "carol", Address: "10.0.0.2"})
+	book.Save()
+	pubKey, err := recipientKey("alice")
+	if err != nil || !pubKey.Equal(&alice.PublicKey) {
+		t.Fatalf("resolved alice as a different key, %v", err)
+	}
+	// a contact that's never been connected to has no key to encrypt to
+	if _, err = recipientKey("carol"); err == nil {
+		t.Fatal("resolved a contact without a key")
+	}
+	path := filepath.Join(t.TempDir(), "pub.pem")
+	os.WriteFile(path, cryptoutils.ExportRsaPub(&bob.PublicKey), 0600)
+	pubKey, err = recipientKey(path)
+	if err != nil || !pubKey.Equal(&bob.PublicKey) {
+		t.Fatalf("resolved the key file as a different key, %v", err)
+	}
+	if _, err = recipientKey("dave"); err == nil {
+		t.Fatal("resolved an unknown alias")
+	}
+}
+
+func TestSenderLabel(t *testing.T) {
+	book := testContacts(t)
+	key := testKey(t)
+	fingerprint := cryptoutils.Fingerprint(&key.PublicKey)
+	book.Set(peerutils.Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: fingerprint, Color: "cyan"})
+	message := peerutils.DroppedMessage{Sender: peerutils.User{Name: "Alice", Color: peerutils.Red}, Fingerprint: fingerprint}
+	if name, sender := senderLabel(book, message); name != peerutils.Cyan+"Alice" || sender != "alice" {
+		t.Fatalf("a contact was shown as %q (%v)", name, sender)
+	}
+	message.Fingerprint = cryptoutils.Fingerprint(&testKey(t).PublicKey)
+	if name, sender := senderLabel(book, message); name != peerutils.Red+"Alice" || sender != message.Fingerprint {
+		t.Fatalf("a stranger was shown as %q (%v)", name, sender)
+	}
+}
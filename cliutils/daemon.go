@@ -0,0 +1,252 @@
+package cliutils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/DrewRoss5/courier/daemonutils"
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// handles the daemon subcommand: logs in and runs chats in the background until interrupted
+func DaemonCommand(cfg *Config, password []byte, socketPath string, args []string) error {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return err
+	}
+	id := login(cfg, password)
+	listener, err := daemonutils.Listen(socketPath)
+	if err != nil {
+		return printError(err)
+	}
+	defer os.Remove(socketPath)
+	daemon := daemonutils.NewDaemon(id.pubKey, id.prvKey, id.user)
+	daemon.ListenPort = cfg.listenPort()
+	daemon.OnTunnel = applyContact
+	daemon.Hooks = cfg.Hooks
+	daemon.Rekey = cfg.rekeyPolicy()
+	daemon.History = func(tunnel *peerutils.Tunnel) *peerutils.HistoryStore {
+		return openHistory(cfg, &id.prvKey, tunnel)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("Daemon running on %v\n", socketPath)
+	err = daemon.Serve(ctx, listener)
+	if err != nil {
+		return printError(err)
+	}
+	return nil
+}
+
+// parses a session id argument
+func parseSession(arg string) (int, error) {
+	session, err := strconv.Atoi(arg)
+	if err != nil || session <= 0 {
+		return 0, printError(errors.New("Invalid session id"))
+	}
+	return session, nil
+}
+
+// handles the ctl subcommand, which sends a single request to the daemon and prints its result as JSON
+// courier ctl sessions|listen|connect|send|delete|ephemeral|close|history|search|subscribe
+func CtlCommand(cfg *Config, socketPath string, args []string) error {
+	if len(args) == 0 {
+		return printError(errors.New("Expected one of: sessions, listen, connect, send, delete, ephemeral, close, history, search, subscribe"))
+	}
+	request := daemonutils.Request{Method: args[0]}
+	args = args[1:]
+	var err error
+	switch request.Method {
+	case "sessions", "listen":
+		err = checkArgs(args, 0, 0)
+	case "connect":
+		if err = checkArgs(args, 1, 1); err != nil {
+			break
+		}
+		// the address may be the alias of a contact, as with courier connect
+		request.Address = args[0]
+		book, err := loadContacts()
+		if err != nil {
+			return err
+		}
+		if contact, ok := book.Get(args[0]); ok {
+			request.Alias = contact.Alias
+			request.Address = contact.Address
+			request.Fingerprint = contact.Fingerprint
+		}
+		request.Address = cfg.dialAddr(request.Address)
+	case "send":
+		if err = checkArgs(args, 2, -1); err == nil {
+			request.Session, err = parseSession(args[0])
+			request.Text = strings.Join(args[1:], " ") + "\n"
+		}
+	case "search":
+		if err = checkArgs(args, 2, -1); err == nil {
+			request.Session, err = parseSession(args[0])
+			request.Text = strings.Join(args[1:], " ")
+		}
+	case "delete":
+		if err = checkArgs(args, 2, 2); err != nil {
+			break
+		}
+		if request.Session, err = parseSession(args[0]); err != nil {
+			break
+		}
+		message, parseErr := strconv.ParseUint(args[1], 10, 32)
+		if parseErr != nil {
+			err = printError(errors.New("Invalid message id"))
+		}
+		request.Message = uint32(message)
+	case "ephemeral":
+		if err = checkArgs(args, 2, 2); err != nil {
+			break
+		}
+		if request.Session, err = parseSession(args[0]); err != nil || args[1] == "off" {
+			break
+		}
+		var parseErr error
+		request.Seconds, parseErr = strconv.Atoi(args[1])
+		if parseErr != nil {
+			err = printError(errors.New("Invalid duration"))
+		}
+	case "close", "history":
+		if err = checkArgs(args, 1, 1); err == nil {
+			request.Session, err = parseSession(args[0])
+		}
+	case "subscribe":
+		if err = checkArgs(args, 0, 1); err == nil && len(args) == 1 {
+			request.Session, err = parseSession(args[0])
+		}
+	default:
+		return printError(errors.New("Unrecognized command"))
+	}
+	if err != nil {
+		return err
+	}
+	client, err := daemonutils.Dial(socketPath)
+	if err != nil {
+		return printError(err)
+	}
+	defer client.Close()
+	var result json.RawMessage
+	err = client.Call(request, &result)
+	if err != nil {
+		return printError(err)
+	}
+	if request.Method != "subscribe" {
+		if result != nil {
+			fmt.Println(string(result))
+		}
+		return nil
+	}
+	// print events as they arrive, until the daemon exits
+	encoder := json.NewEncoder(os.Stdout)
+	for event := range client.Events() {
+		encoder.Encode(event)
+	}
+	return nil
+}
+
+// displays a daemon event in the same format as the chat interface
+func printEvent(event daemonutils.Event) {
+	switch event.Type {
+	case "message", "notice", "previous":
+		// messages from earlier chats may be from another day
+		timeFormat := "15:04:05"
+		if event.Type == "previous" {
+			timeFormat = "2006-01-02 15:04"
+		}
+		fmt.Printf("%v%v%v @ %v%v%v%v: %v", peerutils.Bold, event.Sender, peerutils.ColorReset, peerutils.Italic, peerutils.Yellow, event.Time.Format(timeFormat), peerutils.ColorReset, event.Text)
+	case "ephemeral":
+		if event.Ttl == 0 {
+			fmt.Printf("%vDisappearing messages turned off%v\n", peerutils.Gray, peerutils.ColorReset)
+		} else {
+			fmt.Printf("%vDisappearing messages set to %vs%v\n", peerutils.Gray, event.Ttl, peerutils.ColorReset)
+		}
+	case "status":
+		if event.Unresponsive {
+			fmt.Printf("%vThe peer is unresponsive%v\n", peerutils.Yellow, peerutils.ColorReset)
+		} else {
+			fmt.Printf("%vThe peer is responding again%v\n", peerutils.Gray, peerutils.ColorReset)
+		}
+	case "closed":
+		fmt.Printf("%vChat closed.%v\n", peerutils.Gray, peerutils.ColorReset)
+	}
+}
+
+// handles the attach subcommand, which follows one of the daemon's chats in plain mode
+// lines typed are sent as messages, >disconnect ends the chat, and >detach (or the end of input) leaves it running
+func AttachCommand(socketPath string, args []string) error {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return err
+	}
+	session, err := parseSession(args[0])
+	if err != nil {
+		return err
+	}
+	client, err := daemonutils.Dial(socketPath)
+	if err != nil {
+		return printError(err)
+	}
+	defer client.Close()
+	err = client.Call(daemonutils.Request{Method: "subscribe", Session: session}, nil)
+	if err != nil {
+		return printError(err)
+	}
+	var history []daemonutils.Event
+	err = client.Call(daemonutils.Request{Method: "history", Session: session}, &history)
+	if err != nil {
+		return printError(err)
+	}
+	for _, event := range history {
+		printEvent(event)
+	}
+	closed := make(chan struct{})
+	go func() {
+		for event := range client.Events() {
+			printEvent(event)
+			if event.Type == "closed" {
+				break
+			}
+		}
+		close(closed)
+	}()
+	lines := make(chan string)
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return nil
+		case line, ok := <-lines:
+			if !ok || strings.TrimSpace(line) == ">detach" {
+				fmt.Printf("Detached from session %v\n", session)
+				return nil
+			}
+			request := daemonutils.Request{Method: "send", Session: session, Text: line}
+			if strings.TrimSpace(line) == ">disconnect" {
+				request = daemonutils.Request{Method: "close", Session: session}
+			}
+			err = client.Call(request, nil)
+			if err != nil {
+				printError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package cliutils
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// opens the history store for a tunnel's peer, returning nil if history is turned off or the store can't be opened
+func openHistory(cfg *Config, prvKey *rsa.PrivateKey, tunnel *peerutils.Tunnel) *peerutils.HistoryStore {
+	if !cfg.History {
+		return nil
+	}
+	dir, err := peerutils.DefaultHistoryDir()
+	if err != nil {
+		printError(err)
+		return nil
+	}
+	path := peerutils.HistoryPath(dir, cryptoutils.Fingerprint(&tunnel.PeerPubKey))
+	// a peer who rotated their key keeps the history saved under their most recent earlier key
+	for i := len(tunnel.PeerSuccession) - 1; i >= 0; i-- {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		os.Rename(peerutils.HistoryPath(dir, tunnel.PeerSuccession[i].OldFingerprint()), path)
+	}
+	history, err := peerutils.OpenHistory(path, peerutils.HistoryKey(prvKey), cfg.HistoryLimit, time.Duration(cfg.HistoryDays)*24*time.Hour)
+	if err != nil {
+		fmt.Printf("%verror:%v %v, this chat won't be saved\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		return nil
+	}
+	return history
+}
+
+// returns the options a chat with a tunnel's peer is run with
+func sessionOptions(cfg *Config, id identity, tunnel *peerutils.Tunnel) peerutils.SessionOptions {
+	return peerutils.SessionOptions{Hooks: cfg.Hooks, History: openHistory(cfg, &id.prvKey, tunnel), Rekey: cfg.rekeyPolicy()}
+}
+
+// handles the history subcommand: courier history list|rm
+func HistoryCommand(args []string) {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "rm") {
+		fmt.Printf("%verror:%v Expected one of: list, rm\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	dir, err := peerutils.DefaultHistoryDir()
+	if err != nil {
+		printError(err)
+		return
+	}
+	book, err := loadContacts()
+	if err != nil {
+		return
+	}
+	if args[0] == "list" {
+		if len(args) != 1 {
+			fmt.Printf("%verror:%v This command takes no arguments\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		paths, _ := filepath.Glob(peerutils.HistoryPath(dir, "*"))
+		if len(paths) == 0 {
+			fmt.Printf("%v%vNo saved history%v\n", peerutils.Italic, peerutils.Gray, peerutils.ColorReset)
+		}
+		for _, path := range paths {
+			fingerprint := strings.TrimSuffix(filepath.Base(path), ".hist")
+			name := "(not a contact)"
+			if contact, ok := book.FindByFingerprint(fingerprint); ok {
+				name = contact.Alias
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			fmt.Printf("%v%v%v, last saved %v\n  %v\n", peerutils.Bold, name, peerutils.ColorReset, info.ModTime().Format("2006-01-02 15:04"), fingerprint)
+		}
+		return
+	}
+	if len(args) != 2 {
+		fmt.Printf("%verror:%v This command takes exactly one argument\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	// the peer may be given as a contact's alias or a key fingerprint
+	fingerprint := strings.ToLower(args[1])
+	if contact, ok := book.Get(args[1]); ok {
+		fingerprint = contact.Fingerprint
+	}
+	if !peerutils.ValidFingerprint(fingerprint) {
+		fmt.Printf("%verror:%v No such contact, or invalid fingerprint\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	err = os.Remove(peerutils.HistoryPath(dir, fingerprint))
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("%verror:%v There's no saved history with that peer\n", peerutils.Red, peerutils.ColorReset)
+		return
+	}
+	if err != nil {
+		printError(err)
+		return
+	}
+	fmt.Println("History removed")
+}
@@ -0,0 +1,201 @@
+package cliutils
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// returns the directory containing the user's keys, prompting for it if it isn't configured
+func readKeyPath(cfg *Config) string {
+	keyPath := cfg.KeyPath
+	if keyPath == "" {
+		fmt.Print("Key path: ")
+		fmt.Scanf("%s", &keyPath)
+	}
+	return keyPath
+}
+
+// prompts for a new private key password and its confirmation, unless one was already given
+func readNewPassword(newPassword []byte) ([]byte, error) {
+	if newPassword != nil {
+		return newPassword, nil
+	}
+	newPassword, err := promptPassword("New private key password: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := promptPassword("Confirm: ")
+	if err != nil {
+		return nil, err
+	}
+	if slices.Compare(newPassword, confirm) != 0 {
+		return nil, errors.New("password does not match confirmation")
+	}
+	return newPassword, nil
+}
+
+// handles the key subcommand: courier key passwd|encrypt|decrypt|info|export-pub|fingerprint
+// password is the current private key password and newPassword the one to set, each is prompted for if nil
+func KeyCommand(cfg *Config, password []byte, newPassword []byte, args []string) error {
+	if len(args) == 0 || !slices.Contains([]string{"passwd", "encrypt", "decrypt", "info", "export-pub", "fingerprint"}, args[0]) {
+		return printError(errors.New("Expected one of: passwd, encrypt, decrypt, info, export-pub, fingerprint"))
+	}
+	if args[0] == "export-pub" && len(args) > 2 {
+		return printError(errors.New("This command takes at most one argument"))
+	}
+	if args[0] != "export-pub" && len(args) != 1 {
+		return printError(errors.New("This command takes no arguments"))
+	}
+	keyPath := readKeyPath(cfg)
+	encrypted, err := cryptoutils.RsaPrivateKeyEncrypted(keyPath)
+	if err != nil {
+		return printError(err)
+	}
+	// the commands that only read the public key don't need the password
+	switch args[0] {
+	case "info", "fingerprint", "export-pub":
+		pubKey, err := cryptoutils.ImportRsaPubFile(keyPath)
+		if err != nil {
+			return printError(err)
+		}
+		switch args[0] {
+		case "fingerprint":
+			fmt.Println(cryptoutils.Fingerprint(&pubKey))
+		case "export-pub":
+			if len(args) == 1 {
+				os.Stdout.Write(cryptoutils.ExportRsaPub(&pubKey))
+				return nil
+			}
+			err = os.WriteFile(args[1], cryptoutils.ExportRsaPub(&pubKey), 0644)
+			if err != nil {
+				return printError(err)
+			}
+			fmt.Printf("Public key exported to %v\n", args[1])
+		default:
+			protection := "encrypted with a password"
+			if !encrypted {
+				protection = fmt.Sprintf("%vstored in plaintext%v", peerutils.Yellow, peerutils.ColorReset)
+			}
+			fmt.Printf("%vKey directory:%v %v\n", peerutils.Bold, peerutils.ColorReset, keyPath)
+			fmt.Printf("%vFingerprint:%v %v\n", peerutils.Bold, peerutils.ColorReset, cryptoutils.Fingerprint(&pubKey))
+			fmt.Printf("%vSize:%v %v bits\n", peerutils.Bold, peerutils.ColorReset, pubKey.N.BitLen())
+			fmt.Printf("%vPrivate key:%v %v\n", peerutils.Bold, peerutils.ColorReset, protection)
+			chain, err := cryptoutils.ImportSuccession(keyPath)
+			if err == nil && len(chain) != 0 {
+				fmt.Printf("%vRotated:%v %v times, most recently on %v\n", peerutils.Bold, peerutils.ColorReset, len(chain), chain[len(chain)-1].Time.Local().Format("2006-01-02 15:04"))
+			}
+		}
+		return nil
+	case "passwd", "decrypt":
+		if !encrypted {
+			return printError(errors.New("Your private key isn't encrypted, use `courier key encrypt` to add a password"))
+		}
+	case "encrypt":
+		if encrypted {
+			return printError(errors.New("Your private key is already encrypted, use `courier key passwd` to change its password"))
+		}
+	}
+	if encrypted && password == nil {
+		password, err = promptPassword("Private key password: ")
+		if err != nil {
+			return printError(err)
+		}
+	}
+	prvKey, err := cryptoutils.ImportRsaPrivateKey(keyPath, password)
+	if errors.Is(err, cryptoutils.ErrDecrypt) {
+		return printError(errors.New("failed to read the private key, the password may be incorrect"))
+	}
+	if err != nil {
+		return printError(err)
+	}
+	if args[0] == "decrypt" {
+		newPassword = nil
+	} else {
+		newPassword, err = readNewPassword(newPassword)
+		if err != nil {
+			return printError(err)
+		}
+		if len(newPassword) == 0 {
+			return printError(errors.New("The new password can't be empty, use `courier key decrypt` to remove the password"))
+		}
+	}
+	err = cryptoutils.ExportRsaPrivateKey(prvKey, keyPath, newPassword)
+	if err != nil {
+		return printError(err)
+	}
+	switch args[0] {
+	case "passwd":
+		fmt.Println("Password changed")
+	case "encrypt":
+		fmt.Println("Private key encrypted")
+	default:
+		fmt.Printf("%vWarning:%v your private key is now stored in plaintext.\n", peerutils.Yellow, peerutils.ColorReset)
+	}
+	return nil
+}
+
+// replaces the user's key pair with a new one, along with a statement signed by both keys that peers use to
+// recognize the new key as theirs: courier rotate-keys
+func runRotateKeys(cfg *Config, password []byte, args []string) error {
+	if len(args) != 0 {
+		return printError(errors.New("This command takes no arguments"))
+	}
+	keyPath := readKeyPath(cfg)
+	var err error
+	if password == nil {
+		password, err = promptPassword("Private key password: ")
+		if err != nil {
+			return printError(err)
+		}
+	}
+	// a key stored in plaintext stays in plaintext
+	if len(password) == 0 {
+		password = nil
+	}
+	oldKey, oldPub, err := cryptoutils.ImportRsa(keyPath, password)
+	if err != nil {
+		return printError(errors.New("failed to import RSA keys"))
+	}
+	fmt.Println("Generating keys...")
+	statement, err := cryptoutils.RotateRsaKeys(keyPath, password)
+	if err != nil {
+		return printError(err)
+	}
+	newKey, _, err := cryptoutils.ImportRsa(keyPath, password)
+	if err != nil {
+		return printError(err)
+	}
+	// saved history is encrypted with a key derived from the private key, so it's moved over to the new one
+	rekeyHistory(&oldKey, &newKey)
+	fmt.Printf("Key pair rotated\n  old: %v\n  new: %v\n", statement.OldFingerprint(), statement.NewFingerprint())
+	fmt.Printf("The old keys were moved to %v\n", filepath.Join(keyPath, "retired", cryptoutils.Fingerprint(&oldPub)))
+	fmt.Println("Contacts who pinned your old key will accept the new one the next time you chat with them.")
+	return nil
+}
+
+// re-encrypts every saved history with the key derived from newKey, printing the histories that couldn't be
+func rekeyHistory(oldKey *rsa.PrivateKey, newKey *rsa.PrivateKey) {
+	dir, err := peerutils.DefaultHistoryDir()
+	if err != nil {
+		return
+	}
+	paths, _ := filepath.Glob(peerutils.HistoryPath(dir, "*"))
+	for _, path := range paths {
+		history, err := peerutils.OpenHistory(path, peerutils.HistoryKey(oldKey), 0, 0)
+		if err == nil {
+			err = history.Rekey(peerutils.HistoryKey(newKey))
+		}
+		if err != nil {
+			fingerprint := strings.TrimSuffix(filepath.Base(path), ".hist")
+			fmt.Printf("%verror:%v failed to move the history with %v to the new key: %v\n", peerutils.Red, peerutils.ColorReset, fingerprint, err.Error())
+		}
+	}
+}
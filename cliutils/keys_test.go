@@ -0,0 +1,138 @@
+package cliutils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+func TestRekeyHistory(t *testing.T) {
+	testContacts(t)
+	oldKey, newKey := testKey(t), testKey(t)
+	dir, err := peerutils.DefaultHistoryDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := peerutils.HistoryPath(dir, cryptoutils.Fingerprint(&testKey(t).PublicKey))
+	history, err := peerutils.OpenHistory(path, peerutils.HistoryKey(oldKey), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = history.Append(&peerutils.User{Name: "alice"}, "hello", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekeyHistory(oldKey, newKey)
+	if _, err := peerutils.OpenHistory(path, peerutils.HistoryKey(oldKey), 0, 0); err == nil {
+		t.Fatal("the history can still be read with the old key")
+	}
+	history, err = peerutils.OpenHistory(path, peerutils.HistoryKey(newKey), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := history.Entries(); len(entries) != 1 || entries[0].Text != "hello" {
+		t.Fatalf("the history holds %+v after rekeying", entries)
+	}
+}
+
+// creates a key pair in a temporary directory, encrypted with password unless it's nil, returning a configuration
+// that uses it
+func testKeyConfig(t *testing.T, password []byte) *Config {
+	t.Helper()
+	keyPath := t.TempDir()
+	err := cryptoutils.ExportRsaKeys(testKey(t), keyPath, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{KeyPath: keyPath}
+}
+
+// checks that the private key in the configured directory can be read with password
+func expectPassword(t *testing.T, cfg *Config, password []byte) {
+	t.Helper()
+	if _, err := cryptoutils.ImportRsaPrivateKey(cfg.KeyPath, password); err != nil {
+		t.Fatalf("the private key can't be read with %q: %v", password, err)
+	}
+}
+
+func TestKeyPasswd(t *testing.T) {
+	cfg := testKeyConfig(t, []byte("old"))
+	err := KeyCommand(cfg, []byte("old"), []byte("new"), []string{"passwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPassword(t, cfg, []byte("new"))
+}
+
+func TestKeyPasswdWrongPassword(t *testing.T) {
+	cfg := testKeyConfig(t, []byte("old"))
+	if KeyCommand(cfg, []byte("wrong"), []byte("new"), []string{"passwd"}) == nil {
+		t.Fatal("changed the password without the current one")
+	}
+	expectPassword(t, cfg, []byte("old"))
+}
+
+func TestKeyRefusesToOverwriteProtection(t *testing.T) {
+	encrypted := testKeyConfig(t, []byte("password"))
+	plaintext := testKeyConfig(t, nil)
+	tests := []struct {
+		name string
+		cfg  *Config
+		args []string
+	}{
+		{name: "encrypt an encrypted key", cfg: encrypted, args: []string{"encrypt"}},
+		{name: "change the password of a plaintext key", cfg: plaintext, args: []string{"passwd"}},
+		{name: "decrypt a plaintext key", cfg: plaintext, args: []string{"decrypt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, _ := os.ReadFile(filepath.Join(test.cfg.KeyPath, "prv.pem"))
+			if KeyCommand(test.cfg, []byte("password"), []byte("new"), test.args) == nil {
+				t.Fatal("the command succeeded")
+			}
+			after, _ := os.ReadFile(filepath.Join(test.cfg.KeyPath, "prv.pem"))
+			if !bytes.Equal(before, after) {
+				t.Fatal("the private key was rewritten")
+			}
+		})
+	}
+}
+
+func TestKeyDecryptAndEncrypt(t *testing.T) {
+	cfg := testKeyConfig(t, []byte("password"))
+	err := KeyCommand(cfg, []byte("password"), nil, []string{"decrypt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPassword(t, cfg, nil)
+	if KeyCommand(cfg, nil, []byte{}, []string{"encrypt"}) == nil {
+		t.Fatal("encrypted the key with an empty password")
+	}
+	err = KeyCommand(cfg, nil, []byte("new"), []string{"encrypt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPassword(t, cfg, []byte("new"))
+}
+
+func TestKeyExportPub(t *testing.T) {
+	cfg := testKeyConfig(t, []byte("password"))
+	path := filepath.Join(t.TempDir(), "pub.pem")
+	err := KeyCommand(cfg, nil, nil, []string{"export-pub", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(filepath.Join(cfg.KeyPath, "pub.pem"))
+	if !bytes.Equal(exported, original) {
+		t.Fatal("the exported key doesn't match")
+	}
+}
@@ -0,0 +1,53 @@
+package cliutils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// writes text to stdout in plain mode, removing colors if NO_COLOR is set, and every escape sequence if no_ansi is
+func (ci *ChatInterface) write(text string) {
+	if ci.cfg.NoAnsi || os.Getenv("NO_COLOR") != "" {
+		text = stripAnsi(text, !ci.cfg.NoAnsi)
+	}
+	os.Stdout.WriteString(text)
+}
+
+// prints the messages that haven't been printed yet, one per line
+func (ci *ChatInterface) printNew() {
+	ci.plainMut.Lock()
+	defer ci.plainMut.Unlock()
+	var buf bytes.Buffer
+	ci.shown = ci.room.DisplayMessagesSince(&buf, ci.shown)
+	ci.write(buf.String())
+}
+
+// removes ANSI escape sequences from text, keeping the ones that aren't colors (such as bold and italics) if keepStyles is set
+func stripAnsi(text string, keepStyles bool) string {
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		if text[i] != '\033' {
+			out.WriteByte(text[i])
+			i++
+			continue
+		}
+		end := escapeEnd(text, i)
+		if keepStyles && !isColor(text[i:end]) {
+			out.WriteString(text[i:end])
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// returns true if an escape sequence sets the foreground or background color
+func isColor(sequence string) bool {
+	var code int
+	_, err := fmt.Sscanf(sequence, "\033[%dm", &code)
+	if err != nil {
+		return false
+	}
+	return (code >= 30 && code <= 49) || (code >= 90 && code <= 107)
+}
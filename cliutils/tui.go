@@ -0,0 +1,452 @@
+package cliutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/peerutils"
+	"golang.org/x/term"
+)
+
+const (
+	RESIZE_POLL_INTERVAL = 200 * time.Millisecond
+	KEY_BUFFER_SIZE      = 64
+)
+
+// special keys recognized by the full-screen interface
+const (
+	KEY_RUNE = iota
+	KEY_ENTER
+	KEY_BACKSPACE
+	KEY_DELETE
+	KEY_LEFT
+	KEY_RIGHT
+	KEY_HOME
+	KEY_END
+	KEY_PAGE_UP
+	KEY_PAGE_DOWN
+	KEY_UP
+	KEY_DOWN
+	KEY_CTRL_C
+	KEY_CTRL_L
+	KEY_CTRL_U
+)
+
+type key struct {
+	code int
+	r    rune
+}
+
+// a full-screen terminal interface to a chatroom: a status bar, a scrollable message pane, and an input line that
+// keeps its contents across redraws
+type screen struct {
+	ci       *ChatInterface
+	input    []rune
+	cursor   int
+	scroll   int // the number of lines the message pane is scrolled up from the bottom
+	width    int
+	height   int
+	masked   bool   // hides the input, used when reading passwords
+	prompt   string // replaces the user's name before the input line when set
+	notice   string // shown in the status bar in place of the chat details when set
+	keys     chan key
+	closed   atomic.Bool
+	mut      sync.Mutex
+	oldState *term.State
+}
+
+// takes over the terminal and runs the chat until it closes
+func (ci *ChatInterface) runScreen() error {
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	s := &screen{ci: ci, keys: make(chan key, KEY_BUFFER_SIZE), oldState: oldState}
+	s.width, s.height, _ = term.GetSize(int(os.Stdout.Fd()))
+	ci.screen = s
+	ci.room.ReadPassword = s.readPassword
+	// switch to the alternate screen, so the user's scrollback is left intact
+	fmt.Print("\033[?1049h")
+	go s.readKeys()
+	go s.watchSize()
+	go ci.watchEvents()
+	s.draw()
+	for ci.room.Active.Load() {
+		var k key
+		var ok bool
+		select {
+		case k, ok = <-s.keys:
+		case <-ci.finished:
+		}
+		if !ok || !ci.room.Active.Load() {
+			break
+		}
+		if s.edit(k) {
+			s.submit()
+		}
+		s.draw()
+	}
+	// wait for a final key press, so that the key reader doesn't swallow input meant for the main prompt
+	s.closed.Store(true)
+	s.mut.Lock()
+	s.notice = "Chat closed. Press any key to continue"
+	s.mut.Unlock()
+	s.draw()
+	for len(s.keys) > 0 {
+		<-s.keys
+	}
+	<-s.keys
+	s.restore()
+	return nil
+}
+
+// returns the terminal to the state it was in before the interface started
+func (s *screen) restore() {
+	fmt.Print("\033[?25h\033[?1049l")
+	term.Restore(int(os.Stdin.Fd()), s.oldState)
+}
+
+// reads and decodes key presses from stdin until the interface closes
+func (s *screen) readKeys() {
+	defer close(s.keys)
+	buf := make([]byte, KEY_BUFFER_SIZE)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			s.keys <- key{code: KEY_CTRL_C}
+			return
+		}
+		for _, k := range decodeKeys(buf[:n]) {
+			s.keys <- k
+		}
+		if s.closed.Load() {
+			return
+		}
+	}
+}
+
+// decodes raw terminal input into key presses
+func decodeKeys(input []byte) []key {
+	var keys []key
+	for len(input) > 0 {
+		// escape sequences for the arrow and navigation keys
+		if input[0] == '\033' && len(input) > 2 && (input[1] == '[' || input[1] == 'O') {
+			end := 2
+			for end < len(input) && (input[end] < 0x40 || input[end] > 0x7e) {
+				end++
+			}
+			if end == len(input) {
+				return keys
+			}
+			sequence := string(input[2 : end+1])
+			input = input[end+1:]
+			switch sequence {
+			case "A":
+				keys = append(keys, key{code: KEY_UP})
+			case "B":
+				keys = append(keys, key{code: KEY_DOWN})
+			case "C":
+				keys = append(keys, key{code: KEY_RIGHT})
+			case "D":
+				keys = append(keys, key{code: KEY_LEFT})
+			case "H", "1~", "7~":
+				keys = append(keys, key{code: KEY_HOME})
+			case "F", "4~", "8~":
+				keys = append(keys, key{code: KEY_END})
+			case "3~":
+				keys = append(keys, key{code: KEY_DELETE})
+			case "5~":
+				keys = append(keys, key{code: KEY_PAGE_UP})
+			case "6~":
+				keys = append(keys, key{code: KEY_PAGE_DOWN})
+			}
+			continue
+		}
+		r, size := utf8.DecodeRune(input)
+		input = input[size:]
+		switch r {
+		case '\r', '\n':
+			keys = append(keys, key{code: KEY_ENTER})
+		case 0x7f, 0x08:
+			keys = append(keys, key{code: KEY_BACKSPACE})
+		case 0x03:
+			keys = append(keys, key{code: KEY_CTRL_C})
+		case 0x0c:
+			keys = append(keys, key{code: KEY_CTRL_L})
+		case 0x15:
+			keys = append(keys, key{code: KEY_CTRL_U})
+		case 0x01:
+			keys = append(keys, key{code: KEY_HOME})
+		case 0x05:
+			keys = append(keys, key{code: KEY_END})
+		default:
+			if r >= 0x20 && r != utf8.RuneError {
+				keys = append(keys, key{code: KEY_RUNE, r: r})
+			}
+		}
+	}
+	return keys
+}
+
+// redraws the interface whenever the terminal is resized
+func (s *screen) watchSize() {
+	for !s.closed.Load() {
+		time.Sleep(RESIZE_POLL_INTERVAL)
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			continue
+		}
+		s.mut.Lock()
+		changed := width != s.width || height != s.height
+		s.width, s.height = width, height
+		s.mut.Unlock()
+		if changed {
+			s.draw()
+		}
+	}
+}
+
+// applies a key press to the input line and message pane, returning true if the input was submitted
+func (s *screen) edit(k key) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	page := max(s.height-3, 1)
+	switch k.code {
+	case KEY_RUNE:
+		s.input = append(s.input[:s.cursor], append([]rune{k.r}, s.input[s.cursor:]...)...)
+		s.cursor++
+	case KEY_BACKSPACE:
+		if s.cursor > 0 {
+			s.input = append(s.input[:s.cursor-1], s.input[s.cursor:]...)
+			s.cursor--
+		}
+	case KEY_DELETE:
+		if s.cursor < len(s.input) {
+			s.input = append(s.input[:s.cursor], s.input[s.cursor+1:]...)
+		}
+	case KEY_LEFT:
+		s.cursor = max(s.cursor-1, 0)
+	case KEY_RIGHT:
+		s.cursor = min(s.cursor+1, len(s.input))
+	case KEY_HOME:
+		s.cursor = 0
+	case KEY_END:
+		s.cursor = len(s.input)
+	case KEY_CTRL_U:
+		s.input = nil
+		s.cursor = 0
+	case KEY_UP:
+		s.scroll++
+	case KEY_DOWN:
+		s.scroll = max(s.scroll-1, 0)
+	case KEY_PAGE_UP:
+		s.scroll += page
+	case KEY_PAGE_DOWN:
+		s.scroll = max(s.scroll-page, 0)
+	case KEY_CTRL_C:
+		// treat ctrl+c as a request to leave the chat, since raw mode doesn't deliver it as a signal
+		s.input = []rune(">disconnect")
+		return true
+	case KEY_ENTER:
+		return true
+	}
+	return false
+}
+
+// sends the input line as a message, or runs it as a command
+func (s *screen) submit() {
+	s.mut.Lock()
+	input := string(s.input)
+	s.input = nil
+	s.cursor = 0
+	s.scroll = 0
+	s.mut.Unlock()
+	if len(input) == 0 {
+		return
+	}
+	if input[0] != '>' {
+		input += "\n"
+		s.ci.session.Send(input)
+		return
+	}
+	tmp := strings.Split(input, " ")
+	var args []string = nil
+	if len(tmp) > 1 {
+		args = tmp[1:]
+	}
+	s.ci.handleCommand(tmp[0], args)
+}
+
+// prompts for a password on the input line, hiding what is typed
+func (s *screen) readPassword(prompt string) ([]byte, error) {
+	s.mut.Lock()
+	savedInput, savedCursor := s.input, s.cursor
+	s.input, s.cursor = nil, 0
+	s.masked = true
+	s.prompt = prompt
+	s.mut.Unlock()
+	s.draw()
+	var err error
+	for {
+		k, ok := <-s.keys
+		if !ok || k.code == KEY_CTRL_C {
+			err = errors.New("password entry cancelled")
+			break
+		}
+		if s.edit(k) {
+			break
+		}
+		s.draw()
+	}
+	s.mut.Lock()
+	password := []byte(string(s.input))
+	s.input, s.cursor = savedInput, savedCursor
+	s.masked = false
+	s.prompt = ""
+	s.mut.Unlock()
+	s.draw()
+	return password, err
+}
+
+// returns the status bar's text
+func (s *screen) status() string {
+	if s.notice != "" {
+		return s.notice
+	}
+	room := s.ci.room
+	tunnel := room.Tunnel()
+	status := fmt.Sprintf("Chat with %v | %v | AES-256-GCM, RSA-%v", tunnel.Peer.Name, cryptoutils.Fingerprint(&tunnel.PeerPubKey)[:16], tunnel.PeerPubKey.N.BitLen())
+	// cover traffic pads every frame to its own size, so it's shown in place of the padding
+	if tunnel.Cover.Enabled() {
+		status += ", " + tunnel.Cover.String()
+	} else if tunnel.Supports(peerutils.FEATURE_PADDING) && tunnel.Padding.Mode != peerutils.PADDING_NONE {
+		status += ", " + tunnel.Padding.String()
+	}
+	if rtt := tunnel.RTT(); rtt != 0 {
+		status += fmt.Sprintf(" | rtt %v", rtt.Round(time.Millisecond))
+	}
+	if room.Active.Load() && room.Unresponsive() {
+		status += " | peer unresponsive"
+	}
+	if room.Ttl() != 0 {
+		status += fmt.Sprintf(" | disappearing messages: %v", room.Ttl())
+	}
+	if !room.Active.Load() {
+		status += " | closed"
+	}
+	if s.scroll != 0 {
+		status += fmt.Sprintf(" | scrolled up %v lines", s.scroll)
+	}
+	return status
+}
+
+// redraws the whole interface in place, without clearing the screen
+func (s *screen) draw() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.width <= 0 || s.height < 3 {
+		return
+	}
+	// render and wrap the messages
+	var buf bytes.Buffer
+	s.ci.room.DisplayMessages(&buf)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		lines = append(lines, wrapLine(line, s.width)...)
+	}
+	paneHeight := s.height - 2
+	s.scroll = min(s.scroll, max(len(lines)-paneHeight, 0))
+	start := max(len(lines)-paneHeight-s.scroll, 0)
+	lines = lines[start:min(start+paneHeight, len(lines))]
+	var out strings.Builder
+	out.WriteString("\033[?25l\033[H")
+	// the status bar, in reverse video
+	status := []rune(s.status())
+	if len(status) > s.width {
+		status = status[:s.width]
+	}
+	out.WriteString("\033[7m" + string(status) + strings.Repeat(" ", s.width-len(status)) + peerutils.ColorReset)
+	// the message pane
+	for i := 0; i < paneHeight; i++ {
+		fmt.Fprintf(&out, "\033[%v;1H", i+2)
+		if i < len(lines) {
+			out.WriteString(lines[i] + peerutils.ColorReset)
+		}
+		out.WriteString("\033[K")
+	}
+	// the input line, scrolled horizontally so the cursor stays visible
+	user := s.ci.room.Tunnel().User
+	prompt := s.prompt
+	if prompt == "" {
+		prompt = user.Name + ": "
+	}
+	input := s.input
+	if s.masked {
+		input = []rune(strings.Repeat("*", len(s.input)))
+	}
+	promptWidth := min(utf8.RuneCountInString(prompt), s.width/2)
+	available := max(s.width-promptWidth-1, 1)
+	offset := max(s.cursor-available, 0)
+	visible := input[offset:min(offset+available, len(input))]
+	fmt.Fprintf(&out, "\033[%v;1H%v%v%v%v%v\033[K", s.height, user.Color, peerutils.Bold, string([]rune(prompt)[:promptWidth]), peerutils.ColorReset, string(visible))
+	fmt.Fprintf(&out, "\033[%v;%vH\033[?25h", s.height, promptWidth+s.cursor-offset+1)
+	os.Stdout.WriteString(out.String())
+}
+
+// splits a line containing ANSI escape sequences into lines of at most width visible characters,
+// carrying the active styles over to each continuation line
+func wrapLine(line string, width int) []string {
+	var lines []string
+	var current strings.Builder
+	active := ""
+	visible := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\033' {
+			end := escapeEnd(line, i)
+			sequence := line[i:end]
+			current.WriteString(sequence)
+			if sequence == peerutils.ColorReset {
+				active = ""
+			} else {
+				active += sequence
+			}
+			i = end
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		i += size
+		if r < 0x20 {
+			// control characters would corrupt the layout
+			r = ' '
+		}
+		if visible == width {
+			lines = append(lines, current.String())
+			current.Reset()
+			current.WriteString(active)
+			visible = 0
+		}
+		current.WriteRune(r)
+		visible++
+	}
+	return append(lines, current.String())
+}
+
+// returns the index just past the ANSI escape sequence starting at start
+func escapeEnd(line string, start int) int {
+	end := start + 1
+	if end < len(line) && line[end] == '[' {
+		end++
+		for end < len(line) && (line[end] < 0x40 || line[end] > 0x7e) {
+			end++
+		}
+	}
+	return min(end+1, len(line))
+}
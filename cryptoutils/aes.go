@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"errors"
+	"fmt"
 )
 
 const (
@@ -12,15 +13,18 @@ const (
 	AES_MIN_CIPHERTEXT_SIZE = aes.BlockSize + 12
 )
 
+// errors callers can check for with errors.Is
+var (
+	ErrInvalidKey = errors.New("invalid key")                      // a key was malformed or the wrong size
+	ErrDecrypt    = errors.New("failed to decrypt the ciphertext") // the ciphertext was tampered with, or encrypted with a different key
+)
+
 // a helper function to strip zeroes from the beginning of a byte slice
 // this isn't necessarily related to AES inherently, however there isn't really a better place to put this function
 func StripZeroes(slice []byte) []byte {
 	pos := 0
-	for {
+	for pos < len(slice) && slice[pos] == 0 {
 		pos++
-		if slice[pos] != 0 || pos == len(slice) {
-			break
-		}
 	}
 	return slice[pos:]
 }
@@ -43,7 +47,7 @@ func GenNonce() []byte {
 func AesEncrypt(plaintext []byte, key []byte) ([]byte, error) {
 	// validate the size of the key
 	if len(key) != AES_KEY_SIZE {
-		return nil, errors.New("invalid AES key size")
+		return nil, fmt.Errorf("%w: expected a %v byte AES key", ErrInvalidKey, AES_KEY_SIZE)
 	}
 	// create a cipher
 	aesCipher, err := aes.NewCipher(key)
@@ -54,16 +58,18 @@ func AesEncrypt(plaintext []byte, key []byte) ([]byte, error) {
 	// generate a nonce
 	nonce := make([]byte, gcm.NonceSize())
 	rand.Reader.Read(nonce)
-	ciphertext := gcm.Seal(plaintext[:0], nonce, plaintext, nil)
-	ciphertext = append(nonce, ciphertext...)
-	return ciphertext, nil
+	// the ciphertext is appended to the nonce, leaving the plaintext untouched for callers that still need it
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
 }
 
 // decrypts a ciphertext encrypted with AesEncrypt
 func AesDecrypt(ciphertext []byte, key []byte) ([]byte, error) {
 	// validate the size of the key and ciphertext
 	if len(key) != AES_KEY_SIZE {
-		return nil, errors.New("invalid AES key size")
+		return nil, fmt.Errorf("%w: expected a %v byte AES key", ErrInvalidKey, AES_KEY_SIZE)
+	}
+	if len(ciphertext) < AES_MIN_CIPHERTEXT_SIZE {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrDecrypt)
 	}
 	// create the cipher
 	aesCipher, err := aes.NewCipher(key)
@@ -74,11 +80,10 @@ func AesDecrypt(ciphertext []byte, key []byte) ([]byte, error) {
 	// parse the ciphertext into a nonce and the rest of the ciphertext
 	nonce := ciphertext[:gcm.NonceSize()]
 	ciphertext = ciphertext[gcm.NonceSize():]
-	// attempt to decrypt the plaintext
-	plaintext := make([]byte, len(ciphertext)-gcm.NonceSize())
-	plaintext, err = gcm.Open(plaintext, nonce, ciphertext, nil)
+	// attempt to decrypt the plaintext, which is returned exactly, without any leading zeroes
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return nil, err
+		return nil, ErrDecrypt
 	}
 	return plaintext, nil
 }
@@ -1,6 +1,10 @@
 package cryptoutils
 
-import "crypto/sha256"
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+)
 
 // generates an AES key from a password, by hashing it with a salt repeatedly
 func HashKey(password []byte, salt []byte, rounds int) []byte {
@@ -13,3 +17,11 @@ func HashKey(password []byte, salt []byte, rounds int) []byte {
 	}
 	return key
 }
+
+// derives an AES key from a private key, so that data can be encrypted for its owner without another password
+// keys derived for different purposes are unrelated to each other
+func DeriveKey(prvKey *rsa.PrivateKey, purpose string) []byte {
+	mac := hmac.New(sha256.New, prvKey.D.Bytes())
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
@@ -4,9 +4,10 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
-	"errors"
 	"fmt"
 	"os"
 )
@@ -17,6 +18,9 @@ const (
 	SALT_SIZE      = 16
 )
 
+// returned when a key file can't be parsed
+var errKeyFile = fmt.Errorf("rsa: %w file", ErrInvalidKey)
+
 func ExportRsaPrivateKey(prvKey *rsa.PrivateKey, keyPath string, password []byte) error {
 	prvBytes := x509.MarshalPKCS1PrivateKey(prvKey)
 	var pemBlock pem.Block
@@ -40,17 +44,33 @@ func ExportRsaPrivateKey(prvKey *rsa.PrivateKey, keyPath string, password []byte
 			Bytes: prvCiphertext,
 		}
 	}
-	// export the created pem to a file
-	prvFile, err := os.Create(fmt.Sprintf("%v/prv.pem", keyPath))
+	// export the created pem to a file, through a temporary file so that an existing key isn't lost if writing fails
+	prvPath := fmt.Sprintf("%v/prv.pem", keyPath)
+	err := os.WriteFile(prvPath+".tmp", pem.EncodeToMemory(&pemBlock), 0600)
 	if err != nil {
 		return err
 	}
-	defer prvFile.Close()
-	_, err = prvFile.Write(pem.EncodeToMemory(&pemBlock))
+	return os.Rename(prvPath+".tmp", prvPath)
+}
+
+// returns true if the private key at the provided path is encrypted with a password
+func RsaPrivateKeyEncrypted(keyPath string) (bool, error) {
+	contents, err := os.ReadFile(fmt.Sprintf("%v/prv.pem", keyPath))
 	if err != nil {
-		return err
+		return false, err
+	}
+	pemBlock, _ := pem.Decode(contents)
+	if pemBlock == nil {
+		return false, errKeyFile
+	}
+	switch pemBlock.Type {
+	case "RSA PRIVATE KEY":
+		return false, nil
+	case "ENCRYPTED RSA PRIVATE KEY":
+		return true, nil
+	default:
+		return false, errKeyFile
 	}
-	return nil
 }
 
 func ImportRsaPrivateKey(keyPath string, password []byte) (*rsa.PrivateKey, error) {
@@ -66,17 +86,23 @@ func ImportRsaPrivateKey(keyPath string, password []byte) (*rsa.PrivateKey, erro
 		return nil, err
 	}
 	pemBlock, _ := pem.Decode(buf)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("%w: malformed RSA private key", ErrInvalidKey)
+	}
 	// read the private key
 	switch pemBlock.Type {
 	case "RSA PRIVATE KEY":
 		prvKey, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
 		}
 		return prvKey, nil
 	case "ENCRYPTED RSA PRIVATE KEY":
 		// parse the ciphertext
 		prvCiphertext := pemBlock.Bytes
+		if len(prvCiphertext) < SALT_SIZE+AES_MIN_CIPHERTEXT_SIZE {
+			return nil, fmt.Errorf("%w: malformed RSA private key", ErrInvalidKey)
+		}
 		salt := prvCiphertext[:SALT_SIZE]
 		prvCiphertext = prvCiphertext[SALT_SIZE:]
 		key := HashKey(password, salt, 256)
@@ -85,14 +111,13 @@ func ImportRsaPrivateKey(keyPath string, password []byte) (*rsa.PrivateKey, erro
 		if err != nil {
 			return nil, err
 		}
-		prvBytes = StripZeroes(prvBytes)
 		prvKey, err := x509.ParsePKCS1PrivateKey(prvBytes)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
 		}
 		return prvKey, nil
 	default:
-		return nil, errors.New("rsa: invalid rsa key file")
+		return nil, errKeyFile
 	}
 }
 
@@ -100,6 +125,11 @@ func ImportRsaPrivateKey(keyPath string, password []byte) (*rsa.PrivateKey, erro
 func GenerateRsaKeys(keyPath string, password []byte) error {
 	// generate the rsa keys
 	priv, _ := rsa.GenerateKey(rand.Reader, RSA_KEY_SIZE)
+	return ExportRsaKeys(priv, keyPath, password)
+}
+
+// saves a private key and its public key to the provided path
+func ExportRsaKeys(priv *rsa.PrivateKey, keyPath string, password []byte) error {
 	err := ExportRsaPrivateKey(priv, keyPath, password)
 	if err != nil {
 		return err
@@ -136,24 +166,33 @@ func ImportRsa(keyPath string, password []byte) (rsa.PrivateKey, rsa.PublicKey,
 	}
 	pubBlock, _ := pem.Decode(pubBuf)
 	if pubBlock == nil {
-		return rsa.PrivateKey{}, rsa.PublicKey{}, errors.New("invalid RSA private key")
+		return rsa.PrivateKey{}, rsa.PublicKey{}, fmt.Errorf("%w: malformed RSA public key", ErrInvalidKey)
 	}
 	pubKey, err := x509.ParsePKCS1PublicKey(pubBlock.Bytes)
 	if err != nil {
-		return rsa.PrivateKey{}, rsa.PublicKey{}, err
+		return rsa.PrivateKey{}, rsa.PublicKey{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
 	}
 	return *prvKey, *pubKey, nil
 }
 
+// imports the public key from the provided path, which doesn't require the private key's password
+func ImportRsaPubFile(keyPath string) (rsa.PublicKey, error) {
+	contents, err := os.ReadFile(fmt.Sprintf("%v/pub.pem", keyPath))
+	if err != nil {
+		return rsa.PublicKey{}, err
+	}
+	return ImportRsaPub(contents)
+}
+
 // imports an RSA public key from a byte string of the pem-encoded key
 func ImportRsaPub(pemStr []byte) (rsa.PublicKey, error) {
 	pubBlock, _ := pem.Decode(pemStr)
 	if pubBlock == nil {
-		return rsa.PublicKey{}, errors.New("invalid RSA public key")
+		return rsa.PublicKey{}, fmt.Errorf("%w: malformed RSA public key", ErrInvalidKey)
 	}
 	pubKey, err := x509.ParsePKCS1PublicKey(pubBlock.Bytes)
 	if err != nil {
-		return rsa.PublicKey{}, err
+		return rsa.PublicKey{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
 	}
 	return *pubKey, err
 }
@@ -168,6 +207,12 @@ func ExportRsaPub(pubKey *rsa.PublicKey) []byte {
 	return pem.EncodeToMemory(&pubBlock)
 }
 
+// returns the hex-encoded SHA256 hash of a public key, used to identify keys compactly
+func Fingerprint(pubKey *rsa.PublicKey) string {
+	hash := sha256.Sum256(x509.MarshalPKCS1PublicKey(pubKey))
+	return hex.EncodeToString(hash[:])
+}
+
 // encrypts a given plaintext with the provided public key
 func RsaEncrypt(pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
 	cipherText, err := rsa.EncryptPKCS1v15(rand.Reader, pubKey, plaintext)
@@ -181,7 +226,7 @@ func RsaEncrypt(pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
 func RsaDecrypt(prvKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
 	plaintext, err := rsa.DecryptPKCS1v15(nil, prvKey, ciphertext)
 	if err != nil {
-		return nil, err
+		return nil, ErrDecrypt
 	}
 	return plaintext, nil
 }
@@ -0,0 +1,222 @@
+package cryptoutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const SUCCESSION_BLOCK_TYPE = "COURIER KEY SUCCESSION"
+
+// a statement that a key pair has been replaced by a new one, signed by both the old and new private keys
+// a chain of statements links every earlier key of a user to their current key
+type Succession struct {
+	OldKey       []byte    `json:"old_key"` // the PKCS1 encoding of the old public key
+	NewKey       []byte    `json:"new_key"` // the PKCS1 encoding of the new public key
+	Time         time.Time `json:"time"`
+	OldSignature []byte    `json:"old_signature"`
+	NewSignature []byte    `json:"new_signature"`
+}
+
+// creates a statement that oldKey has been replaced by newKey
+func NewSuccession(oldKey *rsa.PrivateKey, newKey *rsa.PrivateKey) (Succession, error) {
+	s := Succession{
+		OldKey: x509.MarshalPKCS1PublicKey(&oldKey.PublicKey),
+		NewKey: x509.MarshalPKCS1PublicKey(&newKey.PublicKey),
+		Time:   time.Now().UTC(),
+	}
+	var err error
+	s.OldSignature, err = RsaSign(*oldKey, s.statement())
+	if err != nil {
+		return Succession{}, err
+	}
+	s.NewSignature, err = RsaSign(*newKey, s.statement())
+	if err != nil {
+		return Succession{}, err
+	}
+	return s, nil
+}
+
+// returns the data both keys sign
+func (s Succession) statement() []byte {
+	oldHash := sha256.Sum256(s.OldKey)
+	newHash := sha256.Sum256(s.NewKey)
+	statement := []byte("courier key succession\n")
+	statement = append(statement, oldHash[:]...)
+	statement = append(statement, newHash[:]...)
+	return append(statement, []byte(s.Time.Format(time.RFC3339Nano))...)
+}
+
+// ensures the statement was signed by both of its keys
+func (s Succession) Verify() error {
+	oldKey, err := x509.ParsePKCS1PublicKey(s.OldKey)
+	if err != nil {
+		return errors.New("succession: invalid old key")
+	}
+	newKey, err := x509.ParsePKCS1PublicKey(s.NewKey)
+	if err != nil {
+		return errors.New("succession: invalid new key")
+	}
+	if !RsaVerify(*oldKey, s.statement(), s.OldSignature) || !RsaVerify(*newKey, s.statement(), s.NewSignature) {
+		return errors.New("succession: invalid signature")
+	}
+	return nil
+}
+
+// returns the fingerprint of the key that was replaced
+func (s Succession) OldFingerprint() string {
+	hash := sha256.Sum256(s.OldKey)
+	return hex.EncodeToString(hash[:])
+}
+
+// returns the fingerprint of the key that replaced it
+func (s Succession) NewFingerprint() string {
+	hash := sha256.Sum256(s.NewKey)
+	return hex.EncodeToString(hash[:])
+}
+
+// ensures every statement in a chain is valid, that each follows on from the one before it, and that the chain ends at pubKey
+func VerifySuccession(chain []Succession, pubKey *rsa.PublicKey) error {
+	for i, s := range chain {
+		err := s.Verify()
+		if err != nil {
+			return err
+		}
+		if i != 0 && chain[i-1].NewFingerprint() != s.OldFingerprint() {
+			return errors.New("succession: the statements don't form a chain")
+		}
+	}
+	if len(chain) != 0 && chain[len(chain)-1].NewFingerprint() != Fingerprint(pubKey) {
+		return errors.New("succession: the statements don't lead to the current key")
+	}
+	return nil
+}
+
+// returns true if a verified chain shows that the key with the given fingerprint was replaced by the chain's final key
+func SucceededFrom(chain []Succession, fingerprint string) bool {
+	for _, s := range chain {
+		if s.OldFingerprint() == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// encodes a chain of statements as PEM blocks
+func EncodeSuccession(chain []Succession) []byte {
+	var encoded []byte
+	for _, s := range chain {
+		statement, _ := json.Marshal(s)
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: SUCCESSION_BLOCK_TYPE, Bytes: statement})...)
+	}
+	return encoded
+}
+
+// decodes the statements from a series of PEM blocks, skipping blocks of any other type
+func DecodeSuccession(data []byte) ([]Succession, error) {
+	var chain []Succession
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return chain, nil
+		}
+		if block.Type != SUCCESSION_BLOCK_TYPE {
+			continue
+		}
+		var s Succession
+		err := json.Unmarshal(block.Bytes, &s)
+		if err != nil {
+			return nil, errors.New("succession: invalid statement")
+		}
+		chain = append(chain, s)
+	}
+}
+
+// reads the chain of statements kept alongside a key pair, which is empty if the keys were never rotated
+func ImportSuccession(keyPath string) ([]Succession, error) {
+	contents, err := os.ReadFile(filepath.Join(keyPath, "succession.pem"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodeSuccession(contents)
+}
+
+// replaces the key pair at keyPath with a new one, encrypted with the same password, and extends its succession chain
+// the old keys are moved to the retired directory inside keyPath, in a directory named after their fingerprint
+func RotateRsaKeys(keyPath string, password []byte) (Succession, error) {
+	oldKey, oldPub, err := ImportRsa(keyPath, password)
+	if err != nil {
+		return Succession{}, err
+	}
+	chain, err := ImportSuccession(keyPath)
+	if err == nil {
+		err = VerifySuccession(chain, &oldPub)
+	}
+	if err != nil {
+		return Succession{}, err
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, RSA_KEY_SIZE)
+	if err != nil {
+		return Succession{}, err
+	}
+	s, err := NewSuccession(&oldKey, newKey)
+	if err != nil {
+		return Succession{}, err
+	}
+	// save the new keys and chain beside the current ones first, so that nothing is replaced unless they're all written
+	staged, err := os.MkdirTemp(keyPath, "rotating-")
+	if err != nil {
+		return Succession{}, err
+	}
+	defer os.RemoveAll(staged)
+	err = ExportRsaKeys(newKey, staged, password)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(staged, "succession.pem"), EncodeSuccession(append(chain, s)), 0600)
+	}
+	if err != nil {
+		return Succession{}, err
+	}
+	// retire the old keys and move the new files into place, putting the old keys back if any of it fails
+	retired := filepath.Join(keyPath, "retired", Fingerprint(&oldPub))
+	err = os.MkdirAll(retired, 0700)
+	if err != nil {
+		return Succession{}, err
+	}
+	var moved []string
+	for _, name := range []string{"prv.pem", "pub.pem"} {
+		err = os.Rename(filepath.Join(keyPath, name), filepath.Join(retired, name))
+		if err != nil {
+			break
+		}
+		moved = append(moved, name)
+	}
+	// the chain goes last, since it's the only file the old keys don't have a copy of
+	for _, name := range []string{"prv.pem", "pub.pem", "succession.pem"} {
+		if err != nil {
+			break
+		}
+		err = os.Rename(filepath.Join(staged, name), filepath.Join(keyPath, name))
+	}
+	if err != nil {
+		for _, name := range moved {
+			os.Rename(filepath.Join(retired, name), filepath.Join(keyPath, name))
+		}
+		// only removes the directories if they're empty, as they are unless the keys were rotated before
+		os.Remove(retired)
+		os.Remove(filepath.Dir(retired))
+		return Succession{}, err
+	}
+	return s, nil
+}
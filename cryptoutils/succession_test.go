@@ -0,0 +1,192 @@
+package cryptoutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// generates n keys for the tests, smaller than the keys users have since succession doesn't depend on key size
+func testKeys(t *testing.T, n int) []*rsa.PrivateKey {
+	t.Helper()
+	keys := make([]*rsa.PrivateKey, n)
+	for i := range keys {
+		var err error
+		keys[i], err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+// creates a statement that oldKey was replaced by newKey, failing the test if it can't
+func testSuccession(t *testing.T, oldKey *rsa.PrivateKey, newKey *rsa.PrivateKey) Succession {
+	t.Helper()
+	s, err := NewSuccession(oldKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerifySuccession(t *testing.T) {
+	keys := testKeys(t, 4)
+	first := testSuccession(t, keys[0], keys[1])
+	second := testSuccession(t, keys[1], keys[2])
+	unrelated := testSuccession(t, keys[3], keys[2])
+	// a statement whose old signature was made by a key other than the old key
+	forged := testSuccession(t, keys[3], keys[2])
+	forged.OldKey = first.OldKey
+	tests := []struct {
+		name  string
+		chain []Succession
+		key   *rsa.PrivateKey
+		valid bool
+	}{
+		{name: "never rotated", chain: nil, key: keys[0], valid: true},
+		{name: "single rotation", chain: []Succession{first}, key: keys[1], valid: true},
+		{name: "valid chain", chain: []Succession{first, second}, key: keys[2], valid: true},
+		{name: "broken link", chain: []Succession{first, unrelated}, key: keys[2]},
+		{name: "wrong signer", chain: []Succession{forged}, key: keys[2]},
+		{name: "truncated chain", chain: []Succession{first}, key: keys[2]},
+		{name: "out of order", chain: []Succession{second, first}, key: keys[1]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifySuccession(test.chain, &test.key.PublicKey)
+			if (err == nil) != test.valid {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestSucceededFrom(t *testing.T) {
+	keys := testKeys(t, 3)
+	chain := []Succession{testSuccession(t, keys[0], keys[1]), testSuccession(t, keys[1], keys[2])}
+	for _, key := range keys[:2] {
+		if !SucceededFrom(chain, Fingerprint(&key.PublicKey)) {
+			t.Fatal("an earlier key wasn't found in the chain")
+		}
+	}
+	if SucceededFrom(chain, Fingerprint(&keys[2].PublicKey)) {
+		t.Fatal("the current key was treated as replaced")
+	}
+}
+
+func TestEncodeSuccession(t *testing.T) {
+	keys := testKeys(t, 3)
+	chain := []Succession{testSuccession(t, keys[0], keys[1]), testSuccession(t, keys[1], keys[2])}
+	// blocks of other types, such as the public key sent alongside the chain, are skipped
+	encoded := append(ExportRsaPub(&keys[2].PublicKey), EncodeSuccession(chain)...)
+	decoded, err := DecodeSuccession(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || VerifySuccession(decoded, &keys[2].PublicKey) != nil {
+		t.Fatalf("decoded %v statements", len(decoded))
+	}
+}
+
+// creates a key pair in a temporary directory, returning its path
+func testKeyPair(t *testing.T, password []byte) string {
+	t.Helper()
+	keyPath := t.TempDir()
+	err := GenerateRsaKeys(keyPath, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPath
+}
+
+func TestRotateRsaKeys(t *testing.T) {
+	password := []byte("password")
+	keyPath := testKeyPair(t, password)
+	_, original, err := ImportRsa(keyPath, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		_, err = RotateRsaKeys(keyPath, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, current, err := ImportRsa(keyPath, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := ImportSuccession(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chain) != i || VerifySuccession(chain, &current) != nil || !SucceededFrom(chain, Fingerprint(&original)) {
+			t.Fatalf("the chain doesn't lead from the original key after %v rotations", i)
+		}
+	}
+	// the original keys are kept, still encrypted with the same password
+	_, retired, err := ImportRsa(filepath.Join(keyPath, "retired", Fingerprint(&original)), password)
+	if err != nil || Fingerprint(&retired) != Fingerprint(&original) {
+		t.Fatalf("the original keys weren't retired: %v", err)
+	}
+}
+
+// returns the names of the files and directories in dir
+func dirEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestRotateRsaKeysRollsBack(t *testing.T) {
+	tests := []struct {
+		name  string
+		block func(t *testing.T, keyPath string, retired string) // makes one step of the rotation fail
+	}{
+		{name: "the old keys can't be retired", block: func(t *testing.T, keyPath string, retired string) {
+			// a file in place of the retired directory stops it being created, after the new keys have been written
+			err := os.WriteFile(filepath.Join(keyPath, "retired"), nil, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "the old public key can't be retired", block: func(t *testing.T, keyPath string, retired string) {
+			// a directory in the way of the old public key stops it being retired, after the private key has been
+			err := os.MkdirAll(filepath.Join(retired, "pub.pem", "in the way"), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			password := []byte("password")
+			keyPath := testKeyPair(t, password)
+			_, original, _ := ImportRsa(keyPath, password)
+			retired := filepath.Join(keyPath, "retired", Fingerprint(&original))
+			test.block(t, keyPath, retired)
+			before := dirEntries(t, keyPath)
+			_, err := RotateRsaKeys(keyPath, password)
+			if err == nil {
+				t.Fatal("rotated the keys without moving every file into place")
+			}
+			_, current, err := ImportRsa(keyPath, password)
+			if err != nil || Fingerprint(&current) != Fingerprint(&original) {
+				t.Fatalf("the original keys weren't restored: %v", err)
+			}
+			if after := dirEntries(t, keyPath); !slices.Equal(before, after) {
+				t.Fatalf("the key directory held %v before rotating, and %v after", before, after)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package daemonutils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// a connection to a running daemon
+type Client struct {
+	conn    net.Conn
+	events  chan Event
+	pending map[int]chan Response
+	nextId  int
+	err     error // set once the connection to the daemon is lost
+	mut     sync.Mutex
+}
+
+// connects to the daemon listening on the socket at path
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, errors.New("daemon: no daemon is running on " + path)
+	}
+	c := &Client{conn: conn, events: make(chan Event, SUBSCRIBER_BUFFER_SIZE), pending: make(map[int]chan Response), nextId: 1}
+	go c.read()
+	return c, nil
+}
+
+// returns the channel events are delivered on after subscribing, it's closed if the connection to the daemon is lost
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// sends a request and waits for its reply, decoding the reply's result into result if it isn't nil
+func (c *Client) Call(request Request, result any) error {
+	reply := make(chan Response, 1)
+	c.mut.Lock()
+	if c.err != nil {
+		c.mut.Unlock()
+		return c.err
+	}
+	request.Id = c.nextId
+	c.nextId++
+	c.pending[request.Id] = reply
+	encoded, err := json.Marshal(request)
+	if err == nil {
+		_, err = c.conn.Write(append(encoded, '\n'))
+	}
+	if err != nil {
+		delete(c.pending, request.Id)
+		c.mut.Unlock()
+		return err
+	}
+	c.mut.Unlock()
+	response, ok := <-reply
+	if !ok {
+		return c.err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	if result != nil && response.Result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+// disconnects from the daemon, leaving its chats running
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// reads replies and events from the daemon until the connection closes
+func (c *Client) read() {
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, peerutils.BUF_SIZE), MAX_REQUEST_SIZE)
+	for scanner.Scan() {
+		var response Response
+		if json.Unmarshal(scanner.Bytes(), &response) != nil {
+			continue
+		}
+		if response.Event != nil {
+			c.events <- *response.Event
+			continue
+		}
+		c.mut.Lock()
+		reply, ok := c.pending[response.Id]
+		delete(c.pending, response.Id)
+		c.mut.Unlock()
+		if ok {
+			reply <- response
+		}
+	}
+	// fail every call still waiting on a reply
+	c.mut.Lock()
+	c.err = errors.New("daemon: lost the connection to the daemon")
+	for _, reply := range c.pending {
+		close(reply)
+	}
+	c.pending = nil
+	c.mut.Unlock()
+	close(c.events)
+}
@@ -0,0 +1,353 @@
+package daemonutils
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// runs chats in the background on behalf of clients connected to its socket
+type Daemon struct {
+	ListenPort  int                                                    // the base port to await peers on
+	OnTunnel    func(tunnel *peerutils.Tunnel, alias string)           // called for every new tunnel before its chat starts, may be nil
+	Hooks       peerutils.Hooks                                        // user commands run on the daemon's events
+	History     func(tunnel *peerutils.Tunnel) *peerutils.HistoryStore // opens the history store for a new tunnel's peer, may be nil
+	Rekey       peerutils.RekeyPolicy                                  // when chats replace their keys, the zero value uses the defaults
+	pubKey      rsa.PublicKey
+	prvKey      rsa.PrivateKey
+	user        peerutils.User
+	ctx         context.Context
+	sessions    map[int]*peerutils.Session
+	nextId      int
+	listening   bool
+	subscribers map[*client]int // subscribed clients, and the session they follow, zero for all sessions
+	mut         sync.Mutex
+}
+
+// a client connected to the daemon's socket
+type client struct {
+	conn net.Conn
+	out  chan Response
+	done chan struct{}
+}
+
+// creates a daemon for the given identity
+func NewDaemon(pubKey rsa.PublicKey, prvKey rsa.PrivateKey, user peerutils.User) *Daemon {
+	return &Daemon{
+		ListenPort:  peerutils.DEFAULT_PORT,
+		pubKey:      pubKey,
+		prvKey:      prvKey,
+		user:        user,
+		sessions:    make(map[int]*peerutils.Session),
+		nextId:      1,
+		subscribers: make(map[*client]int),
+	}
+}
+
+// creates the daemon's Unix socket, which only the current user may connect to
+// a socket left behind by a daemon that is no longer running is replaced
+func Listen(path string) (net.Listener, error) {
+	err := privateDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("daemon: a daemon is already running on " + path)
+	}
+	os.Remove(path)
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// accepts clients until ctx is cancelled, at which point every chat is closed
+func (d *Daemon) Serve(ctx context.Context, listener net.Listener) error {
+	d.ctx = ctx
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		err = checkPeer(conn)
+		if err != nil {
+			fmt.Printf("%vwarning:%v %v\n", peerutils.Yellow, peerutils.ColorReset, err.Error())
+			conn.Close()
+			continue
+		}
+		go d.handle(conn)
+	}
+	d.mut.Lock()
+	for _, session := range d.sessions {
+		session.Close()
+	}
+	d.mut.Unlock()
+	return nil
+}
+
+// reads and answers a client's requests until it disconnects
+func (d *Daemon) handle(conn net.Conn) {
+	c := &client{conn: conn, out: make(chan Response, SUBSCRIBER_BUFFER_SIZE), done: make(chan struct{})}
+	defer func() {
+		d.mut.Lock()
+		delete(d.subscribers, c)
+		d.mut.Unlock()
+		close(c.done)
+		conn.Close()
+	}()
+	go c.write()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, peerutils.BUF_SIZE), MAX_REQUEST_SIZE)
+	for scanner.Scan() {
+		var request Request
+		err := json.Unmarshal(scanner.Bytes(), &request)
+		if err != nil {
+			c.reply(Response{Error: "daemon: invalid request"})
+			continue
+		}
+		// connecting waits on the peer, so it mustn't hold up the client's other requests
+		if request.Method == "connect" {
+			go d.respond(c, request)
+		} else {
+			d.respond(c, request)
+		}
+	}
+}
+
+// writes responses to the client as they're queued
+func (c *client) write() {
+	encoder := json.NewEncoder(c.conn)
+	for {
+		select {
+		case response := <-c.out:
+			if encoder.Encode(response) != nil {
+				c.conn.Close()
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// queues a response for the client, waiting if its queue is full
+func (c *client) reply(response Response) {
+	select {
+	case c.out <- response:
+	case <-c.done:
+	}
+}
+
+// runs a request and replies with its result
+func (d *Daemon) respond(c *client, request Request) {
+	result, err := d.call(c, request)
+	response := Response{Id: request.Id}
+	if err != nil {
+		response.Error = err.Error()
+	} else if result != nil {
+		response.Result, err = json.Marshal(result)
+		if err != nil {
+			response.Error = err.Error()
+		}
+	}
+	c.reply(response)
+}
+
+// runs a request, returning the value to reply with
+func (d *Daemon) call(c *client, request Request) (any, error) {
+	switch request.Method {
+	case "sessions":
+		return d.list(), nil
+	case "connect":
+		tunnel, err := peerutils.ConnectPeer(request.Address, request.Fingerprint, d.pubKey, d.prvKey, d.user)
+		if err != nil {
+			d.verificationFailed(err)
+			return nil, err
+		}
+		return d.open(tunnel, request.Alias), nil
+	case "listen":
+		return nil, d.listen()
+	case "subscribe":
+		if request.Session != 0 {
+			if _, err := d.session(request.Session); err != nil {
+				return nil, err
+			}
+		}
+		d.mut.Lock()
+		d.subscribers[c] = request.Session
+		d.mut.Unlock()
+		return nil, nil
+	case "unsubscribe":
+		d.mut.Lock()
+		delete(d.subscribers, c)
+		d.mut.Unlock()
+		return nil, nil
+	}
+	// the remaining methods all act on a session
+	session, err := d.session(request.Session)
+	if err != nil {
+		return nil, err
+	}
+	switch request.Method {
+	case "history":
+		var history []Event
+		for _, event := range session.History() {
+			history = append(history, newEvent(request.Session, event))
+		}
+		return history, nil
+	case "search":
+		found, err := session.Search(request.Text)
+		if err != nil {
+			return nil, err
+		}
+		var events []Event
+		for _, event := range found {
+			events = append(events, newEvent(request.Session, event))
+		}
+		return events, nil
+	case "send":
+		id, err := session.Send(request.Text)
+		return id, err
+	case "delete":
+		return nil, session.Delete(request.Message)
+	case "ephemeral":
+		return nil, session.SetEphemeral(time.Duration(request.Seconds) * time.Second)
+	case "close":
+		return nil, session.Close()
+	default:
+		return nil, errors.New("daemon: unrecognized method " + request.Method)
+	}
+}
+
+// returns the session with the given id
+func (d *Daemon) session(id int) (*peerutils.Session, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	session, ok := d.sessions[id]
+	if !ok {
+		return nil, errors.New("daemon: no such session")
+	}
+	return session, nil
+}
+
+// returns the details of every running chat
+func (d *Daemon) list() []SessionInfo {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	sessions := []SessionInfo{}
+	for id := 1; id < d.nextId; id++ {
+		session, ok := d.sessions[id]
+		if !ok {
+			continue
+		}
+		peer := session.Peer()
+		sessions = append(sessions, SessionInfo{Id: id, Peer: peer.Name, PeerId: peer.Id, Fingerprint: session.PeerFingerprint(), Active: session.Active(), Unresponsive: session.Unresponsive(), Rtt: int(session.RTT() / time.Millisecond)})
+	}
+	return sessions
+}
+
+// starts a chat over a new tunnel, and returns its details
+func (d *Daemon) open(tunnel *peerutils.Tunnel, alias string) SessionInfo {
+	if d.OnTunnel != nil {
+		d.OnTunnel(tunnel, alias)
+	}
+	opts := peerutils.SessionOptions{Hooks: d.Hooks, Rekey: d.Rekey}
+	if d.History != nil {
+		opts.History = d.History(tunnel)
+	}
+	session := peerutils.NewSession(d.ctx, tunnel, opts)
+	d.mut.Lock()
+	id := d.nextId
+	d.nextId++
+	d.sessions[id] = session
+	d.mut.Unlock()
+	fmt.Printf("Session %v opened with %v (%v)\n", id, tunnel.Peer.Name, cryptoutils.Fingerprint(&tunnel.PeerPubKey))
+	d.broadcast(Event{Session: id, Type: "opened", Sender: tunnel.Peer.Name, SenderId: tunnel.Peer.Id, Time: time.Now()})
+	go d.forward(id, session)
+	return SessionInfo{Id: id, Peer: tunnel.Peer.Name, PeerId: tunnel.Peer.Id, Fingerprint: session.PeerFingerprint(), Active: true}
+}
+
+// passes a session's events on to subscribed clients, and forgets the session once it ends
+func (d *Daemon) forward(id int, session *peerutils.Session) {
+	for event := range session.Events() {
+		d.broadcast(newEvent(id, event))
+	}
+	d.mut.Lock()
+	delete(d.sessions, id)
+	d.mut.Unlock()
+	fmt.Printf("Session %v closed\n", id)
+}
+
+// sends an event to every client subscribed to its session, skipping clients that aren't keeping up
+func (d *Daemon) broadcast(event Event) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	for c, session := range d.subscribers {
+		if session != 0 && session != event.Session {
+			continue
+		}
+		select {
+		case c.out <- Response{Event: &event}:
+		default:
+		}
+	}
+}
+
+// runs the verification_failed hooks if err was caused by a peer failing verification
+func (d *Daemon) verificationFailed(err error) {
+	if !peerutils.IsVerificationError(err) {
+		return
+	}
+	event := peerutils.HookEvent{Event: peerutils.HOOK_VERIFICATION_FAILED, Error: err.Error(), Time: time.Now()}
+	d.Hooks.Fire(event, func(err error) {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+	})
+}
+
+// starts accepting peers in the background, each peer that connects gets a new session
+func (d *Daemon) listen() error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.listening {
+		return errors.New("daemon: already listening")
+	}
+	d.listening = true
+	go func() {
+		fmt.Printf("Listening on port %v\n", d.ListenPort)
+		for d.ctx.Err() == nil {
+			tunnel, err := peerutils.AwaitPeer(d.ListenPort, d.pubKey, d.prvKey, d.user)
+			if err != nil {
+				fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+				d.verificationFailed(err)
+				time.Sleep(time.Second)
+				continue
+			}
+			d.open(tunnel, "")
+		}
+	}()
+	return nil
+}
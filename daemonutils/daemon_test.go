@@ -0,0 +1,146 @@
+//go:build unix
+
+package daemonutils
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+// runs a daemon on a socket in a temporary directory, returning the socket's path
+func testDaemon(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), SOCKET_NAME)
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := NewDaemon(rsa.PublicKey{}, rsa.PrivateKey{}, peerutils.User{Name: "daemon"})
+	// a free port for listen to await peers on, nothing connects to it
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.ListenPort = probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- daemon.Serve(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	})
+	return path
+}
+
+// connects a client to the daemon on the socket at path
+func testClient(t *testing.T, path string) *Client {
+	t.Helper()
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestDaemonSocketIsPrivate(t *testing.T) {
+	path := testDaemon(t)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("the socket's mode is %v", info.Mode().Perm())
+	}
+	// a second daemon can't take over the socket of a running one
+	if _, err := Listen(path); err == nil {
+		t.Fatal("started a second daemon on the same socket")
+	}
+}
+
+func TestListenCreatesPrivateDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "courier")
+	listener, err := Listen(filepath.Join(dir, SOCKET_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Fatalf("the socket's directory's mode is %v", info.Mode().Perm())
+	}
+}
+
+func TestListenRefusesSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	err := os.Chmod(dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := Listen(filepath.Join(dir, SOCKET_NAME)); err == nil {
+		listener.Close()
+		t.Fatal("created a socket in a directory anyone can write to")
+	}
+}
+
+func TestDaemonRequests(t *testing.T) {
+	client := testClient(t, testDaemon(t))
+	var sessions []SessionInfo
+	err := client.Call(Request{Method: "sessions"}, &sessions)
+	if err != nil || sessions == nil || len(sessions) != 0 {
+		t.Fatalf("got sessions %v, %v", sessions, err)
+	}
+	err = client.Call(Request{Method: "listen"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Call(Request{Method: "listen"}, nil) == nil {
+		t.Fatal("started listening twice")
+	}
+	if client.Call(Request{Method: "send", Session: 1, Text: "hello"}, nil) == nil {
+		t.Fatal("sent a message in a session that doesn't exist")
+	}
+	if client.Call(Request{Method: "subscribe", Session: 1}, nil) == nil {
+		t.Fatal("subscribed to a session that doesn't exist")
+	}
+	err = client.Call(Request{Method: "subscribe"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemonRejectsInvalidRequests(t *testing.T) {
+	path := testDaemon(t)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("not json\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response Response
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Error == "" {
+		t.Fatal("the daemon accepted an invalid request")
+	}
+}
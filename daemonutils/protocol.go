@@ -0,0 +1,106 @@
+package daemonutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DrewRoss5/courier/peerutils"
+)
+
+const (
+	SOCKET_NAME            = "courier.sock"
+	MAX_REQUEST_SIZE       = 1 << 20
+	SUBSCRIBER_BUFFER_SIZE = 256
+)
+
+// a request from a client, sent as a single line of JSON
+// only the fields a method uses need to be set
+type Request struct {
+	Id          int    `json:"id"`
+	Method      string `json:"method"`
+	Session     int    `json:"session,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Alias       string `json:"alias,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Text        string `json:"text,omitempty"`
+	Message     uint32 `json:"message,omitempty"`
+	Seconds     int    `json:"seconds,omitempty"`
+}
+
+// a line sent to a client: either the reply to a request, or an event for a subscribed client, which has no id
+type Response struct {
+	Id     int             `json:"id,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Event  *Event          `json:"event,omitempty"`
+}
+
+// a chat the daemon is running
+type SessionInfo struct {
+	Id           int    `json:"id"`
+	Peer         string `json:"peer"`
+	PeerId       string `json:"peer_id"`
+	Fingerprint  string `json:"fingerprint"`
+	Active       bool   `json:"active"`
+	Unresponsive bool   `json:"unresponsive,omitempty"` // set while the peer has missed several heartbeats in a row
+	Rtt          int    `json:"rtt_ms,omitempty"`       // the most recent round trip time to the peer, in milliseconds
+}
+
+// a change to one of the daemon's chats
+type Event struct {
+	Session      int       `json:"session"`
+	Type         string    `json:"type"`
+	Message      uint32    `json:"message"`
+	Sender       string    `json:"sender,omitempty"`
+	SenderId     string    `json:"sender_id,omitempty"`
+	Text         string    `json:"text,omitempty"`
+	Time         time.Time `json:"time"`
+	Ttl          int       `json:"ttl,omitempty"` // the disappearing message timer, in seconds
+	Error        string    `json:"error,omitempty"`
+	Unresponsive bool      `json:"unresponsive,omitempty"` // whether the peer has missed several heartbeats in a row, for status events
+	Rtt          int       `json:"rtt_ms,omitempty"`       // the most recent round trip time to the peer, in milliseconds
+}
+
+// the names events are sent with, indexed by their peerutils type
+var eventNames = map[int]string{
+	peerutils.EVENT_MESSAGE:   "message",
+	peerutils.EVENT_NOTICE:    "notice",
+	peerutils.EVENT_DELETE:    "delete",
+	peerutils.EVENT_CLEAR:     "clear",
+	peerutils.EVENT_EPHEMERAL: "ephemeral",
+	peerutils.EVENT_CLOSED:    "closed",
+	peerutils.EVENT_PREVIOUS:  "previous",
+	peerutils.EVENT_STATUS:    "status",
+}
+
+// converts a session's event to the form it's sent to clients in
+func newEvent(session int, event peerutils.Event) Event {
+	converted := Event{
+		Session:      session,
+		Type:         eventNames[event.Type],
+		Message:      event.Id,
+		Sender:       event.Sender.Name,
+		SenderId:     event.Sender.Id,
+		Text:         event.Text,
+		Time:         event.Time,
+		Ttl:          int(event.Ttl / time.Second),
+		Unresponsive: event.Unresponsive,
+		Rtt:          int(event.Rtt / time.Millisecond),
+	}
+	if event.Err != nil {
+		converted.Error = event.Err.Error()
+	}
+	return converted
+}
+
+// returns the default location of the daemon's socket, inside the user's runtime directory if they have one, and
+// otherwise inside a directory of their own in the temporary directory, which Listen creates
+func DefaultSocketPath() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, SOCKET_NAME)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("courier-%v", os.Getuid()), SOCKET_NAME)
+}
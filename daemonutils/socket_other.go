@@ -0,0 +1,21 @@
+//go:build !unix
+
+package daemonutils
+
+import (
+	"errors"
+	"net"
+)
+
+// other systems can't keep other users away from the socket the same way, so the daemon isn't run on them
+var errUnsupported = errors.New("daemon: the daemon is only supported on Unix systems")
+
+// fails, see errUnsupported
+func listenPrivate(path string) (net.Listener, error) {
+	return nil, errUnsupported
+}
+
+// fails, see errUnsupported
+func privateDir(dir string) error {
+	return errUnsupported
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package daemonutils
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// creates a Unix socket without any permissions for other users, rather than having them removed afterwards
+func listenPrivate(path string) (net.Listener, error) {
+	oldMask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	return listener, err
+}
+
+// creates the directory the socket is kept in if it doesn't exist, and ensures nobody else can replace what's in it
+func privateDir(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm()&0022 != 0 {
+		return errors.New("daemon: the socket's directory must be owned by you, and not writable by anyone else: " + dir)
+	}
+	return nil
+}
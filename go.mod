@@ -2,7 +2,6 @@ module github.com/DrewRoss5/courier
 
 go 1.22.2
 
-require (
-	golang.org/x/sys v0.26.0 // indirect
-	golang.org/x/term v0.25.0 // indirect
-)
+require golang.org/x/term v0.25.0
+
+require golang.org/x/sys v0.26.0 // indirect
@@ -1,25 +1,91 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
 	"os"
 	"slices"
 	"syscall"
 
 	"github.com/DrewRoss5/courier/cliutils"
 	"github.com/DrewRoss5/courier/cryptoutils"
+	"github.com/DrewRoss5/courier/daemonutils"
 	"github.com/DrewRoss5/courier/peerutils"
 	"golang.org/x/term"
 )
 
 func main() {
+	proxyUrl := flag.String("proxy", "", "route all outbound connections through a SOCKS5 proxy (socks5://host:port)")
+	configPath := flag.String("config", "", "the configuration file to use")
+	keyPath := flag.String("key", "", "the directory containing your RSA key pair")
+	name := flag.String("name", "", "your display name")
+	color := flag.String("color", "", "your display color")
+	passwordFd := flag.Int("password-fd", -1, "read the private key or archive password from this file descriptor")
+	plain := flag.Bool("plain", false, "print chats one line at a time, without redrawing the screen")
+	noAnsi := flag.Bool("no-ansi", false, "remove all colors and styles from plain mode output")
+	socketPath := flag.String("socket", daemonutils.DefaultSocketPath(), "the socket the daemon listens on")
+	passwordEnv := flag.String("password-env", "", "read the private key or archive password from this environment variable")
+	newPasswordFd := flag.Int("new-password-fd", -1, "read the new private key password for key passwd and key encrypt from this file descriptor")
+	newPasswordEnv := flag.String("new-password-env", "", "read the new private key password for key passwd and key encrypt from this environment variable")
+	flag.Parse()
+	args := flag.Args()
+	// key commands accept the same flags after the key command's name, e.g. courier key info --key ~/keys
+	if len(args) > 1 && args[0] == "key" {
+		flag.CommandLine.Parse(args[2:])
+		args = append([]string{args[0], args[1]}, flag.Args()...)
+	}
+	// commands that run a chat accept the same flags after the command name, e.g. courier connect --key ~/keys <address>
+	if len(args) > 0 && slices.Contains([]string{"connect", "listen", "relay-connect", "relay-await", "drop", "collect", "archive", "rotate-keys", "daemon", "ctl", "attach"}, args[0]) {
+		flag.CommandLine.Parse(args[1:])
+		args = append([]string{args[0]}, flag.Args()...)
+	}
+	cfg, err := cliutils.LoadConfig(*configPath)
+	// the config command is how a broken configuration is repaired, so it runs regardless
+	if err != nil && (cfg == nil || len(args) == 0 || args[0] != "config") {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("%vWarning:%v %v\n", peerutils.Yellow, peerutils.ColorReset, err.Error())
+	}
+	// flags override the configuration for this run only, so config commands are given the configuration as it's stored
+	stored := *cfg
+	if *keyPath != "" {
+		cfg.KeyPath = *keyPath
+	}
+	if *name != "" {
+		cfg.Name = *name
+	}
+	if *color != "" {
+		cfg.Color = *color
+	}
+	if *plain {
+		cfg.Plain = true
+	}
+	if *noAnsi {
+		cfg.NoAnsi = true
+	}
+	password, err := cliutils.ReadPasswordSource(*passwordFd, *passwordEnv)
+	if err != nil {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		os.Exit(1)
+	}
+	if *proxyUrl == "" {
+		*proxyUrl = cfg.Proxy
+	}
+	err = peerutils.SetProxy(*proxyUrl)
+	if err != nil {
+		fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		os.Exit(1)
+	}
 	// generate the key file if requested
-	if len(os.Args) > 1 && os.Args[1] == "init" {
-		if len(os.Args) != 3 {
+	if len(args) > 0 && args[0] == "init" {
+		if len(args) != 2 {
 			fmt.Printf("%verror:%v This command takes exactly one argument\n", peerutils.Red, peerutils.ColorReset)
 			return
 		}
-		path := os.Args[2]
+		path := args[1]
 		err := os.MkdirAll(path, 0777)
 		if err != nil {
 			fmt.Printf("%verror:%v invalid path", peerutils.Red, peerutils.ColorReset)
@@ -46,7 +112,60 @@ func main() {
 		}
 		fmt.Println("Key pair generated")
 		return
+	} else if len(args) > 0 && args[0] == "config" {
+		cliutils.ConfigCommand(&stored, args[1:])
+	} else if len(args) > 0 && args[0] == "contacts" {
+		cliutils.ContactsCommand(args[1:])
+	} else if len(args) > 0 && args[0] == "history" {
+		cliutils.HistoryCommand(args[1:])
+	} else if len(args) > 0 && args[0] == "key" {
+		newPassword, err := cliutils.ReadPasswordSource(*newPasswordFd, *newPasswordEnv)
+		if err == nil {
+			err = cliutils.KeyCommand(cfg, password, newPassword, args[1:])
+		} else {
+			fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+	} else if len(args) > 0 && (args[0] == "daemon" || args[0] == "ctl" || args[0] == "attach") {
+		switch args[0] {
+		case "daemon":
+			err = cliutils.DaemonCommand(cfg, password, *socketPath, args[1:])
+		case "ctl":
+			err = cliutils.CtlCommand(cfg, *socketPath, args[1:])
+		default:
+			err = cliutils.AttachCommand(*socketPath, args[1:])
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+	} else if len(args) > 0 && args[0] == "relay" {
+		// run a relay server for peers that can't reach each other directly
+		if len(args) > 2 {
+			fmt.Printf("%verror:%v This command takes at most one argument\n", peerutils.Red, peerutils.ColorReset)
+			return
+		}
+		addr := ":" + peerutils.RELAY_PORT
+		if len(args) == 2 {
+			addr = args[1]
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+			return
+		}
+		fmt.Printf("Relay listening on %v\n", listener.Addr())
+		err = peerutils.NewRelay().Serve(listener)
+		if err != nil {
+			fmt.Printf("%verror:%v %v\n", peerutils.Red, peerutils.ColorReset, err.Error())
+		}
+	} else if len(args) > 0 {
+		err = cliutils.RunCommand(cfg, password, args[0], args[1:])
+		if err != nil {
+			os.Exit(1)
+		}
 	} else {
-		cliutils.MainLoop()
+		cliutils.MainLoop(cfg, password)
 	}
 }
@@ -6,45 +6,269 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/DrewRoss5/courier/cryptoutils"
-	"golang.org/x/term"
 )
 
 const (
-	DEFAULT_ROUNDS = 256
-	SALT_SIZE      = 16
-	MAX_MSG_COUNT  = 50
+	DEFAULT_ROUNDS         = 256
+	SALT_SIZE              = 16
+	MAX_MSG_COUNT          = 50
+	MAX_RECONNECT_ATTEMPTS = 6
+	MAX_EPHEMERAL_SECONDS  = 0xffffffff // the longest disappearing message timer, which is sent as a 4 byte count of seconds
+	MESSAGE_ID_WINDOW      = 1024       // how many of the peer's most recent message ids are remembered
 )
 
 type Chatroom struct {
-	Tunnel   Tunnel
-	Messages map[uint32]Message
-	MaxId    uint32
-	Active   bool
-	Mut      sync.Mutex
+	Messages     map[uint32]Message
+	MaxId        uint32
+	Active       atomic.Bool                         // cleared once the chat ends, read by both the sending and recieving goroutines
+	ArchiveDir   string                              // the directory >archive saves to when no path is given
+	ReadPassword func(prompt string) ([]byte, error) // reads passwords for commands such as >archive
+	OnEvent      func(Event)                         // called whenever the chat changes, may be nil
+	Hooks        Hooks                               // user commands run on the chat's events
+	History      *HistoryStore                       // saves the chat's messages between chats with the same peer, may be nil
+	Previous     []Message                           // messages from earlier chats with the peer, shown before this chat's messages
+	Mut          sync.Mutex
+	reconnectMut sync.Mutex
+	closed       atomic.Bool            // set once the chat is closed from this end
+	unresponsive atomic.Bool            // set while the peer has missed several heartbeats in a row
+	tunnel       atomic.Pointer[Tunnel] // the tunnel the chat is using, replaced whenever it's re-established
+	pending      [][]byte               // messages that were not acknowledged by the peer before the connection dropped
+	stored       map[uint32]uint64      // the id of the history entry each saved message was given
+	oldest       uint32                 // the id of the oldest message still held in Messages
+	spillMut     sync.Mutex             // guards spill and spillFailed, taken while holding Mut so that disk access can outlast it
+	spill        *spillSegment          // messages pushed out of Messages, created once it first holds MAX_MSG_COUNT messages
+	spillFailed  bool                   // set once a message couldn't be spilled, so that the failure is only reported once
+	ttl          atomic.Int64           // the chat-wide disappearing message timer, zero when disabled, read by both the sending and recieving goroutines
+	lastId       atomic.Uint64          // the id of the last message sent to the peer, when they support message ids
+	seen         map[uint64]bool        // the ids of the peer's recent messages, only used by the recieving goroutine
+	newestSeen   uint64                 // the highest id of a message from the peer
 }
 
-// appends a new message to the chat history
-func (c *Chatroom) pushMessage(msg *string, user *User) {
+// creates a chat over an established tunnel, which the chatroom takes over
+func NewChatroom(tunnel *Tunnel) *Chatroom {
+	c := &Chatroom{Messages: make(map[uint32]Message)}
+	c.tunnel.Store(tunnel)
+	c.Active.Store(true)
+	return c
+}
+
+// returns the tunnel the chat is currently using, which is replaced whenever the connection drops and is re-established
+// callers using the tunnel more than once should only load it once, so that they all use the same one
+func (c *Chatroom) Tunnel() *Tunnel {
+	return c.tunnel.Load()
+}
+
+// returns the chat-wide disappearing message timer, zero when disabled
+func (c *Chatroom) Ttl() time.Duration {
+	return time.Duration(c.ttl.Load())
+}
+
+// appends a new message to the chat history, and returns its id
+func (c *Chatroom) pushMessage(msg *string, user *User) uint32 {
 	newMessage := NewMessage(*msg, user)
 	c.Mut.Lock()
-	c.Messages[c.MaxId] = *newMessage
+	id := c.MaxId
+	c.Messages[id] = *newMessage
 	c.MaxId++
-	if c.MaxId == 0xffffffff {
+	// once every id has been used, the history is cleared and the ids start over
+	limitReached := c.MaxId == 0xffffffff
+	if limitReached {
 		c.Messages = make(map[uint32]Message)
+		c.stored = nil
+		c.MaxId = 0
+		c.oldest = 0
+	}
+	var spillId uint32
+	var spilled Message
+	var spilledEntry *uint64
+	spilling := len(c.Messages) > MAX_MSG_COUNT
+	if spilling {
+		spillId, spilled, spilledEntry = c.takeOldest()
+	}
+	// the spill is written to once Mut is released, anyone looking for the message being spilled waits on spillMut
+	c.spillMut.Lock()
+	c.Mut.Unlock()
+	if limitReached && c.spill != nil {
+		c.spill.discard()
+		c.spill = nil
+	}
+	var spillErr error
+	if spilling {
+		spillErr = c.spillMessage(spillId, spilled, spilledEntry)
+	}
+	reportSpill := spillErr != nil && !c.spillFailed
+	c.spillFailed = c.spillFailed || spillErr != nil
+	c.spillMut.Unlock()
+	// notices push messages of their own, so they're only added once nothing is held
+	if limitReached {
 		c.serverMessage("Message limit reached. Chat history cleared")
 	}
+	if reportSpill {
+		c.errorMessage("failed to move old messages to disk, they won't be available: " + spillErr.Error())
+	}
+	eventType := EVENT_MESSAGE
+	if user.Id == "" {
+		eventType = EVENT_NOTICE
+	} else {
+		c.save(id, newMessage)
+	}
+	c.notify(Event{Type: eventType, Id: id, Sender: *user, Text: *msg, Time: time.Now()})
+	return id
+}
+
+// removes the oldest message in memory so that it can be spilled, returning it along with its history entry, if any
+// the caller must hold Mut, the message is dropped from memory even if it can't be spilled, so that memory use stays bounded
+func (c *Chatroom) takeOldest() (uint32, Message, *uint64) {
+	c.skipRemoved()
+	id := c.oldest
+	message := c.Messages[id]
+	delete(c.Messages, id)
+	c.oldest++
+	var stored *uint64
+	if entry, ok := c.stored[id]; ok {
+		stored = &entry
+		delete(c.stored, id)
+	}
+	return id, message, stored
+}
+
+// adds a message to the spill segment, creating it if needed, the caller must hold spillMut
+func (c *Chatroom) spillMessage(id uint32, message Message, stored *uint64) error {
+	if c.spill == nil {
+		// once the chat is over, its spilled messages have been discarded, so there's nowhere to put the message
+		if !c.Active.Load() {
+			return nil
+		}
+		var err error
+		c.spill, err = newSpillSegment()
+		if err != nil {
+			return err
+		}
+	}
+	return c.spill.add(id, message, stored)
+}
+
+// moves oldest past messages that have been removed, so that displaying the chat doesn't revisit them
+// the caller must hold Mut
+func (c *Chatroom) skipRemoved() {
+	for c.oldest < c.MaxId {
+		if _, ok := c.Messages[c.oldest]; ok {
+			return
+		}
+		c.oldest++
+	}
+}
+
+// returns the message with the given id, whether it's held in memory or has been spilled
+func (c *Chatroom) message(id uint32) (Message, bool) {
+	c.Mut.Lock()
+	defer c.Mut.Unlock()
+	message, ok := c.Messages[id]
+	if ok {
+		return message, ok
+	}
+	c.spillMut.Lock()
+	defer c.spillMut.Unlock()
+	if c.spill == nil {
+		return message, ok
+	}
+	spilled, ok := c.spill.get(id)
+	return spilled.message(), ok
+}
+
+// discards the messages that were spilled to disk
+func (c *Chatroom) discardSpill() {
+	c.spillMut.Lock()
+	defer c.spillMut.Unlock()
+	if c.spill != nil {
+		c.spill.discard()
+		c.spill = nil
+	}
+}
+
+// reports a change to the chat to the OnEvent callback, if one is set
+func (c *Chatroom) notify(event Event) {
+	if c.OnEvent != nil {
+		c.OnEvent(event)
+	}
+}
+
+// runs the chat's hooks for an event, reporting any failures in the chat
+func (c *Chatroom) fireHooks(event HookEvent) {
+	c.Hooks.Fire(event, func(err error) {
+		c.errorMessage(err.Error())
+	})
+}
+
+// saves a message to the history store, unless there isn't one or disappearing messages are on
+func (c *Chatroom) save(id uint32, message *Message) {
+	if c.History == nil || c.Ttl() != 0 {
+		return
+	}
+	entry, err := c.History.Append(message.sender, message.content, message.sent)
+	if err != nil {
+		c.errorMessage("failed to save the message: " + err.Error())
+		return
+	}
+	c.Mut.Lock()
+	if c.stored == nil {
+		c.stored = make(map[uint32]uint64)
+	}
+	c.stored[id] = entry
 	c.Mut.Unlock()
 }
 
+// removes a message from the local history, and the history store, returning false if it didn't exist
+func (c *Chatroom) remove(id uint32) bool {
+	c.Mut.Lock()
+	_, ok := c.Messages[id]
+	delete(c.Messages, id)
+	entry, saved := c.stored[id]
+	delete(c.stored, id)
+	c.spillMut.Lock()
+	if !ok && c.spill != nil {
+		var spilled spilledMessage
+		spilled, ok = c.spill.remove(id)
+		if ok && spilled.Stored != nil {
+			entry, saved = *spilled.Stored, true
+		}
+	}
+	c.spillMut.Unlock()
+	c.skipRemoved()
+	c.Mut.Unlock()
+	if saved {
+		err := c.History.Remove(entry)
+		if err != nil {
+			c.errorMessage("failed to remove the message from the history: " + err.Error())
+		}
+	}
+	if ok {
+		c.notify(Event{Type: EVENT_DELETE, Id: id, Time: time.Now()})
+	}
+	return ok
+}
+
+// schedules a message to be removed from the local history once the chat's disappearing message timer elapses
+func (c *Chatroom) expire(id uint32) {
+	ttl := c.Ttl()
+	if ttl == 0 {
+		return
+	}
+	time.AfterFunc(ttl, func() {
+		c.remove(id)
+	})
+}
+
 // appends a new message sent from the chatroom itself, used for alerts, and the like
 func (c *Chatroom) serverMessage(msg string) {
 	colored := fmt.Sprintf("%v%v%v\n", Green, msg, ColorReset)
@@ -57,34 +281,211 @@ func (c *Chatroom) errorMessage(msg string) {
 	c.pushMessage(&colored, &User{Name: "Chatroom", Id: "", Color: Green})
 }
 
+// sends a raw message through the tunnel, reconnecting and resending it if the connection has dropped
+// a peer that supports message ids is sent one with every message, so that they can drop a resent message they'd
+// already recieved before the connection dropped
+func (c *Chatroom) send(msg []byte) error {
+	tunnel := c.Tunnel()
+	if tunnel.Supports(FEATURE_MESSAGE_IDS) {
+		msg = append(binary.LittleEndian.AppendUint64([]byte{MESSAGE_NUMBERED}, c.lastId.Add(1)), msg...)
+	}
+	err := tunnel.SendMessage(msg)
+	if err == nil {
+		return nil
+	}
+	if !c.Active.Load() {
+		return err
+	}
+	if errors.Is(err, ErrTimeout) {
+		return c.peerTimedOut(tunnel)
+	}
+	c.reconnectMut.Lock()
+	c.pending = append(c.pending, msg)
+	c.reconnectMut.Unlock()
+	return c.reconnect(tunnel)
+}
+
+// re-establishes the tunnel with backoff, and resends any unacknowledged messages
+// failed is the tunnel the caller saw fail, so that concurrent failures only reconnect once
+func (c *Chatroom) reconnect(failed *Tunnel) error {
+	c.reconnectMut.Lock()
+	defer c.reconnectMut.Unlock()
+	if c.Tunnel() == failed {
+		c.serverMessage("Connection lost. Reconnecting...")
+		delay := time.Second
+		var tunnel *Tunnel
+		var err error
+		for attempt := 0; attempt < MAX_RECONNECT_ATTEMPTS; attempt++ {
+			tunnel, err = failed.Reconnect()
+			if err == nil || !c.Active.Load() {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err != nil || !c.Active.Load() {
+			c.Active.Store(false)
+			c.pending = nil
+			c.errorMessage("Failed to reconnect")
+			if IsVerificationError(err) {
+				event := newHookEvent(HOOK_VERIFICATION_FAILED, failed)
+				event.Error = err.Error()
+				c.fireHooks(event)
+			}
+			if err == nil {
+				err = ErrClosed
+			}
+			return err
+		}
+		tunnel.Rekey = failed.Rekey
+		// messages waiting for a cover traffic slot are sent through the new tunnel
+		tunnel.cover = failed.cover
+		c.tunnel.Store(tunnel)
+		c.serverMessage("Reconnected.")
+	}
+	// resend everything the peer didn't acknowledge before the drop
+	tunnel := c.Tunnel()
+	for len(c.pending) != 0 {
+		msg := c.pending[0]
+		// a peer that no longer supports message ids is sent the message alone
+		if msg[0] == MESSAGE_NUMBERED && !tunnel.Supports(FEATURE_MESSAGE_IDS) {
+			msg = msg[9:]
+		}
+		err := tunnel.SendMessage(msg)
+		if err != nil {
+			return err
+		}
+		c.pending = c.pending[1:]
+	}
+	return nil
+}
+
+// records the id of a message from the peer, returning false if it was already recieved
+// ids older than the last MESSAGE_ID_WINDOW are forgotten, and treated as already recieved
+func (c *Chatroom) firstSeen(id uint64) bool {
+	if id+MESSAGE_ID_WINDOW <= c.newestSeen || c.seen[id] {
+		return false
+	}
+	if c.seen == nil {
+		c.seen = make(map[uint64]bool)
+	}
+	c.seen[id] = true
+	if id > c.newestSeen {
+		c.newestSeen = id
+		for seen := range c.seen {
+			if seen+MESSAGE_ID_WINDOW <= c.newestSeen {
+				delete(c.seen, seen)
+			}
+		}
+	}
+	return true
+}
+
+// ends a chat whose peer stopped responding, a peer that's still connected but silent isn't reconnected to
+func (c *Chatroom) peerTimedOut(tunnel *Tunnel) error {
+	if !c.Active.CompareAndSwap(true, false) {
+		return ErrTimeout
+	}
+	c.serverMessage(fmt.Sprintf("%v%v%v stopped responding. The chat was closed.", tunnel.Peer.Color, tunnel.Peer.Name, Green))
+	tunnel.Incoming.Close()
+	tunnel.Outgoing.Close()
+	return ErrTimeout
+}
+
+// updates whether the peer is unresponsive from when they were last heard from, reporting any change
+func (c *Chatroom) checkPeer() {
+	tunnel := c.Tunnel()
+	unresponsive := time.Since(tunnel.LastHeard()) > tunnel.Heartbeat.Interval*HEARTBEAT_MISSED
+	if c.unresponsive.Swap(unresponsive) == unresponsive {
+		return
+	}
+	c.notify(Event{Type: EVENT_STATUS, Unresponsive: unresponsive, Rtt: tunnel.RTT(), Time: time.Now()})
+}
+
+// returns true while the peer has missed several heartbeats in a row
+func (c *Chatroom) Unresponsive() bool {
+	return c.unresponsive.Load()
+}
+
 // awaits an incoming message, and handles it according to its code
+// a chatroom closed locally keeps reading until its tunnel shuts down, so that the peer's messages are still acknowledged
 func (c *Chatroom) AwaitMessage() error {
-	if !c.Active {
-		return errors.New("chatroom: this chatroom is no longer Active")
+	if !c.Active.Load() && !c.closed.Load() {
+		return ErrClosed
 	}
-	msg, err := c.Tunnel.AwaitMessage()
+	tunnel := c.Tunnel()
+	msg, err := tunnel.AwaitMessage()
 	if err != nil {
-		return err
+		if !c.Active.Load() {
+			return err
+		}
+		if errors.Is(err, ErrTimeout) {
+			return c.peerTimedOut(tunnel)
+		}
+		if IsVerificationError(err) {
+			event := newHookEvent(HOOK_VERIFICATION_FAILED, tunnel)
+			event.Error = err.Error()
+			c.fireHooks(event)
+		}
+		return c.reconnect(tunnel)
 	}
 	// seperate the message from its code and handle it accordingly
-	msgCode := msg[0]
-	msg = msg[1:]
+	msgCode, msg, err := decodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	// a message resent after a reconnect may have been recieved before the connection dropped
+	if msgCode == MESSAGE_NUMBERED {
+		var id uint64
+		id, msg, err = decodeNumbered(msg)
+		if err != nil {
+			return err
+		}
+		if !c.firstSeen(id) {
+			return nil
+		}
+		msgCode, msg, err = decodeMessage(msg)
+		if err != nil {
+			return err
+		}
+	}
 	switch msgCode {
 	case MESSAGE_TXT:
 		messageStr := string(msg)
-		c.pushMessage(&messageStr, &c.Tunnel.Peer)
+		id := c.pushMessage(&messageStr, &tunnel.Peer)
+		c.expire(id)
+		event := newHookEvent(HOOK_MESSAGE_RECEIVED, tunnel)
+		event.MessageId = &id
+		event.Content = messageStr
+		c.fireHooks(event)
 	case MESSAGE_DISCONNECT:
-		c.Active = false
+		c.Active.Store(false)
+		c.serverMessage(fmt.Sprintf("%v%v%v left the chat.", tunnel.Peer.Color, tunnel.Peer.Name, Green))
 	case MESSAGE_DELETE:
-		id := binary.LittleEndian.Uint32(msg)
-		message, ok := c.Messages[id]
-		if ok && message.sender.Id == c.Tunnel.Peer.Id {
-			c.Mut.Lock()
-			delete(c.Messages, id)
-			c.Mut.Unlock()
+		id, err := decodeDelete(msg)
+		if err != nil {
+			return err
 		}
+		message, ok := c.message(id)
+		if ok && message.sender.Id == tunnel.Peer.Id {
+			c.remove(id)
+		}
+	case MESSAGE_DUMMY:
+		// cover traffic carries nothing, and is only sent so that the real messages can't be told apart from it
 	case CHAT_ARCHIVE:
-		c.serverMessage(fmt.Sprintf("%v%v%v archived this chat.", c.Tunnel.Peer.Color, c.Tunnel.Peer.Name, Green))
+		c.serverMessage(fmt.Sprintf("%v%v%v archived this chat.", tunnel.Peer.Color, tunnel.Peer.Name, Green))
+	case MESSAGE_EPHEMERAL:
+		ttl, err := decodeEphemeral(msg)
+		if err != nil {
+			return err
+		}
+		c.ttl.Store(int64(ttl))
+		c.notify(Event{Type: EVENT_EPHEMERAL, Ttl: ttl, Time: time.Now()})
+		if ttl == 0 {
+			c.serverMessage(fmt.Sprintf("%v%v%v turned off disappearing messages.", tunnel.Peer.Color, tunnel.Peer.Name, Green))
+		} else {
+			c.serverMessage(fmt.Sprintf("%v%v%v set disappearing messages to %v.", tunnel.Peer.Color, tunnel.Peer.Name, Green, ttl))
+		}
 	default:
 		return errors.New("chatroom: invalid message recieved")
 	}
@@ -93,15 +494,38 @@ func (c *Chatroom) AwaitMessage() error {
 
 // sends a string message to the peer
 func (c *Chatroom) SendMessage(msg *string) error {
-	tmp := []byte(*msg)
-	msgBytes := append([]byte{MESSAGE_TXT}, tmp...)
-	err := c.Tunnel.SendMessage(msgBytes)
+	_, err := c.sendText(*msg)
+	return err
+}
+
+// sends a message to the peer, and returns its id in the chat history
+func (c *Chatroom) sendText(msg string) (uint32, error) {
+	msgBytes := append([]byte{MESSAGE_TXT}, msg...)
+	err := c.send(msgBytes)
+	if err != nil {
+		return 0, err
+	}
+	id := c.pushMessage(&msg, &c.Tunnel().User)
+	c.expire(id)
+	return id, nil
+}
+
+// sets the chat-wide disappearing message timer on both ends of the chat, a ttl of zero disables it
+func (c *Chatroom) SetEphemeral(ttl time.Duration) error {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(ttl/time.Second))
+	err := c.send(append([]byte{MESSAGE_EPHEMERAL}, buf...))
 	if err != nil {
 		return err
 	}
-	c.pushMessage(msg, &c.Tunnel.User)
+	c.ttl.Store(int64(ttl))
+	c.notify(Event{Type: EVENT_EPHEMERAL, Ttl: ttl, Time: time.Now()})
+	if ttl == 0 {
+		c.serverMessage("Disappearing messages turned off.")
+	} else {
+		c.serverMessage(fmt.Sprintf("Disappearing messages set to %v.", ttl))
+	}
 	return nil
-
 }
 
 // sends a message and waits for a given number of seconds before deleting it
@@ -109,7 +533,7 @@ func (c *Chatroom) TimedMessage(msg *string, delay int) {
 	id := c.MaxId
 	err := c.SendMessage(msg)
 	if err != nil {
-		c.Active = false
+		c.Active.Store(false)
 		return
 	}
 	time.Sleep(time.Second * time.Duration(delay))
@@ -117,26 +541,73 @@ func (c *Chatroom) TimedMessage(msg *string, delay int) {
 }
 
 // deletes the message with a specified ID from the chat
-func (c *Chatroom) DeleteMessage(id uint32) {
-	c.Mut.Lock()
-	delete(c.Messages, id)
-	c.Mut.Unlock()
-	buf := make([]byte, 4)
-	binary.LittleEndian.AppendUint32(buf, id)
-	err := c.Tunnel.SendMessage(append([]byte{MESSAGE_DELETE}, buf...))
+func (c *Chatroom) DeleteMessage(id uint32) error {
+	c.remove(id)
+	err := c.send(binary.LittleEndian.AppendUint32([]byte{MESSAGE_DELETE}, id))
 	if err != nil {
-		c.Active = false
+		c.Active.Store(false)
 	}
+	return err
+}
+
+// ends the chat from this end, letting the peer know, closing a chat that's already closed does nothing
+func (c *Chatroom) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	// there's nobody to notify if the peer has already left
+	peerLeft := !c.Active.Swap(false)
+	tunnel := c.Tunnel()
+	if peerLeft {
+		tunnel.Incoming.Close()
+		tunnel.Outgoing.Close()
+		return nil
+	}
+	return tunnel.Shutdown()
 }
 
 // displays all of the Messages currently in the archive
 func (c *Chatroom) DisplayMessages(file io.Writer) {
-	if len(c.Messages) == 0 {
-		fmt.Printf("%v%vNo messages to display%v\n", Italic, Gray, ColorReset)
+	c.Mut.Lock()
+	defer c.Mut.Unlock()
+	if len(c.Messages) == 0 && len(c.Previous) == 0 {
+		fmt.Fprintf(file, "%v%vNo messages to display%v\n", Italic, Gray, ColorReset)
 		return
 	}
-	var i uint32
-	for i = 0; i < c.MaxId; i++ {
+	c.displayPrevious(file)
+	c.displayFrom(file, 0)
+}
+
+// displays the messages from earlier chats with the peer
+func (c *Chatroom) DisplayPrevious(file io.Writer) {
+	c.Mut.Lock()
+	defer c.Mut.Unlock()
+	c.displayPrevious(file)
+}
+
+// displays the messages from earlier chats, followed by a divider, the caller must hold Mut
+func (c *Chatroom) displayPrevious(file io.Writer) {
+	if len(c.Previous) == 0 {
+		return
+	}
+	for _, message := range c.Previous {
+		message.Display(file)
+	}
+	fmt.Fprintf(file, "%v%v--- earlier chats above ---%v\n", Italic, Gray, ColorReset)
+}
+
+// displays the messages with an id of at least start, and returns the id the next message will have
+func (c *Chatroom) DisplayMessagesSince(file io.Writer, start uint32) uint32 {
+	c.Mut.Lock()
+	defer c.Mut.Unlock()
+	c.displayFrom(file, start)
+	return c.MaxId
+}
+
+// displays the messages with an id of at least start, the caller must hold Mut
+func (c *Chatroom) displayFrom(file io.Writer, start uint32) {
+	// messages older than oldest have been spilled to disk, and aren't shown
+	for i := max(start, c.oldest); i < c.MaxId; i++ {
 		// under normal circumstances, all id's should be sequential, however, this is to account for messages potentially being deleted
 		message, ok := c.Messages[i]
 		if ok {
@@ -145,16 +616,141 @@ func (c *Chatroom) DisplayMessages(file io.Writer) {
 	}
 }
 
+// returns up to count of the most recent messages that have been spilled to disk, oldest first
+func (c *Chatroom) Older(count int) ([]Message, error) {
+	c.Mut.Lock()
+	defer c.Mut.Unlock()
+	c.spillMut.Lock()
+	defer c.spillMut.Unlock()
+	if c.spill == nil {
+		return nil, nil
+	}
+	var messages []Message
+	skip := max(c.spill.count()-count, 0)
+	err := c.spill.each(func(message spilledMessage) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		messages = append(messages, message.message())
+		return true
+	})
+	return messages, err
+}
+
+// returns every message in the chat (including those spilled to disk) containing query, ignoring case
+// messages from the chatroom itself aren't searched
+func (c *Chatroom) Search(query string) ([]Message, error) {
+	query = strings.ToLower(query)
+	matches := func(message Message) bool {
+		return message.sender.Id != "" && strings.Contains(strings.ToLower(message.content), query)
+	}
+	c.Mut.Lock()
+	defer c.Mut.Unlock()
+	var found []Message
+	c.spillMut.Lock()
+	if c.spill != nil {
+		err := c.spill.each(func(spilled spilledMessage) bool {
+			if message := spilled.message(); matches(message) {
+				found = append(found, message)
+			}
+			return true
+		})
+		if err != nil {
+			c.spillMut.Unlock()
+			return nil, err
+		}
+	}
+	c.spillMut.Unlock()
+	for i := c.oldest; i < c.MaxId; i++ {
+		if message, ok := c.Messages[i]; ok && matches(message) {
+			found = append(found, message)
+		}
+	}
+	return found, nil
+}
+
+// returns messages as they're displayed, one per line
+func displayed(messages []Message) string {
+	var buf bytes.Buffer
+	for _, message := range messages {
+		message.Display(&buf)
+	}
+	return buf.String()
+}
+
 // handles a chat command, and returns the string to be output to the terminal after running
 func (c *Chatroom) HandleCommand(command string, args []string) {
 	switch command {
 	// clears the message history
 	case ">clear":
+		c.Mut.Lock()
 		c.Messages = make(map[uint32]Message)
+		c.Previous = nil
+		c.oldest = c.MaxId
+		// spilled messages are cleared too, but remember their history entries so that deleting them still reaches the history
+		c.spillMut.Lock()
+		if c.spill != nil {
+			if c.stored == nil {
+				c.stored = make(map[uint32]uint64)
+			}
+			c.spill.each(func(message spilledMessage) bool {
+				if message.Stored != nil {
+					c.stored[message.Id] = *message.Stored
+				}
+				return true
+			})
+			c.spill.discard()
+			c.spill = nil
+		}
+		c.spillMut.Unlock()
+		c.Mut.Unlock()
+		c.notify(Event{Type: EVENT_CLEAR, Time: time.Now()})
 		c.serverMessage("Messages cleared")
+	// shows the messages that no longer fit on screen
+	case ">history":
+		count := MAX_MSG_COUNT
+		if len(args) > 1 {
+			c.errorMessage("This command takes at most one argument")
+			return
+		}
+		if len(args) == 1 {
+			var err error
+			count, err = strconv.Atoi(args[0])
+			if err != nil || count <= 0 {
+				c.errorMessage("Invalid message count")
+				return
+			}
+		}
+		messages, err := c.Older(count)
+		if err != nil {
+			c.errorMessage("failed to read older messages: " + err.Error())
+			return
+		}
+		if len(messages) == 0 {
+			c.serverMessage("No older messages")
+			return
+		}
+		c.serverMessage(fmt.Sprintf("The %v messages before the oldest shown:\n%v", len(messages), strings.TrimSuffix(displayed(messages), "\n")))
+	// searches every message in the chat
+	case ">search":
+		if len(args) == 0 {
+			c.errorMessage("This command takes at least one argument")
+			return
+		}
+		messages, err := c.Search(strings.Join(args, " "))
+		if err != nil {
+			c.errorMessage("failed to search older messages: " + err.Error())
+			return
+		}
+		if len(messages) == 0 {
+			c.serverMessage("No messages found")
+			return
+		}
+		c.serverMessage(fmt.Sprintf("%v message(s) found:\n%v", len(messages), strings.TrimSuffix(displayed(messages), "\n")))
 	// terminates the connection
 	case ">disconnect":
-		err := c.Tunnel.Shutdown()
+		err := c.Close()
 		if err != nil {
 			c.errorMessage("failed to close the chatroom")
 			return
@@ -162,16 +758,18 @@ func (c *Chatroom) HandleCommand(command string, args []string) {
 		c.serverMessage("Chat closed.")
 	// returns the peer's ID
 	case ">peerid":
-		c.serverMessage(fmt.Sprintf("%v%v%v Has the ID\n%v%v%v", c.Tunnel.Peer.Color, c.Tunnel.Peer.Name, ColorReset, Green, c.Tunnel.Peer.Id, ColorReset))
+		tunnel := c.Tunnel()
+		c.serverMessage(fmt.Sprintf("%v%v%v Has the ID\n%v%v%v\nand the key fingerprint %v", tunnel.Peer.Color, tunnel.Peer.Name, ColorReset, Green, tunnel.Peer.Id, Green, cryptoutils.Fingerprint(&tunnel.PeerPubKey)))
 	// deletes a message from the chat history on both user's ends
 	case ">delete":
+		user := c.Tunnel().User
 		var id uint32
 		if len(args) == 0 {
 			id = c.MaxId - 1
 			// find the last message the user sent
-			for id > 0 {
+			for id > c.oldest {
 				message, ok := c.Messages[id]
-				if ok && message.sender.Id == c.Tunnel.User.Id {
+				if ok && message.sender.Id == user.Id {
 					break
 				}
 				id--
@@ -184,8 +782,8 @@ func (c *Chatroom) HandleCommand(command string, args []string) {
 			}
 			id = uint32(tmp)
 		}
-		message, ok := c.Messages[id]
-		if !ok || message.sender.Id != c.Tunnel.User.Id {
+		message, ok := c.message(id)
+		if !ok || message.sender.Id != user.Id {
 			c.errorMessage("Invalid message id")
 			return
 		}
@@ -219,8 +817,46 @@ func (c *Chatroom) HandleCommand(command string, args []string) {
 		msg += ColorReset + "\n"
 		c.SendMessage(&msg)
 
+	// sets or disables the chat-wide disappearing message timer
+	case ">ephemeral":
+		if len(args) != 1 {
+			c.errorMessage("This command takes exactly one argument")
+			return
+		}
+		var ttl time.Duration
+		if args[0] != "off" {
+			var err error
+			ttl, err = time.ParseDuration(args[0])
+			if err != nil {
+				// fall back to treating the duration as a number of seconds, as >timed does
+				seconds, convErr := strconv.Atoi(args[0])
+				if convErr != nil {
+					c.errorMessage("Invalid duration")
+					return
+				}
+				ttl = time.Second * time.Duration(seconds)
+			}
+			if ttl < time.Second {
+				c.errorMessage("Duration must be at least one second")
+				return
+			}
+			if ttl/time.Second > MAX_EPHEMERAL_SECONDS {
+				c.errorMessage(fmt.Sprintf("Duration must be at most %v", time.Duration(MAX_EPHEMERAL_SECONDS)*time.Second))
+				return
+			}
+			ttl = ttl.Truncate(time.Second)
+		}
+		err := c.SetEphemeral(ttl)
+		if err != nil {
+			c.Active.Store(false)
+			c.errorMessage("connection severed")
+			return
+		}
 	// archive the chat
 	case ">archive":
+		if len(args) == 0 && c.ArchiveDir != "" {
+			args = []string{c.ArchiveDir}
+		}
 		if len(args) < 1 || len(args) > 2 {
 			c.errorMessage("That command takes between one and two arguments")
 			return
@@ -241,45 +877,54 @@ func (c *Chatroom) HandleCommand(command string, args []string) {
 				return
 			}
 		}
-		fmt.Print("Password: ")
-		password, err := term.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			c.errorMessage("Failed to read the message")
+		if c.Ttl() != 0 {
+			c.errorMessage("Chats can't be archived while disappearing messages are on")
 			return
 		}
-		fmt.Print("\nConfirm Password: ")
-		confirm, _ := term.ReadPassword(int(syscall.Stdin))
-		if slices.Compare(confirm, password) != 0 {
-			c.errorMessage("Password does not match confirmation. Archive not saved")
+		if c.ReadPassword == nil {
+			c.errorMessage("Archiving isn't supported here")
 			return
 		}
-		err = c.ArchiveChat(password, args[0], rounds)
+		password, err := c.ReadPassword("Password: ")
 		if err != nil {
-			c.errorMessage(err.Error())
+			c.errorMessage("Failed to read the message")
 			return
 		}
-		// inform the other user that the chat has been archived
-		err = c.Tunnel.SendMessage([]byte{CHAT_ARCHIVE})
-		if err != nil {
-			c.Active = false
-			c.errorMessage("connection severed")
+		confirm, _ := c.ReadPassword("Confirm Password: ")
+		if slices.Compare(confirm, password) != 0 {
+			c.errorMessage("Password does not match confirmation. Archive not saved")
 			return
 		}
-		c.serverMessage("Chat archived")
-	// severs the connection and exits the application
-	case ">exit":
-		err := c.Tunnel.Shutdown()
+		err = c.Archive(password, args[0], rounds)
 		if err != nil {
-			c.errorMessage("failed to close the chatroom")
-			return
+			c.errorMessage(err.Error())
 		}
-		os.Exit(0)
 	default:
 		c.errorMessage("unrecognized message")
 		return
 	}
 }
 
+// archives the chat, and lets the peer know it was archived
+func (c *Chatroom) Archive(password []byte, path string, rounds int) error {
+	if c.Ttl() != 0 {
+		return errors.New("chatroom: chats can't be archived while disappearing messages are on")
+	}
+	err := c.ArchiveChat(password, path, rounds)
+	if err != nil {
+		return err
+	}
+	// inform the other user that the chat has been archived
+	err = c.send([]byte{CHAT_ARCHIVE})
+	if err != nil {
+		c.Active.Store(false)
+		c.errorMessage("connection severed")
+		return err
+	}
+	c.serverMessage("Chat archived")
+	return nil
+}
+
 // archives a chat and saves it to a file in a given path
 func (c *Chatroom) ArchiveChat(password []byte, path string, rounds int) error {
 	// create the path if needed
@@ -290,9 +935,20 @@ func (c *Chatroom) ArchiveChat(password []byte, path string, rounds int) error {
 	// generate a key
 	salt := cryptoutils.GenNonce()
 	key := cryptoutils.HashKey(password, salt, rounds)
-	// write the chat to a buffer, and encrypt it
+	// write the chat to a buffer, including any messages spilled to disk, and encrypt it
 	var buf bytes.Buffer
-	c.DisplayMessages(&buf)
+	older, err := c.Older(math.MaxInt)
+	if err != nil {
+		return err
+	}
+	c.DisplayPrevious(&buf)
+	buf.WriteString(displayed(older))
+	c.Mut.Lock()
+	c.displayFrom(&buf, 0)
+	c.Mut.Unlock()
+	if buf.Len() == 0 {
+		c.DisplayMessages(&buf)
+	}
 	ciphertext, err := cryptoutils.AesEncrypt(buf.Bytes(), key)
 	if err != nil {
 		return err
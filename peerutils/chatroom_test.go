@@ -0,0 +1,143 @@
+package peerutils
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestFirstSeen(t *testing.T) {
+	tests := []struct {
+		name  string
+		ids   []uint64
+		first []bool
+	}{
+		{name: "in order", ids: []uint64{1, 2, 3}, first: []bool{true, true, true}},
+		{name: "repeated", ids: []uint64{1, 2, 2, 1}, first: []bool{true, true, false, false}},
+		{name: "out of order", ids: []uint64{2, 1, 3, 1}, first: []bool{true, true, true, false}},
+		{name: "older than the window", ids: []uint64{2, MESSAGE_ID_WINDOW + 2, 1}, first: []bool{true, true, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var room Chatroom
+			for i, id := range test.ids {
+				if first := room.firstSeen(id); first != test.first[i] {
+					t.Fatalf("id %v was seen first %v, expected %v", id, first, test.first[i])
+				}
+			}
+			if len(room.seen) > MESSAGE_ID_WINDOW {
+				t.Fatalf("remembered %v ids", len(room.seen))
+			}
+		})
+	}
+}
+
+func TestResentMessageShownOnce(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []string
+		shown    int
+	}{
+		{name: "with message ids", features: []string{FEATURE_MESSAGE_IDS}, shown: 1},
+		// peers without message ids can't tell a resent message apart from a new one
+		{name: "without message ids", features: nil, shown: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := testTunnels(t, handshakeResult{features: test.features})
+			sender := NewChatroom(a)
+			reciever := NewChatroom(b)
+			recieved := make(chan error)
+			go func() {
+				for i := 0; i < 2; i++ {
+					recieved <- reciever.AwaitMessage()
+				}
+			}()
+			msg := "sent twice"
+			err := sender.SendMessage(&msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-recieved; err != nil {
+				t.Fatal(err)
+			}
+			// the peer recieved the message, but its acknowledgement was lost along with the connection
+			resent := append([]byte{MESSAGE_TXT}, msg...)
+			if sender.Tunnel().Supports(FEATURE_MESSAGE_IDS) {
+				resent = append(binary.LittleEndian.AppendUint64([]byte{MESSAGE_NUMBERED}, sender.lastId.Load()), resent...)
+			}
+			sender.pending = [][]byte{resent}
+			// a tunnel other than the current one failing only resends the pending messages
+			err = sender.reconnect(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-recieved; err != nil {
+				t.Fatal(err)
+			}
+			if len(reciever.Messages) != test.shown {
+				t.Fatalf("the message was shown %v times, expected %v", len(reciever.Messages), test.shown)
+			}
+		})
+	}
+}
+
+func TestResendWithoutMessageIds(t *testing.T) {
+	a, b := testTunnels(t, handshakeResult{})
+	sender := NewChatroom(a)
+	reciever := NewChatroom(b)
+	// a message numbered for a tunnel that supported ids, resent through one that doesn't
+	sender.pending = [][]byte{append(binary.LittleEndian.AppendUint64([]byte{MESSAGE_NUMBERED}, 1), append([]byte{MESSAGE_TXT}, "resent"...)...)}
+	recieved := make(chan error)
+	go func() {
+		recieved <- reciever.AwaitMessage()
+	}()
+	err := sender.reconnect(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-recieved; err != nil {
+		t.Fatal(err)
+	}
+	if len(reciever.Messages) != 1 {
+		t.Fatalf("recieved %v messages, expected 1", len(reciever.Messages))
+	}
+}
+
+func TestReconnectDeliversPendingMessagesOnce(t *testing.T) {
+	// the first connection drops after the peer recieves the third message, and the second after they recieve the
+	// fourth frame sent through it, the first of which is the resent third message
+	a, b := testReconnectingTunnels(t, handshakeResult{features: []string{FEATURE_MESSAGE_IDS}}, 3, 4)
+	sender, reciever := NewSession(context.Background(), a, SessionOptions{}), NewSession(context.Background(), b, SessionOptions{})
+	defer reciever.Close()
+	defer sender.Close()
+	var sent []string
+	for i := 0; i < 10; i++ {
+		text := fmt.Sprint("message ", i)
+		_, err := sender.Send(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, text)
+	}
+	var recieved []string
+	for len(recieved) < len(sent) {
+		recieved = append(recieved, nextEvent(t, reciever, EVENT_MESSAGE).Text)
+	}
+	if !slices.Equal(recieved, sent) {
+		t.Fatalf("recieved %q, expected %q", recieved, sent)
+	}
+	// a message shown twice would arrive ahead of this one
+	_, err := sender.Send("last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := nextEvent(t, reciever, EVENT_MESSAGE); last.Text != "last" {
+		t.Fatalf("recieved %q again", last.Text)
+	}
+	if sender.Chatroom().Tunnel() == a {
+		t.Fatal("the tunnel was never reconnected")
+	}
+}
@@ -0,0 +1,134 @@
+package peerutils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// a known peer, mapping a memorable alias to their address and pinned key
+type Contact struct {
+	Alias       string
+	Address     string // the peer's address, optionally followed by a port
+	Fingerprint string // the peer's pinned key fingerprint, empty until it is first pinned
+	PublicKey   string `json:",omitempty"` // the PEM encoded key with the pinned fingerprint, once the peer has been connected to
+	Notes       string
+	Color       string // the name of the color to display the peer in, overriding their own choice
+}
+
+// a set of contacts, stored as JSON
+type ContactBook struct {
+	Contacts map[string]Contact
+	path     string
+}
+
+// returns the default location of the contact book, inside the user's configuration directory
+func DefaultContactsPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "courier", "contacts.json"), nil
+}
+
+// reads a contact book from a file, returning an empty book if the file doesn't exist yet
+func LoadContacts(path string) (*ContactBook, error) {
+	book := ContactBook{Contacts: make(map[string]Contact), path: path}
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, &book.Contacts)
+	if err != nil {
+		return nil, errors.New("contacts: invalid contacts file")
+	}
+	return &book, nil
+}
+
+// writes the contact book back to the file it was loaded from
+func (b *ContactBook) Save() error {
+	err := os.MkdirAll(filepath.Dir(b.path), 0700)
+	if err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(b.Contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.path, contents, 0600)
+}
+
+// returns the contact with the given alias
+func (b *ContactBook) Get(alias string) (Contact, bool) {
+	contact, ok := b.Contacts[alias]
+	return contact, ok
+}
+
+// returns the contact whose pinned key has the given fingerprint
+func (b *ContactBook) FindByFingerprint(fingerprint string) (Contact, bool) {
+	for _, contact := range b.Contacts {
+		if contact.Fingerprint != "" && contact.Fingerprint == fingerprint {
+			return contact, true
+		}
+	}
+	return Contact{}, false
+}
+
+// adds or replaces a contact, after validating it
+func (b *ContactBook) Set(contact Contact) error {
+	if contact.Alias == "" || strings.ContainsAny(contact.Alias, " \t\n") {
+		return errors.New("contacts: aliases can't be empty or contain whitespace")
+	}
+	if contact.Address == "" {
+		return errors.New("contacts: contacts must have an address")
+	}
+	contact.Fingerprint = strings.ToLower(contact.Fingerprint)
+	if contact.Fingerprint != "" && !ValidFingerprint(contact.Fingerprint) {
+		return errors.New("contacts: invalid key fingerprint")
+	}
+	if contact.PublicKey != "" {
+		pubKey, err := cryptoutils.ImportRsaPub([]byte(contact.PublicKey))
+		if err != nil || cryptoutils.Fingerprint(&pubKey) != contact.Fingerprint {
+			return errors.New("contacts: the contact's key doesn't match their pinned fingerprint")
+		}
+	}
+	if _, err := ParseColor(contact.Color); err != nil {
+		return err
+	}
+	b.Contacts[contact.Alias] = contact
+	return nil
+}
+
+// removes a contact, returning false if there was no such contact
+func (b *ContactBook) Remove(alias string) bool {
+	_, ok := b.Contacts[alias]
+	delete(b.Contacts, alias)
+	return ok
+}
+
+// returns all contacts, sorted by alias
+func (b *ContactBook) List() []Contact {
+	contacts := make([]Contact, 0, len(b.Contacts))
+	for _, contact := range b.Contacts {
+		contacts = append(contacts, contact)
+	}
+	slices.SortFunc(contacts, func(a Contact, b Contact) int {
+		return strings.Compare(a.Alias, b.Alias)
+	})
+	return contacts
+}
+
+// determines if a string is a well-formed key fingerprint
+func ValidFingerprint(fingerprint string) bool {
+	decoded, err := hex.DecodeString(fingerprint)
+	return err == nil && len(decoded) == 32
+}
@@ -0,0 +1,80 @@
+package peerutils
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+func TestContactBookRoundTrip(t *testing.T) {
+	keyA, _ := testKeys(t)
+	fingerprint := cryptoutils.Fingerprint(&keyA.PublicKey)
+	path := filepath.Join(t.TempDir(), "courier", "contacts.json")
+	book, err := LoadContacts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = book.Set(Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: strings.ToUpper(fingerprint), Color: "cyan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = book.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadContacts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contact, ok := loaded.Get("alice")
+	if !ok || contact.Address != "10.0.0.1" || contact.Color != "cyan" {
+		t.Fatalf("looked up %+v", contact)
+	}
+	// fingerprints are stored in lowercase, so they can be compared directly
+	found, ok := loaded.FindByFingerprint(fingerprint)
+	if !ok || found.Alias != "alice" {
+		t.Fatalf("found %+v by fingerprint", found)
+	}
+	if _, ok := loaded.Get("bob"); ok {
+		t.Fatal("found a contact that was never added")
+	}
+}
+
+func TestContactValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		contact Contact
+	}{
+		{name: "empty alias", contact: Contact{Address: "10.0.0.1"}},
+		{name: "whitespace in alias", contact: Contact{Alias: "al ice", Address: "10.0.0.1"}},
+		{name: "no address", contact: Contact{Alias: "alice"}},
+		{name: "malformed fingerprint", contact: Contact{Alias: "alice", Address: "10.0.0.1", Fingerprint: "abc"}},
+		{name: "unknown color", contact: Contact{Alias: "alice", Address: "10.0.0.1", Color: "mauve"}},
+		{name: "malformed key", contact: Contact{Alias: "alice", Address: "10.0.0.1", PublicKey: "not a key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			book := &ContactBook{Contacts: make(map[string]Contact)}
+			if book.Set(test.contact) == nil {
+				t.Fatal("accepted an invalid contact")
+			}
+		})
+	}
+}
+
+func TestHandshakeRefusesUnpinnedKey(t *testing.T) {
+	keyA, keyB := testKeys(t)
+	userA, userB := testUser(t, keyA, "a"), testUser(t, keyB, "b")
+	initiatorConn, acceptorConn := net.Pipe()
+	defer acceptorConn.Close()
+	go acceptHandshake(acceptorConn, "", keyB.PublicKey, *keyB, userB)
+	// the pin belongs to a, so b's key doesn't match it
+	_, err := initiateHandshake(initiatorConn, cryptoutils.Fingerprint(&keyA.PublicKey), keyA.PublicKey, *keyA, userA)
+	initiatorConn.Close()
+	if err == nil {
+		t.Fatal("completed a handshake with a peer whose key didn't match the pin")
+	}
+}
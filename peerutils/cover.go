@@ -0,0 +1,203 @@
+package peerutils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_COVER_INTERVAL = 500 * time.Millisecond
+	MIN_COVER_INTERVAL     = 50 * time.Millisecond
+	MAX_COVER_INTERVAL     = 10 * time.Second
+	DEFAULT_COVER_SIZE     = 1024
+	MIN_COVER_SIZE         = 1024 // large enough that a new key always fits in a single frame
+	MAX_COVER_SIZE         = 16 * 1024
+	COVER_SIZE_STEP        = 256
+	MAX_FRAGMENTED_SIZE    = 1024 * 1024 // the largest message that's reassembled from fragments
+)
+
+// how often a tunnel in cover traffic mode sends a frame, and the size every frame is padded to
+// the zero value disables cover traffic
+type CoverPolicy struct {
+	Interval time.Duration `json:"interval"`
+	Size     int           `json:"size"`
+}
+
+// the cover traffic this user asks peers to use, sent during handshakes
+var cover CoverPolicy
+
+// sets the cover traffic asked for during handshakes, a chat uses cover traffic if either peer asks for it
+func SetCover(policy CoverPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	cover = policy
+	return nil
+}
+
+// creates an enabled cover traffic policy, an interval or size of zero uses the default
+func ParseCover(interval time.Duration, size int) (CoverPolicy, error) {
+	policy := CoverPolicy{Interval: interval, Size: size}
+	if policy.Interval == 0 {
+		policy.Interval = DEFAULT_COVER_INTERVAL
+	}
+	if policy.Size == 0 {
+		policy.Size = DEFAULT_COVER_SIZE
+	}
+	return policy, policy.Validate()
+}
+
+// returns true if the policy sends cover traffic
+func (p CoverPolicy) Enabled() bool {
+	return p.Interval != 0
+}
+
+// ensures the policy is one this version can apply
+func (p CoverPolicy) Validate() error {
+	if !p.Enabled() {
+		return nil
+	}
+	if p.Interval < MIN_COVER_INTERVAL || p.Interval > MAX_COVER_INTERVAL {
+		return errors.New("cover: the interval must be between 50 milliseconds and 10 seconds")
+	}
+	// frames are kept off multiples of RecvAll's chunk size, which a multiple of 256 plus the signature and GCM overhead never is
+	if p.Size < MIN_COVER_SIZE || p.Size > MAX_COVER_SIZE || p.Size%COVER_SIZE_STEP != 0 {
+		return errors.New("cover: the frame size must be a multiple of 256 between 1024 and 16384")
+	}
+	return nil
+}
+
+// describes the policy as it's shown to users
+func (p CoverPolicy) String() string {
+	if !p.Enabled() {
+		return "no cover traffic"
+	}
+	return fmt.Sprintf("cover traffic: %v byte frames every %v", p.Size, p.Interval)
+}
+
+// returns the policy a chat uses given both peers' policies: either peer asking for cover traffic turns it on, at
+// the faster rate and larger frame size of the two
+func agreeCover(a CoverPolicy, b CoverPolicy) CoverPolicy {
+	if !a.Enabled() {
+		return b
+	}
+	if !b.Enabled() {
+		return a
+	}
+	return CoverPolicy{Interval: min(a.Interval, b.Interval), Size: max(a.Size, b.Size)}
+}
+
+// a message waiting to be sent in cover traffic mode, split into frames that each fill one slot
+type coverMessage struct {
+	frames [][]byte
+	done   chan error
+}
+
+// the messages a tunnel in cover traffic mode is waiting to send
+// it's shared by copies of the tunnel, and carried over when the tunnel is reconnected
+type coverQueue struct {
+	policy  CoverPolicy
+	pending []*coverMessage
+	stopped bool
+	mut     sync.Mutex
+}
+
+// creates an empty queue for a tunnel using the given policy
+func newCoverQueue(policy CoverPolicy) *coverQueue {
+	return &coverQueue{policy: policy}
+}
+
+// queues a message and waits until it's been sent, or has failed to send
+func (q *coverQueue) send(message []byte) error {
+	queued := &coverMessage{frames: q.fragment(message), done: make(chan error, 1)}
+	q.mut.Lock()
+	if q.stopped {
+		q.mut.Unlock()
+		return errors.New("cover: the tunnel is no longer sending")
+	}
+	q.pending = append(q.pending, queued)
+	q.mut.Unlock()
+	return <-queued.done
+}
+
+// splits a message into frames that each fit in a single padded frame, a message that fits already is left whole
+func (q *coverQueue) fragment(message []byte) [][]byte {
+	// every frame needs room for the padding's end marker
+	if len(message) < q.policy.Size {
+		return [][]byte{message}
+	}
+	chunkSize := q.policy.Size - 3
+	var frames [][]byte
+	for len(message) != 0 {
+		chunk := message[:min(chunkSize, len(message))]
+		message = message[len(chunk):]
+		more := byte(0)
+		if len(message) != 0 {
+			more = 1
+		}
+		frames = append(frames, append([]byte{MESSAGE_FRAGMENT, more}, chunk...))
+	}
+	return frames
+}
+
+// returns the next frame to send, or nil if nothing is waiting
+func (q *coverQueue) next() []byte {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	return q.pending[0].frames[0]
+}
+
+// records the outcome of sending the frame returned by next, completing its message once every frame is sent
+// a frame that fails fails its whole message
+func (q *coverQueue) sent(err error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	current := q.pending[0]
+	current.frames = current.frames[1:]
+	if err != nil || len(current.frames) == 0 {
+		current.done <- err
+		q.pending = q.pending[1:]
+	}
+}
+
+// fails every waiting message, and any sent afterwards
+func (q *coverQueue) stop() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.stopped = true
+	for _, waiting := range q.pending {
+		waiting.done <- errors.New("cover: the tunnel is no longer sending")
+	}
+	q.pending = nil
+}
+
+// sends one frame every interval until stop is closed: the next waiting frame, or a dummy frame when nothing is
+// waiting, so that an observer can't tell when messages are sent
+// every frame goes through the tunnel the chat is using at the time, so that the schedule carries on after a reconnect,
+// and a dummy frame that fails is left to the receiving goroutine, which notices the same failure
+func (c *Chatroom) runCover(stop <-chan struct{}) {
+	queue := c.Tunnel().cover
+	ticker := time.NewTicker(queue.policy.Interval)
+	defer ticker.Stop()
+	defer queue.stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		tunnel := c.Tunnel()
+		frame := queue.next()
+		if frame == nil {
+			tunnel.sendNow([]byte{MESSAGE_DUMMY})
+			continue
+		}
+		queue.sent(tunnel.sendNow(frame))
+	}
+}
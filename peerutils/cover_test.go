@@ -0,0 +1,160 @@
+package peerutils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// returns a message of the given size that's easy to tell apart from a corrupted one
+func testMessage(size int) []byte {
+	message := make([]byte, size)
+	message[0] = MESSAGE_TXT
+	for i := 1; i < size; i++ {
+		message[i] = byte(i)
+	}
+	return message
+}
+
+// splits a message as a tunnel sending 1024 byte cover frames would
+func testFragments(message []byte) [][]byte {
+	return newCoverQueue(CoverPolicy{Interval: DEFAULT_COVER_INTERVAL, Size: DEFAULT_COVER_SIZE}).fragment(message)
+}
+
+func TestFragments(t *testing.T) {
+	large := testMessage(3 * DEFAULT_COVER_SIZE)
+	chunk := make([]byte, MAX_COVER_SIZE)
+	var oversized [][]byte
+	for size := 0; size <= MAX_FRAGMENTED_SIZE; size += len(chunk) {
+		oversized = append(oversized, append([]byte{MESSAGE_FRAGMENT, 1}, chunk...))
+	}
+	tests := []struct {
+		name    string
+		rekey   bool
+		frames  [][]byte
+		message []byte
+		err     error
+	}{
+		{name: "reassembled", frames: testFragments(large), message: large},
+		{name: "rekeyed between fragments", rekey: true, frames: testFragments(large), message: large},
+		{name: "single fragment", frames: [][]byte{append([]byte{MESSAGE_FRAGMENT, 0}, large...)}, message: large},
+		{name: "oversized", frames: oversized, err: ErrMalformed},
+		{name: "interleaved with a chat message", frames: append(testFragments(large)[:1], testMessage(16)), err: ErrMalformed},
+		{name: "interleaved with a dummy frame", frames: append(testFragments(large)[:2], []byte{MESSAGE_DUMMY}), err: ErrMalformed},
+		{name: "interleaved with a heartbeat", frames: append(testFragments(large)[:1], []byte{MESSAGE_HEARTBEAT}), err: ErrMalformed},
+		{name: "nested fragment", frames: testFragments(append([]byte{MESSAGE_FRAGMENT, 0}, large...)), err: ErrMalformed},
+		{name: "missing continuation flag", frames: [][]byte{{MESSAGE_FRAGMENT}}, err: ErrMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			features := []string{FEATURE_PADDING, FEATURE_HEARTBEAT, FEATURE_COVER}
+			if test.rekey {
+				features = append(features, FEATURE_REKEY)
+			}
+			a, b := testTunnels(t, handshakeResult{features: features, padding: PaddingPolicy{Mode: PADDING_BLOCK, Block: DEFAULT_COVER_SIZE}})
+			// a new key before every frame shows that rekeys can come between fragments
+			a.Rekey = RekeyPolicy{Messages: 1}
+			sent := make(chan error, 1)
+			go func() {
+				var err error
+				for _, frame := range test.frames {
+					err = a.sendNow(frame)
+					if err != nil {
+						break
+					}
+				}
+				sent <- err
+			}()
+			message, err := b.AwaitMessage()
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if test.err != nil {
+				if err := <-sent; !errors.Is(err, ErrMessageRejected) {
+					t.Fatalf("the sender got %v, expected ErrMessageRejected", err)
+				}
+				return
+			}
+			if !bytes.Equal(message, test.message) {
+				t.Fatalf("reassembled %v bytes, expected %v", len(message), len(test.message))
+			}
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCoverTraffic(t *testing.T) {
+	policy := CoverPolicy{Interval: MIN_COVER_INTERVAL, Size: DEFAULT_COVER_SIZE}
+	a, b := testTunnels(t, handshakeResult{features: supportedFeatures, padding: PaddingPolicy{Mode: PADDING_BLOCK, Block: policy.Size}, cover: policy})
+	stop := make(chan struct{})
+	defer close(stop)
+	go NewChatroom(a).runCover(stop)
+	messages := [][]byte{testMessage(16), testMessage(5 * policy.Size), testMessage(policy.Size - 1)}
+	sent := make(chan error, len(messages))
+	for _, message := range messages {
+		go func() {
+			sent <- a.SendMessage(message)
+		}()
+		// dummy frames fill the slots no message was waiting for
+		received := []byte{MESSAGE_DUMMY}
+		for received[0] == MESSAGE_DUMMY {
+			var err error
+			received, err = b.AwaitMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(received, message) {
+			t.Fatalf("received %v bytes, expected %v", len(received), len(message))
+		}
+		select {
+		case err := <-sent:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the sender wasn't told the message was sent")
+		}
+	}
+}
+
+func TestCoverTrafficSurvivesReconnect(t *testing.T) {
+	policy := CoverPolicy{Interval: MIN_COVER_INTERVAL, Size: DEFAULT_COVER_SIZE}
+	template := handshakeResult{features: supportedFeatures, padding: PaddingPolicy{Mode: PADDING_BLOCK, Block: policy.Size}, heartbeat: DEFAULT_HEARTBEAT_INTERVAL, cover: policy}
+	a, b := testReconnectingTunnels(t, template)
+	sender, reciever := NewSession(context.Background(), a, SessionOptions{}), NewSession(context.Background(), b, SessionOptions{})
+	defer reciever.Close()
+	defer sender.Close()
+	// a message sent before the drop shows the schedule is running on the first tunnel
+	_, err := sender.Send("before the drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, reciever, EVENT_MESSAGE)
+	// the next message waits for a slot while the connection drops under it
+	sent := make(chan error, 1)
+	go func() {
+		_, err := sender.Send("after the drop")
+		sent <- err
+	}()
+	a.Incoming.Close()
+	a.Outgoing.Close()
+	if recieved := nextEvent(t, reciever, EVENT_MESSAGE); recieved.Text != "after the drop" {
+		t.Fatalf("recieved %q", recieved.Text)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sender wasn't told the message was sent")
+	}
+	if sender.Chatroom().Tunnel() == a {
+		t.Fatal("the tunnel was never reconnected")
+	}
+}
@@ -0,0 +1,184 @@
+package peerutils
+
+import (
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// a message from a peer that couldn't be decoded, every decoder in this file checks its input's length before
+// reading it, so that a hostile peer's messages fail with one of these rather than a panic
+type DecodeError struct {
+	Message string // the kind of message, such as "frame" or "delete message"
+	Reason  string
+	Err     error // the sentinel error this wraps, ErrMalformed unless the message was well formed but untrustworthy
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode: invalid %v: %v", e.Message, e.Reason)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// creates a DecodeError for a malformed message
+func invalid(message string, reason string) error {
+	return &DecodeError{Message: message, Reason: reason, Err: ErrMalformed}
+}
+
+// splits a frame recieved through a tunnel into the sender's signature and the ciphertext
+func decodeFrame(raw []byte) ([]byte, []byte, error) {
+	if len(raw) < cryptoutils.SIGNATURE_SIZE+cryptoutils.AES_MIN_CIPHERTEXT_SIZE {
+		return nil, nil, invalid("frame", "too short")
+	}
+	return raw[:cryptoutils.SIGNATURE_SIZE], raw[cryptoutils.SIGNATURE_SIZE:], nil
+}
+
+// splits a decrypted message into its code and its body
+func decodeMessage(message []byte) (byte, []byte, error) {
+	if len(message) == 0 {
+		return 0, nil, invalid("message", "empty")
+	}
+	return message[0], message[1:], nil
+}
+
+// returns the id of the message a delete message removes
+func decodeDelete(body []byte) (uint32, error) {
+	if len(body) != 4 {
+		return 0, invalid("delete message", "expected a 4 byte id")
+	}
+	return binary.LittleEndian.Uint32(body), nil
+}
+
+// returns the disappearing message timer an ephemeral message sets
+func decodeEphemeral(body []byte) (time.Duration, error) {
+	if len(body) != 4 {
+		return 0, invalid("ephemeral message", "expected a 4 byte timer")
+	}
+	return time.Second * time.Duration(binary.LittleEndian.Uint32(body)), nil
+}
+
+// returns the new key a rekey message carries, decrypted with the user's private key
+func decodeRekey(prvKey *rsa.PrivateKey, body []byte) ([]byte, error) {
+	key, err := cryptoutils.RsaDecrypt(prvKey, body)
+	if err != nil || len(key) != cryptoutils.AES_KEY_SIZE {
+		return nil, invalid("rekey message", "expected an encrypted AES key")
+	}
+	return key, nil
+}
+
+// returns the id a numbered message was sent with, and the message itself
+func decodeNumbered(body []byte) (uint64, []byte, error) {
+	if len(body) < 9 {
+		return 0, nil, invalid("numbered message", "expected an 8 byte id followed by a message")
+	}
+	return binary.LittleEndian.Uint64(body), body[8:], nil
+}
+
+// returns whether more fragments follow a fragment, and the part of the message it carries
+func decodeFragment(body []byte) (bool, []byte, error) {
+	if len(body) == 0 || body[0] > 1 {
+		return false, nil, invalid("fragment", "expected a continuation flag")
+	}
+	return body[0] == 1, body[1:], nil
+}
+
+// returns the public key, succession statements and hello a peer opens a handshake with, the hello is nil if
+// they didn't send one
+func decodeInit(message []byte) (rsa.PublicKey, []cryptoutils.Succession, *hello, error) {
+	code, body, err := decodeMessage(message)
+	if err != nil {
+		return rsa.PublicKey{}, nil, nil, err
+	}
+	if code != MESSAGE_INIT {
+		return rsa.PublicKey{}, nil, nil, invalid("handshake request", "unrecognized request")
+	}
+	peerPub, chain, err := parsePeerKey(body)
+	if err != nil {
+		return rsa.PublicKey{}, nil, nil, err
+	}
+	peerHello, err := decodeHello(body)
+	if err != nil {
+		return rsa.PublicKey{}, nil, nil, err
+	}
+	return peerPub, chain, peerHello, nil
+}
+
+// returns the hello sent after a peer's key and succession statements, nil if they didn't send one
+func decodeHello(data []byte) (*hello, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, nil
+		}
+		if block.Type != HELLO_BLOCK_TYPE {
+			continue
+		}
+		var h hello
+		if json.Unmarshal(block.Bytes, &h) != nil {
+			return nil, invalid("hello", "malformed JSON")
+		}
+		if len(h.Versions) == 0 || len(h.Suites) == 0 || len(h.KeyTypes) == 0 {
+			return nil, invalid("hello", "expected at least one version, cipher suite and key type")
+		}
+		return &h, nil
+	}
+}
+
+// returns the 16 byte challenge decrypted from the initiator's challenge message
+func decodeChallenge(ciphertext []byte, sessionKey []byte) ([]byte, error) {
+	challenge, err := cryptoutils.AesDecrypt(ciphertext, sessionKey)
+	if err != nil {
+		return nil, invalid("challenge", "failed to decrypt")
+	}
+	if len(challenge) != 16 {
+		return nil, invalid("challenge", "expected 16 bytes")
+	}
+	return challenge, nil
+}
+
+// decrypts the information a peer sends about themselves, and ensures it describes the owner of peerPub
+func decodePeerInfo(ciphertext []byte, sessionKey []byte, peerPub *rsa.PublicKey) (peerInfo, error) {
+	plaintext, err := cryptoutils.AesDecrypt(ciphertext, sessionKey)
+	if err != nil {
+		return peerInfo{}, invalid("peer information", "failed to decrypt")
+	}
+	var info peerInfo
+	err = json.Unmarshal(plaintext, &info)
+	if err != nil {
+		return peerInfo{}, invalid("peer information", "malformed JSON")
+	}
+	if !ValidateId(info.Id, peerPub) {
+		return peerInfo{}, &DecodeError{Message: "peer information", Reason: "the id doesn't belong to the peer's key", Err: ErrPeerIdentityInvalid}
+	}
+	if !slices.Contains([]string{Red, Green, Blue, Yellow, Magenta, Cyan, Gray, White}, info.Color) {
+		return peerInfo{}, invalid("peer information", "unsupported color")
+	}
+	if len(info.Name) > 64 {
+		return peerInfo{}, invalid("peer information", "the name is longer than 64 characters")
+	}
+	return info, nil
+}
+
+// reads a single byte acknowledgement, returning rejected if the peer didn't acknowledge
+func readAck(conn net.Conn, rejected error) error {
+	response := make([]byte, 1)
+	_, err := io.ReadFull(conn, response)
+	if err != nil {
+		return timedOut(err)
+	}
+	if response[0] != RES_OK {
+		return rejected
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package peerutils
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// fails the test unless err is nil or a DecodeError, as every decoder should return for a hostile peer's input
+func expectDecodeError(t *testing.T, err error) {
+	t.Helper()
+	var decodeErr *DecodeError
+	if err != nil && !errors.As(err, &decodeErr) {
+		t.Fatalf("got %T (%v), expected a DecodeError", err, err)
+	}
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	f.Add(make([]byte, cryptoutils.SIGNATURE_SIZE+cryptoutils.AES_MIN_CIPHERTEXT_SIZE))
+	f.Add(make([]byte, cryptoutils.SIGNATURE_SIZE))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		signature, ciphertext, err := decodeFrame(raw)
+		expectDecodeError(t, err)
+		if err == nil && (len(signature) != cryptoutils.SIGNATURE_SIZE || len(signature)+len(ciphertext) != len(raw)) {
+			t.Fatalf("split %v bytes into %v and %v", len(raw), len(signature), len(ciphertext))
+		}
+	})
+}
+
+func FuzzDecodeInit(f *testing.F) {
+	keyA, _ := testKeys(f)
+	f.Add(keyMessage(MESSAGE_INIT, &keyA.PublicKey))
+	f.Add(append([]byte{MESSAGE_INIT}, cryptoutils.ExportRsaPub(&keyA.PublicKey)...))
+	f.Add(append([]byte{MESSAGE_TXT}, cryptoutils.ExportRsaPub(&keyA.PublicKey)...))
+	f.Add([]byte{MESSAGE_INIT})
+	f.Fuzz(func(t *testing.T, message []byte) {
+		_, _, _, err := decodeInit(message)
+		expectDecodeError(t, err)
+	})
+}
+
+func FuzzDecodeHello(f *testing.F) {
+	f.Add(localHello().encode())
+	f.Add(legacyHello().encode())
+	f.Add([]byte("-----BEGIN " + HELLO_BLOCK_TYPE + "-----\ne30=\n-----END " + HELLO_BLOCK_TYPE + "-----\n"))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		peerHello, err := decodeHello(data)
+		expectDecodeError(t, err)
+		if peerHello != nil && (len(peerHello.Versions) == 0 || len(peerHello.Suites) == 0 || len(peerHello.KeyTypes) == 0) {
+			t.Fatalf("accepted an empty hello %+v", peerHello)
+		}
+	})
+}
+
+// peer information is fuzzed before it's encrypted, since random ciphertexts never get past decryption
+func FuzzDecodePeerInfo(f *testing.F) {
+	keyA, _ := testKeys(f)
+	valid, _ := json.Marshal(localInfo(testUser(f, keyA, "a")))
+	f.Add(valid, false)
+	f.Add([]byte(`{"Name":"a","Color":"red"}`), false)
+	f.Add([]byte("null"), false)
+	f.Add(valid, true)
+	sessionKey := cryptoutils.GenAesKey()
+	f.Fuzz(func(t *testing.T, plaintext []byte, corrupt bool) {
+		ciphertext, err := cryptoutils.AesEncrypt(plaintext, sessionKey)
+		if err != nil {
+			t.Skip()
+		}
+		if corrupt {
+			ciphertext[len(ciphertext)-1] ^= 1
+		}
+		_, err = decodePeerInfo(ciphertext, sessionKey, &keyA.PublicKey)
+		expectDecodeError(t, err)
+	})
+}
+
+func FuzzDecodeFragment(f *testing.F) {
+	f.Add([]byte{1, 'h', 'i'})
+	f.Add([]byte{0})
+	f.Add([]byte{2, 'h', 'i'})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		more, chunk, err := decodeFragment(body)
+		expectDecodeError(t, err)
+		if err == nil && (more != (body[0] == 1) || len(chunk) != len(body)-1) {
+			t.Fatalf("decoded %v as %v and %v bytes", body, more, len(chunk))
+		}
+	})
+}
+
+// rekeys are fuzzed before they're encrypted, unless raw is set, since random ciphertexts rarely decrypt
+func FuzzDecodeRekey(f *testing.F) {
+	keyA, _ := testKeys(f)
+	f.Add(cryptoutils.GenAesKey(), false)
+	f.Add(make([]byte, cryptoutils.AES_KEY_SIZE-1), false)
+	f.Add([]byte{}, false)
+	f.Add(make([]byte, cryptoutils.SIGNATURE_SIZE), true)
+	f.Fuzz(func(t *testing.T, data []byte, raw bool) {
+		body := data
+		if !raw {
+			var err error
+			body, err = cryptoutils.RsaEncrypt(&keyA.PublicKey, data)
+			if err != nil {
+				t.Skip()
+			}
+		}
+		key, err := decodeRekey(keyA, body)
+		expectDecodeError(t, err)
+		if err == nil && len(key) != cryptoutils.AES_KEY_SIZE {
+			t.Fatalf("accepted a %v byte key", len(key))
+		}
+	})
+}
+
+func FuzzUnpad(f *testing.F) {
+	f.Add(PaddingPolicy{Mode: PADDING_BLOCK, Block: DEFAULT_PADDING_BLOCK}.pad([]byte("hello")))
+	f.Add(PaddingPolicy{Mode: PADDING_POW2}.pad([]byte{}))
+	f.Add([]byte{PADDING_MARKER, 0, 1})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, padded []byte) {
+		message, err := unpad(padded)
+		expectDecodeError(t, err)
+		if err == nil && len(message) >= len(padded) {
+			t.Fatalf("unpadded %v bytes to %v", len(padded), len(message))
+		}
+	})
+}
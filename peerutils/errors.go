@@ -0,0 +1,36 @@
+package peerutils
+
+import (
+	"errors"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// errors callers can check for with errors.Is, failures to connect to or chat with a peer either wrap one of these,
+// or come from the network itself. Those shared between packages aren't prefixed, so callers can add their own
+var (
+	ErrHandshakeRejected   = errors.New("the peer rejected the connection")
+	ErrPeerIdentityInvalid = errors.New("the peer failed to prove their identity")
+	ErrPinMismatch         = errors.New("peer's key does not match the pinned fingerprint")
+	ErrSignature           = errors.New("failed to verify RSA signature")
+	ErrDecrypt             = cryptoutils.ErrDecrypt // the same error cryptoutils returns, so either can be checked for
+	ErrMalformed           = errors.New("malformed message")
+	ErrTimeout             = errors.New("the peer stopped responding")
+	ErrIncompatible        = errors.New("the peer's version of courier is incompatible")
+	ErrHandshake           = errors.New("the handshake was altered in transit")
+	ErrIdentityChanged     = errors.New("tunnel: peer identity changed while reconnecting")
+	ErrMessageRejected     = errors.New("tunnel: the peer rejected the message")
+	ErrClosed              = errors.New("chatroom: this chatroom is no longer Active")
+	ErrRateLimited         = errors.New("handshake: too many attempts from this address")
+	ErrTooManyHandshakes   = errors.New("handshake: too many handshakes in progress")
+)
+
+// returns true if err was caused by a peer failing to prove their identity, or by a message failing verification
+func IsVerificationError(err error) bool {
+	for _, verificationErr := range []error{ErrPinMismatch, ErrPeerIdentityInvalid, ErrSignature, ErrIdentityChanged} {
+		if errors.Is(err, verificationErr) {
+			return true
+		}
+	}
+	return false
+}
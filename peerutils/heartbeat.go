@@ -0,0 +1,84 @@
+package peerutils
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_HEARTBEAT_INTERVAL = 15 * time.Second
+	DEFAULT_HEARTBEAT_LIMIT    = 4
+	MIN_HEARTBEAT_INTERVAL     = time.Second
+	HEARTBEAT_MISSED           = 2 // how many heartbeats can be missed before the peer is shown as unresponsive
+)
+
+// how often peers prove they're still there, and how long a silent peer is waited on
+// zero fields use the defaults
+type HeartbeatPolicy struct {
+	Interval time.Duration // how often heartbeats are sent, a chat uses the shorter of its two peers' intervals
+	Limit    int           // how many heartbeats can be missed before the chat is closed
+}
+
+// the heartbeat policy used for new tunnels
+var heartbeat HeartbeatPolicy
+
+// sets the heartbeat policy used for new tunnels
+func SetHeartbeat(policy HeartbeatPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	heartbeat = policy
+	return nil
+}
+
+// ensures the policy's interval isn't too short, and that a peer is shown as unresponsive before the chat is closed
+func (p HeartbeatPolicy) Validate() error {
+	p = p.withDefaults()
+	if p.Interval < MIN_HEARTBEAT_INTERVAL {
+		return errors.New("heartbeat: the interval must be at least a second")
+	}
+	if p.Limit <= HEARTBEAT_MISSED {
+		return errors.New("heartbeat: the limit must be more than 2 missed heartbeats")
+	}
+	return nil
+}
+
+// returns the policy with its unset fields replaced by the defaults
+func (p HeartbeatPolicy) withDefaults() HeartbeatPolicy {
+	if p.Interval == 0 {
+		p.Interval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	if p.Limit == 0 {
+		p.Limit = DEFAULT_HEARTBEAT_LIMIT
+	}
+	return p
+}
+
+// returns the heartbeat interval two peers agree on: the shorter of their intervals, though never below the minimum
+func agreeInterval(interval time.Duration, peerInterval time.Duration) time.Duration {
+	if peerInterval != 0 && peerInterval < interval {
+		interval = peerInterval
+	}
+	return max(interval, MIN_HEARTBEAT_INTERVAL)
+}
+
+// when a tunnel's peer was last heard from, and how quickly they acknowledge messages
+// it's shared by copies of the tunnel, since it's updated by both the sending and receiving goroutines
+type liveness struct {
+	lastHeard atomic.Int64 // unix nanoseconds
+	rtt       atomic.Int64 // nanoseconds
+}
+
+// creates a record of a peer that was just heard from
+func newLiveness() *liveness {
+	l := &liveness{}
+	l.heard()
+	return l
+}
+
+// records that the peer was just heard from
+func (l *liveness) heard() {
+	l.lastHeard.Store(time.Now().UnixNano())
+}
@@ -0,0 +1,76 @@
+package peerutils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// heartbeats far more often than users can ask for, so that the tests don't wait long on them
+const TEST_HEARTBEAT_INTERVAL = 50 * time.Millisecond
+
+func TestHeartbeatKeepsIdleChatOpen(t *testing.T) {
+	template := handshakeResult{features: []string{FEATURE_HEARTBEAT}, heartbeat: TEST_HEARTBEAT_INTERVAL}
+	a, b := testSessions(t, context.Background(), template)
+	defer a.Close()
+	// idle for well past the point a silent peer would be given up on
+	time.Sleep(TEST_HEARTBEAT_INTERVAL * DEFAULT_HEARTBEAT_LIMIT * 3)
+	if !a.Active() || !b.Active() || a.Unresponsive() || b.Unresponsive() {
+		t.Fatal("an idle chat whose peers were sending heartbeats was treated as dead")
+	}
+	if a.RTT() == 0 || b.RTT() == 0 {
+		t.Fatal("the heartbeats' round trip time wasn't measured")
+	}
+}
+
+func TestHeartbeatSilentPeer(t *testing.T) {
+	// more heartbeats can be missed than by default, leaving time to notice the peer is unresponsive first
+	heartbeat.Limit = 10
+	defer func() { heartbeat.Limit = 0 }()
+	a, _ := testTunnels(t, handshakeResult{features: []string{FEATURE_HEARTBEAT}, heartbeat: TEST_HEARTBEAT_INTERVAL})
+	// the peer never reads, acknowledges or sends anything
+	start := time.Now()
+	s := NewSession(context.Background(), a, SessionOptions{})
+	status := nextEvent(t, s, EVENT_STATUS)
+	if !status.Unresponsive || !s.Unresponsive() {
+		t.Fatal("the silent peer wasn't shown as unresponsive")
+	}
+	closed := nextEvent(t, s, EVENT_CLOSED)
+	if !errors.Is(closed.Err, ErrTimeout) {
+		t.Fatalf("the chat ended with %v", closed.Err)
+	}
+	limit := a.Heartbeat.Interval * time.Duration(a.Heartbeat.Limit)
+	if elapsed := time.Since(start); elapsed < limit {
+		t.Fatalf("the chat ended after %v, before the limit of %v", elapsed, limit)
+	}
+}
+
+func TestAgreeInterval(t *testing.T) {
+	tests := []struct {
+		own, peer, agreed time.Duration
+	}{
+		{own: 10 * time.Second, peer: 5 * time.Second, agreed: 5 * time.Second},
+		{own: 5 * time.Second, peer: 10 * time.Second, agreed: 5 * time.Second},
+		{own: 5 * time.Second, peer: 0, agreed: 5 * time.Second},
+		{own: 5 * time.Second, peer: time.Millisecond, agreed: MIN_HEARTBEAT_INTERVAL},
+	}
+	for _, test := range tests {
+		if agreed := agreeInterval(test.own, test.peer); agreed != test.agreed {
+			t.Errorf("agreed on %v between %v and %v", agreed, test.own, test.peer)
+		}
+	}
+}
+
+func TestHeartbeatPolicyValidate(t *testing.T) {
+	for _, policy := range []HeartbeatPolicy{{}, {Interval: time.Second, Limit: HEARTBEAT_MISSED + 1}} {
+		if err := policy.Validate(); err != nil {
+			t.Errorf("rejected %+v: %v", policy, err)
+		}
+	}
+	for _, policy := range []HeartbeatPolicy{{Interval: time.Millisecond}, {Limit: HEARTBEAT_MISSED}} {
+		if policy.Validate() == nil {
+			t.Errorf("accepted %+v", policy)
+		}
+	}
+}
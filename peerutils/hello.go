@@ -0,0 +1,133 @@
+package peerutils
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"slices"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+const (
+	PROTOCOL_VERSION     = 2 // this version's protocol, whose handshakes open with a hello
+	MIN_PROTOCOL_VERSION = 1 // the oldest protocol still spoken, from before hellos were sent
+	HELLO_BLOCK_TYPE     = "COURIER HELLO"
+)
+
+// cipher suites, each naming the key exchange, message cipher and signature hash used together
+const (
+	SUITE_RSA_AES_GCM = "rsa4096-aes256gcm-sha256"
+)
+
+// the types of key peers identify themselves with
+const (
+	KEY_RSA_4096 = "rsa-4096"
+)
+
+// the suites and key types this version supports, in order of preference
+var (
+	supportedSuites   = []string{SUITE_RSA_AES_GCM}
+	supportedKeyTypes = []string{KEY_RSA_4096}
+)
+
+// what a peer can speak, sent after their key and succession statements as a PEM block, which older versions skip
+// over. It's sent before the session key exists, so each peer repeats theirs in their encrypted peerInfo
+type hello struct {
+	Versions []int    // the protocol versions the peer speaks
+	Suites   []string // the cipher suites the peer supports, most preferred first
+	KeyTypes []string // the types of key the peer accepts from others
+	Features []string // the optional protocol features the peer supports
+}
+
+// what both peers agreed on, given each other's hellos
+type agreement struct {
+	version  int
+	suite    string
+	features []string
+}
+
+// returns the hello describing this version
+func localHello() hello {
+	var versions []int
+	for version := PROTOCOL_VERSION; version >= MIN_PROTOCOL_VERSION; version-- {
+		versions = append(versions, version)
+	}
+	return hello{Versions: versions, Suites: supportedSuites, KeyTypes: supportedKeyTypes, Features: supportedFeatures}
+}
+
+// returns the hello assumed for a peer that didn't send one, whose features are only known from their peerInfo
+func legacyHello() hello {
+	return hello{Versions: []int{1}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}}
+}
+
+// encodes a hello as a PEM block
+func (h hello) encode() []byte {
+	encoded, _ := json.Marshal(h)
+	return pem.EncodeToMemory(&pem.Block{Type: HELLO_BLOCK_TYPE, Bytes: encoded})
+}
+
+// returns true if two hellos advertise the same things
+func (h hello) equal(other hello) bool {
+	return slices.Equal(h.Versions, other.Versions) && slices.Equal(h.Suites, other.Suites) &&
+		slices.Equal(h.KeyTypes, other.KeyTypes) && slices.Equal(h.Features, other.Features)
+}
+
+// settles the best protocol version, cipher suite and features both peers support, failing with ErrIncompatible if
+// they have nothing in common. The initiator's preferences come first, so that both peers reach the same result
+func agree(initiator hello, acceptor hello) (agreement, error) {
+	var result agreement
+	for _, version := range initiator.Versions {
+		if slices.Contains(acceptor.Versions, version) && version > result.version {
+			result.version = version
+		}
+	}
+	if result.version == 0 {
+		return agreement{}, fmt.Errorf("%w: no common protocol version, the initiator speaks %v and the listener speaks %v", ErrIncompatible, initiator.Versions, acceptor.Versions)
+	}
+	for _, suite := range initiator.Suites {
+		if slices.Contains(acceptor.Suites, suite) {
+			result.suite = suite
+			break
+		}
+	}
+	if result.suite == "" {
+		return agreement{}, fmt.Errorf("%w: no common cipher suite, the initiator supports %v and the listener supports %v", ErrIncompatible, initiator.Suites, acceptor.Suites)
+	}
+	// both peers identify themselves with an RSA-4096 key, so each must accept that type
+	if !slices.Contains(initiator.KeyTypes, KEY_RSA_4096) || !slices.Contains(acceptor.KeyTypes, KEY_RSA_4096) {
+		return agreement{}, fmt.Errorf("%w: a peer doesn't accept %v keys", ErrIncompatible, KEY_RSA_4096)
+	}
+	for _, feature := range initiator.Features {
+		if slices.Contains(acceptor.Features, feature) && !slices.Contains(result.features, feature) {
+			result.features = append(result.features, feature)
+		}
+	}
+	return result, nil
+}
+
+// settles what both peers will use given the peer's hello, which is nil if they didn't send one
+func settle(peerHello *hello, initiating bool) (agreement, error) {
+	theirs := legacyHello()
+	if peerHello != nil {
+		theirs = *peerHello
+	}
+	if initiating {
+		return agree(localHello(), theirs)
+	}
+	return agree(theirs, localHello())
+}
+
+// the handshake's opening message, or the reply to it, made of the user's key, their succession statements and hello
+func keyMessage(code byte, pubKey *rsa.PublicKey) []byte {
+	message := append([]byte{code}, cryptoutils.ExportRsaPub(pubKey)...)
+	message = append(message, cryptoutils.EncodeSuccession(succession)...)
+	message = append(message, localHello().encode()...)
+	// the peer stops reading at the first short read, so a message filling its last read exactly is lengthened by a
+	// newline, which PEM decoding ignores
+	if len(message)%BUF_SIZE == 0 {
+		message = append(message, '\n')
+	}
+	return message
+}
@@ -0,0 +1,136 @@
+package peerutils
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestAgree(t *testing.T) {
+	tests := []struct {
+		name      string
+		initiator hello
+		acceptor  hello
+		version   int
+		suite     string
+		features  []string
+		err       error
+	}{
+		{
+			name:      "newest common version",
+			initiator: hello{Versions: []int{3, 2, 1}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}},
+			acceptor:  hello{Versions: []int{2, 1}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}},
+			version:   2,
+			suite:     SUITE_RSA_AES_GCM,
+		},
+		{
+			name:      "initiator's preferred suite",
+			initiator: hello{Versions: []int{2}, Suites: []string{"b", "a", SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}},
+			acceptor:  hello{Versions: []int{2}, Suites: []string{SUITE_RSA_AES_GCM, "a", "b"}, KeyTypes: []string{KEY_RSA_4096}},
+			version:   2,
+			suite:     "b",
+		},
+		{
+			name:      "common features",
+			initiator: hello{Versions: []int{2}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}, Features: []string{FEATURE_REKEY, FEATURE_PADDING, "receipts"}},
+			acceptor:  hello{Versions: []int{2}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}, Features: []string{FEATURE_PADDING, FEATURE_REKEY}},
+			version:   2,
+			suite:     SUITE_RSA_AES_GCM,
+			features:  []string{FEATURE_REKEY, FEATURE_PADDING},
+		},
+		{
+			name:      "no common version",
+			initiator: hello{Versions: []int{3}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}},
+			acceptor:  hello{Versions: []int{2, 1}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}},
+			err:       ErrIncompatible,
+		},
+		{
+			name:      "no common suite",
+			initiator: hello{Versions: []int{2}, Suites: []string{"a"}, KeyTypes: []string{KEY_RSA_4096}},
+			acceptor:  hello{Versions: []int{2}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}},
+			err:       ErrIncompatible,
+		},
+		{
+			name:      "unaccepted key type",
+			initiator: hello{Versions: []int{2}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{"ed25519"}},
+			acceptor:  hello{Versions: []int{2}, Suites: []string{SUITE_RSA_AES_GCM}, KeyTypes: []string{KEY_RSA_4096}},
+			err:       ErrIncompatible,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agreed, err := agree(test.initiator, test.acceptor)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if agreed.version != test.version || agreed.suite != test.suite || !slices.Equal(agreed.features, test.features) {
+				t.Fatalf("got %+v", agreed)
+			}
+		})
+	}
+}
+
+func TestHandshakeSettlesNewestVersion(t *testing.T) {
+	initiator, acceptor := testHandshake(t, nil)
+	if initiator.err != nil || acceptor.err != nil {
+		t.Fatalf("handshake failed: %v, %v", initiator.err, acceptor.err)
+	}
+	for _, result := range []handshakeResult{initiator.result, acceptor.result} {
+		if result.agreed.version != PROTOCOL_VERSION || result.agreed.suite != SUITE_RSA_AES_GCM {
+			t.Fatalf("settled on version %v with %v", result.agreed.version, result.agreed.suite)
+		}
+		if !slices.Equal(result.features, supportedFeatures) {
+			t.Fatalf("settled on features %v", result.features)
+		}
+	}
+}
+
+// removes the hello from a key message, as an attacker forcing the legacy protocol would
+func stripHello(data []byte) []byte {
+	start := bytes.Index(data, []byte("-----BEGIN "+HELLO_BLOCK_TYPE+"-----"))
+	endMarker := []byte("-----END " + HELLO_BLOCK_TYPE + "-----\n")
+	end := bytes.Index(data, endMarker)
+	if start == -1 || end == -1 {
+		return data
+	}
+	stripped := append(data[:start:start], data[end+len(endMarker):]...)
+	if len(stripped)%BUF_SIZE == 0 {
+		stripped = append(stripped, '\n')
+	}
+	return stripped
+}
+
+func TestHandshakeRejectsStrippedHello(t *testing.T) {
+	initiator, acceptor := testHandshake(t, stripHello)
+	if !errors.Is(acceptor.err, ErrHandshake) {
+		t.Fatalf("the acceptor got %v, expected ErrHandshake", acceptor.err)
+	}
+	if initiator.err == nil {
+		t.Fatal("the initiator completed a handshake the acceptor rejected")
+	}
+}
+
+func TestHandshakeRejectsAlteredHello(t *testing.T) {
+	lowerVersions := func(data []byte) []byte {
+		altered := bytes.Replace(data, []byte(localHello().encode()), []byte(legacyHelloWithFeatures().encode()), 1)
+		if len(altered)%BUF_SIZE == 0 {
+			altered = append(altered, '\n')
+		}
+		return altered
+	}
+	_, acceptor := testHandshake(t, lowerVersions)
+	if !errors.Is(acceptor.err, ErrHandshake) {
+		t.Fatalf("the acceptor got %v, expected ErrHandshake", acceptor.err)
+	}
+}
+
+// returns a hello offering only the legacy protocol, as an attacker downgrading the handshake would send
+func legacyHelloWithFeatures() hello {
+	downgraded := legacyHello()
+	downgraded.Features = supportedFeatures
+	return downgraded
+}
@@ -0,0 +1,181 @@
+package peerutils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// RSA-4096 keys are slow to generate, so every test shares the same two
+var (
+	testKeysOnce sync.Once
+	testKeyA     *rsa.PrivateKey
+	testKeyB     *rsa.PrivateKey
+)
+
+// returns the two keys shared by the tests
+func testKeys(t testing.TB) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		testKeyA, _ = rsa.GenerateKey(rand.Reader, cryptoutils.RSA_KEY_SIZE)
+		testKeyB, _ = rsa.GenerateKey(rand.Reader, cryptoutils.RSA_KEY_SIZE)
+	})
+	return testKeyA, testKeyB
+}
+
+// returns a user whose id belongs to key
+func testUser(t testing.TB, key *rsa.PrivateKey, name string) User {
+	t.Helper()
+	id, err := GenId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return User{Name: name, Color: Red, Id: id}
+}
+
+// the outcome of one side of a handshake run by testHandshake
+type handshakeOutcome struct {
+	result handshakeResult
+	err    error
+}
+
+// runs a handshake between the two test keys over an in-memory connection, passing every write from the initiator
+// through tamper on its way to the acceptor, when tamper isn't nil
+func testHandshake(t *testing.T, tamper func([]byte) []byte) (handshakeOutcome, handshakeOutcome) {
+	t.Helper()
+	keyA, keyB := testKeys(t)
+	userA, userB := testUser(t, keyA, "a"), testUser(t, keyB, "b")
+	initiatorConn, towardsAcceptor := net.Pipe()
+	fromInitiator, acceptorConn := net.Pipe()
+	defer initiatorConn.Close()
+	defer acceptorConn.Close()
+	go relay(towardsAcceptor, fromInitiator, tamper)
+	go relay(fromInitiator, towardsAcceptor, nil)
+	initiated := make(chan handshakeOutcome)
+	go func() {
+		result, err := initiateHandshake(initiatorConn, "", keyA.PublicKey, *keyA, userA)
+		initiated <- handshakeOutcome{result, err}
+	}()
+	result, err := acceptHandshake(acceptorConn, "", keyB.PublicKey, *keyB, userB)
+	// the initiator may still be waiting on a reply the acceptor won't send
+	acceptorConn.Close()
+	return <-initiated, handshakeOutcome{result, err}
+}
+
+// copies every write from src to dst, passing it through tamper first when tamper isn't nil
+func relay(src net.Conn, dst net.Conn, tamper func([]byte) []byte) {
+	defer dst.Close()
+	defer src.Close()
+	buf := make([]byte, MAX_KEY_MSG_SIZE)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		data := buf[:n]
+		if tamper != nil {
+			data = tamper(bytes.Clone(data))
+		}
+		_, err = dst.Write(data)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// creates two tunnels connected to each other in memory, using the features, padding, heartbeat and cover traffic in template
+func testTunnels(t *testing.T, template handshakeResult) (*Tunnel, *Tunnel) {
+	t.Helper()
+	keyA, keyB := testKeys(t)
+	userA, userB := testUser(t, keyA, "a"), testUser(t, keyB, "b")
+	aOut, bIn := net.Pipe()
+	bOut, aIn := net.Pipe()
+	t.Cleanup(func() {
+		aOut.Close()
+		bOut.Close()
+	})
+	template.sessionKey = cryptoutils.GenAesKey()
+	forA, forB := template, template
+	forA.peerPub, forA.peer = keyB.PublicKey, userB
+	forB.peerPub, forB.peer = keyA.PublicKey, userA
+	return forA.tunnel(*keyA, userA, aIn, aOut, nil), forB.tunnel(*keyB, userB, bIn, bOut, nil)
+}
+
+// a connection dropped as the acknowledgement of its nth write arrives, once the peer has recieved the message
+type droppingConn struct {
+	net.Conn
+	writes int
+	dropAt int
+}
+
+func (c *droppingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func (c *droppingConn) Read(b []byte) (int, error) {
+	if c.writes == c.dropAt {
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Read(b)
+}
+
+// creates two tunnels connected to each other in memory like testTunnels, which reconnect to each other when redialed
+// the nth connection the first tunnel sends through is dropped as the acknowledgement of its drops[n]th frame arrives
+func testReconnectingTunnels(t *testing.T, template handshakeResult, drops ...int) (*Tunnel, *Tunnel) {
+	t.Helper()
+	keyA, keyB := testKeys(t)
+	userA, userB := testUser(t, keyA, "a"), testUser(t, keyB, "b")
+	template.sessionKey = cryptoutils.GenAesKey()
+	forA, forB := template, template
+	forA.peerPub, forA.peer = keyB.PublicKey, userB
+	forB.peerPub, forB.peer = keyA.PublicKey, userA
+	var mut sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		mut.Lock()
+		defer mut.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	// the first tunnel's redial creates the new connections, and hands the other end to the second tunnel's
+	redialed := make(chan *Tunnel, 1)
+	var redialA, redialB func() (*Tunnel, error)
+	connect := func() (*Tunnel, *Tunnel) {
+		aOut, bIn := net.Pipe()
+		bOut, aIn := net.Pipe()
+		mut.Lock()
+		var out net.Conn = aOut
+		if len(drops) != 0 {
+			out = &droppingConn{Conn: aOut, dropAt: drops[0]}
+			drops = drops[1:]
+		}
+		conns = append(conns, aOut, bOut)
+		mut.Unlock()
+		return forA.tunnel(*keyA, userA, aIn, out, redialA), forB.tunnel(*keyB, userB, bIn, bOut, redialB)
+	}
+	redialA = func() (*Tunnel, error) {
+		a, b := connect()
+		redialed <- b
+		return a, nil
+	}
+	redialB = func() (*Tunnel, error) {
+		select {
+		case b := <-redialed:
+			return b, nil
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("the other tunnel never redialed")
+		}
+	}
+	return connect()
+}
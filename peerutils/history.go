@@ -0,0 +1,231 @@
+package peerutils
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+const MAX_HISTORY_RECORD_SIZE = 1 << 20
+
+// a message saved in a history store
+type HistoryEntry struct {
+	Id       uint64    `json:"id"` // identifies the entry within its store
+	Sender   string    `json:"sender"`
+	SenderId string    `json:"sender_id"`
+	Color    string    `json:"color"`
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+}
+
+// an encrypted record of the messages exchanged with one peer, kept between chats
+// every entry is encrypted on its own, so that new messages are appended without rewriting the file
+type HistoryStore struct {
+	MaxMessages int           // the most entries kept, zero for no limit
+	MaxAge      time.Duration // how long entries are kept, zero to keep them forever
+	path        string
+	key         []byte
+	entries     []HistoryEntry
+	nextId      uint64
+	mut         sync.Mutex
+}
+
+// returns the default directory history stores are kept in, inside the user's configuration directory
+func DefaultHistoryDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "courier", "history"), nil
+}
+
+// returns the path of the history store for the peer with the given key fingerprint
+func HistoryPath(dir string, fingerprint string) string {
+	return filepath.Join(dir, fingerprint+".hist")
+}
+
+// derives the key history stores are encrypted with from the user's private key
+func HistoryKey(prvKey *rsa.PrivateKey) []byte {
+	return cryptoutils.DeriveKey(prvKey, "courier history")
+}
+
+// opens the history store at path, creating it once the first entry is added
+// entries outside the retention limits are removed as the store is opened
+func OpenHistory(path string, key []byte, maxMessages int, maxAge time.Duration) (*HistoryStore, error) {
+	h := &HistoryStore{MaxMessages: maxMessages, MaxAge: maxAge, path: path, key: key}
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(contents) != 0 {
+		if len(contents) < 4 {
+			return nil, errors.New("history: invalid history file")
+		}
+		size := binary.LittleEndian.Uint32(contents)
+		if size > MAX_HISTORY_RECORD_SIZE || int(size) > len(contents)-4 {
+			return nil, errors.New("history: invalid history file")
+		}
+		var entry HistoryEntry
+		err = openRecord(contents[:size+4], key, &entry)
+		if err != nil {
+			return nil, errors.New("history: failed to read the history, it may belong to another identity")
+		}
+		contents = contents[size+4:]
+		h.entries = append(h.entries, entry)
+		h.nextId = max(h.nextId, entry.Id+1)
+	}
+	if h.prune() {
+		err = h.rewrite()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// returns every entry in the store, oldest first
+func (h *HistoryStore) Entries() []HistoryEntry {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return append([]HistoryEntry(nil), h.entries...)
+}
+
+// saves a message to the store, and returns the id of its entry
+func (h *HistoryStore) Append(sender *User, text string, sent time.Time) (uint64, error) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	entry := HistoryEntry{Id: h.nextId, Sender: sender.Name, SenderId: sender.Id, Color: sender.Color, Text: text, Time: sent}
+	h.nextId++
+	h.entries = append(h.entries, entry)
+	if h.prune() {
+		return entry.Id, h.rewrite()
+	}
+	record, err := sealRecord(entry, h.key)
+	if err != nil {
+		return 0, err
+	}
+	err = os.MkdirAll(filepath.Dir(h.path), 0700)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, err = file.Write(record)
+	return entry.Id, err
+}
+
+// removes an entry from the store, doing nothing if it doesn't exist
+func (h *HistoryStore) Remove(id uint64) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for i, entry := range h.entries {
+		if entry.Id == id {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			return h.rewrite()
+		}
+	}
+	return nil
+}
+
+// re-encrypts the store with a new key, as when the user's key pair is rotated
+func (h *HistoryStore) Rekey(key []byte) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.key = key
+	return h.rewrite()
+}
+
+// removes the entries outside of the retention limits, returning true if any were removed
+// the caller must hold mut
+func (h *HistoryStore) prune() bool {
+	count := len(h.entries)
+	if h.MaxAge != 0 {
+		cutoff := time.Now().Add(-h.MaxAge)
+		for len(h.entries) != 0 && h.entries[0].Time.Before(cutoff) {
+			h.entries = h.entries[1:]
+		}
+	}
+	if h.MaxMessages != 0 && len(h.entries) > h.MaxMessages {
+		h.entries = h.entries[len(h.entries)-h.MaxMessages:]
+	}
+	return len(h.entries) != count
+}
+
+// encrypts a value as JSON into a record: the size of its ciphertext, followed by the ciphertext
+func sealRecord(value any, key []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := cryptoutils.AesEncrypt(plaintext, key)
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(ciphertext))), ciphertext...), nil
+}
+
+// decrypts a record created by sealRecord into value
+func openRecord(record []byte, key []byte, value any) error {
+	if len(record) < 4+cryptoutils.AES_MIN_CIPHERTEXT_SIZE || int(binary.LittleEndian.Uint32(record)) != len(record)-4 {
+		return errors.New("history: invalid record")
+	}
+	plaintext, err := cryptoutils.AesDecrypt(record[4:], key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, value)
+}
+
+// replaces the file with the store's current entries, the caller must hold mut
+func (h *HistoryStore) rewrite() error {
+	if len(h.entries) == 0 {
+		err := os.Remove(h.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var contents bytes.Buffer
+	for _, entry := range h.entries {
+		record, err := sealRecord(entry, h.key)
+		if err != nil {
+			return err
+		}
+		contents.Write(record)
+	}
+	err := os.MkdirAll(filepath.Dir(h.path), 0700)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that the history isn't lost if writing fails part way
+	tmpPath := h.path + ".tmp"
+	err = os.WriteFile(tmpPath, contents.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, h.path)
+}
+
+// converts the store's entries to messages, as they're shown before a new chat
+func (h *HistoryStore) messages() []Message {
+	var messages []Message
+	for _, entry := range h.Entries() {
+		sender := &User{Name: entry.Sender, Id: entry.SenderId, Color: entry.Color}
+		messages = append(messages, Message{content: entry.Text, sender: sender, timeSent: entry.Time.Format("2006-01-02 15:04"), sent: entry.Time})
+	}
+	return messages
+}
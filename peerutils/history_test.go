@@ -0,0 +1,147 @@
+package peerutils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// returns the path of a history store in a temporary directory, and a key for it
+func testHistory(t *testing.T) (string, []byte) {
+	t.Helper()
+	return filepath.Join(t.TempDir(), "history", "peer.hist"), cryptoutils.GenAesKey()
+}
+
+// returns the texts of a store's entries, oldest first
+func entryTexts(h *HistoryStore) []string {
+	var texts []string
+	for _, entry := range h.Entries() {
+		texts = append(texts, entry.Text)
+	}
+	return texts
+}
+
+// checks that a store holds entries with the given texts, in order
+func expectEntries(t *testing.T, h *HistoryStore, texts ...string) {
+	t.Helper()
+	got := entryTexts(h)
+	if len(got) != len(texts) {
+		t.Fatalf("got entries %q, expected %q", got, texts)
+	}
+	for i := range texts {
+		if got[i] != texts[i] {
+			t.Fatalf("got entries %q, expected %q", got, texts)
+		}
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	path, key := testHistory(t)
+	h, err := OpenHistory(path, key, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &User{Name: "alice", Id: "alice-id", Color: Cyan}
+	sent := time.Now().Round(0)
+	var ids []uint64
+	for _, text := range []string{"one", "two", "three"} {
+		id, err := h.Append(sender, text, sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	err = h.Remove(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenHistory(path, key, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEntries(t, reopened, "one", "three")
+	entry := reopened.Entries()[0]
+	if entry.Sender != "alice" || entry.SenderId != "alice-id" || entry.Color != Cyan || !entry.Time.Equal(sent) {
+		t.Fatalf("reopened %+v", entry)
+	}
+	// new entries never reuse the id of an earlier one
+	id, _ := reopened.Append(sender, "four", sent)
+	if id <= ids[2] {
+		t.Fatalf("reused the id %v", id)
+	}
+}
+
+func TestHistoryKeepsMaxMessages(t *testing.T) {
+	path, key := testHistory(t)
+	h, _ := OpenHistory(path, key, 2, 0)
+	for _, text := range []string{"one", "two", "three"} {
+		_, err := h.Append(&User{Name: "alice"}, text, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectEntries(t, h, "two", "three")
+	reopened, _ := OpenHistory(path, key, 2, 0)
+	expectEntries(t, reopened, "two", "three")
+	// a lower limit takes effect when the store is next opened
+	reopened, _ = OpenHistory(path, key, 1, 0)
+	expectEntries(t, reopened, "three")
+}
+
+func TestHistoryKeepsMaxAge(t *testing.T) {
+	path, key := testHistory(t)
+	h, _ := OpenHistory(path, key, 0, 0)
+	h.Append(&User{Name: "alice"}, "old", time.Now().Add(-48*time.Hour))
+	h.Append(&User{Name: "alice"}, "new", time.Now())
+	reopened, err := OpenHistory(path, key, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEntries(t, reopened, "new")
+	reopened, _ = OpenHistory(path, key, 0, 0)
+	expectEntries(t, reopened, "new")
+}
+
+func TestHistoryWrongKey(t *testing.T) {
+	path, key := testHistory(t)
+	h, _ := OpenHistory(path, key, 0, 0)
+	_, err := h.Append(&User{Name: "alice"}, "hello", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenHistory(path, cryptoutils.GenAesKey(), 0, 0)
+	if err == nil {
+		t.Fatal("opened a history store with the wrong key")
+	}
+}
+
+func TestHistoryKeyBelongsToIdentity(t *testing.T) {
+	keyA, keyB := testKeys(t)
+	if string(HistoryKey(keyA)) != string(HistoryKey(keyA)) {
+		t.Fatal("the history key isn't stable")
+	}
+	if string(HistoryKey(keyA)) == string(HistoryKey(keyB)) {
+		t.Fatal("two identities have the same history key")
+	}
+}
+
+func TestHistoryRekey(t *testing.T) {
+	path, key := testHistory(t)
+	h, _ := OpenHistory(path, key, 0, 0)
+	h.Append(&User{Name: "alice"}, "hello", time.Now())
+	newKey := cryptoutils.GenAesKey()
+	err := h.Rekey(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenHistory(path, key, 0, 0); err == nil {
+		t.Fatal("the history can still be read with the old key")
+	}
+	reopened, err := OpenHistory(path, newKey, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEntries(t, reopened, "hello")
+}
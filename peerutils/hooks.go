@@ -0,0 +1,136 @@
+package peerutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+const HOOK_TIMEOUT = 30 * time.Second
+
+// how long a hook may run before it's killed, only changed by tests
+var hookTimeout = HOOK_TIMEOUT
+
+// the events hooks can be run on
+// there's no event for a file being offered, since file transfer is out of scope and chats can only carry text
+const (
+	HOOK_MESSAGE_RECEIVED    = "message_received"
+	HOOK_PEER_CONNECTED      = "peer_connected"
+	HOOK_PEER_DISCONNECTED   = "peer_disconnected"
+	HOOK_VERIFICATION_FAILED = "verification_failed"
+	HOOK_ALL                 = "*"
+)
+
+// a user command run whenever an event happens
+// the command receives the event as JSON on stdin, and as COURIER_* environment variables
+type Hook struct {
+	Event   string   `json:"event"` // one of the HOOK_ events, or * for all of them
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Content bool     `json:"content,omitempty"` // whether the hook receives the text of messages, which is withheld by default
+}
+
+// the hooks to run, in the order they're run in
+type Hooks []Hook
+
+// the details of an event, as passed to a hook
+type HookEvent struct {
+	Event       string    `json:"event"`
+	Peer        string    `json:"peer,omitempty"`
+	PeerId      string    `json:"peer_id,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	MessageId   *uint32   `json:"message_id,omitempty"`
+	Content     string    `json:"content,omitempty"` // only set for hooks that opted in to receiving content
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// creates the details of an event concerning the peer of a tunnel
+func newHookEvent(event string, tunnel *Tunnel) HookEvent {
+	hookEvent := HookEvent{Event: event, Time: time.Now()}
+	if tunnel != nil {
+		hookEvent.Peer = tunnel.Peer.Name
+		hookEvent.PeerId = tunnel.Peer.Id
+		hookEvent.Fingerprint = cryptoutils.Fingerprint(&tunnel.PeerPubKey)
+	}
+	return hookEvent
+}
+
+// ensures a hook can be run
+func (h Hook) Validate() error {
+	if h.Command == "" {
+		return errors.New("hooks: hooks must have a command")
+	}
+	if !slices.Contains([]string{HOOK_MESSAGE_RECEIVED, HOOK_PEER_CONNECTED, HOOK_PEER_DISCONNECTED, HOOK_VERIFICATION_FAILED, HOOK_ALL}, h.Event) {
+		return errors.New("hooks: unrecognized event " + h.Event)
+	}
+	return nil
+}
+
+// runs the hook for an event, waiting for it to finish
+func (h Hook) Run(event HookEvent) error {
+	if !h.Content {
+		event.Content = ""
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	// message content is never put in the environment, since other processes may be able to read it
+	cmd.Env = append(os.Environ(),
+		"COURIER_EVENT="+event.Event,
+		"COURIER_PEER="+event.Peer,
+		"COURIER_PEER_ID="+event.PeerId,
+		"COURIER_FINGERPRINT="+event.Fingerprint,
+		"COURIER_ERROR="+event.Error,
+	)
+	if event.MessageId != nil {
+		cmd.Env = append(cmd.Env, "COURIER_MESSAGE_ID="+strconv.FormatUint(uint64(*event.MessageId), 10))
+	}
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("hooks: %v failed: %v", h.Command, err)
+	}
+	return nil
+}
+
+// runs every hook for an event one at a time, returning any errors
+func (h Hooks) Run(event HookEvent) error {
+	var errs []error
+	for _, hook := range h {
+		if hook.Event != event.Event && hook.Event != HOOK_ALL {
+			continue
+		}
+		err := hook.Run(event)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runs every hook for an event in the background, passing any errors to onError if it isn't nil
+func (h Hooks) Fire(event HookEvent, onError func(error)) {
+	if len(h) == 0 {
+		return
+	}
+	go func() {
+		err := h.Run(event)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}()
+}
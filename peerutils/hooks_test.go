@@ -0,0 +1,120 @@
+package peerutils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns a hook that saves its environment to env, and its stdin to env.json
+func recordingHook(t *testing.T, event string, content bool) (Hook, string) {
+	t.Helper()
+	env := filepath.Join(t.TempDir(), "env")
+	return Hook{Event: event, Command: "sh", Args: []string{"-c", `env > "$0"; cat > "$0.json"`, env}, Content: content}, env
+}
+
+// returns the environment and payload recorded by a hook from recordingHook
+func recorded(t *testing.T, env string) ([]string, HookEvent) {
+	t.Helper()
+	vars, err := os.ReadFile(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := os.ReadFile(env + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event HookEvent
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(vars), "\n"), event
+}
+
+// returns the details of a message event, as a session would pass them to hooks
+func testHookEvent() HookEvent {
+	id := uint32(7)
+	return HookEvent{Event: HOOK_MESSAGE_RECEIVED, Peer: "alice", PeerId: "alice-id", Fingerprint: "ab12", MessageId: &id, Content: "secret", Time: time.Now()}
+}
+
+func TestHookEnvironment(t *testing.T) {
+	hook, env := recordingHook(t, HOOK_MESSAGE_RECEIVED, true)
+	err := hook.Run(testHookEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, event := recorded(t, env)
+	for _, expected := range []string{"COURIER_EVENT=message_received", "COURIER_PEER=alice", "COURIER_PEER_ID=alice-id", "COURIER_FINGERPRINT=ab12", "COURIER_MESSAGE_ID=7"} {
+		if !slices.Contains(vars, expected) {
+			t.Fatalf("%v wasn't in the environment", expected)
+		}
+	}
+	for _, v := range vars {
+		if strings.Contains(v, "secret") {
+			t.Fatalf("message content was put in the environment as %v", v)
+		}
+	}
+	if event.Content != "secret" || event.Peer != "alice" || event.MessageId == nil || *event.MessageId != 7 {
+		t.Fatalf("the hook recieved %+v", event)
+	}
+}
+
+func TestHookContentWithheld(t *testing.T) {
+	hook, env := recordingHook(t, HOOK_MESSAGE_RECEIVED, false)
+	err := hook.Run(testHookEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, event := recorded(t, env)
+	if event.Content != "" {
+		t.Fatal("a hook that didn't opt in recieved message content")
+	}
+}
+
+func TestHooksRunOnTheirEvents(t *testing.T) {
+	matching, matchingEnv := recordingHook(t, HOOK_MESSAGE_RECEIVED, false)
+	all, allEnv := recordingHook(t, HOOK_ALL, false)
+	other, otherEnv := recordingHook(t, HOOK_PEER_CONNECTED, false)
+	err := Hooks{matching, all, other}.Run(testHookEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{matchingEnv, allEnv} {
+		if _, err := os.Stat(env); err != nil {
+			t.Fatal("a hook for the event wasn't run")
+		}
+	}
+	if _, err := os.Stat(otherEnv); err == nil {
+		t.Fatal("a hook for another event was run")
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	hookTimeout = 100 * time.Millisecond
+	defer func() { hookTimeout = HOOK_TIMEOUT }()
+	start := time.Now()
+	err := Hook{Event: HOOK_ALL, Command: "sleep", Args: []string{"10"}}.Run(testHookEvent())
+	if err == nil {
+		t.Fatal("a hanging hook didn't fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the hook ran for %v", elapsed)
+	}
+}
+
+func TestHookValidate(t *testing.T) {
+	if (Hook{Event: HOOK_ALL}).Validate() == nil {
+		t.Fatal("accepted a hook without a command")
+	}
+	if (Hook{Event: "file_offered", Command: "true"}).Validate() == nil {
+		t.Fatal("accepted a hook for an unrecognized event")
+	}
+	if (Hook{Event: HOOK_PEER_DISCONNECTED, Command: "true"}).Validate() != nil {
+		t.Fatal("rejected a valid hook")
+	}
+}
@@ -0,0 +1,168 @@
+package peerutils
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HANDSHAKE_PHASE_TIMEOUT   = 10 * time.Second // the longest a peer is waited on at each step of the handshake
+	MAX_HANDSHAKE_MSG_SIZE    = MAX_KEY_MSG_SIZE // the largest single message accepted during a handshake
+	MAX_CONCURRENT_HANDSHAKES = 16
+	MAX_SOURCE_HANDSHAKES     = 10 // the most handshakes a single address can start per RATE_LIMIT_WINDOW
+	RATE_LIMIT_WINDOW         = time.Minute
+)
+
+// called with the address and reason whenever a listener rejects a connection, may be nil
+var rejectLog func(addr string, reason error)
+
+// sets the function that's told about every connection a listener rejects, such as those that fail the handshake
+// or exceed the rate limits, so that offenders can be logged
+func SetRejectLog(log func(addr string, reason error)) {
+	rejectLog = log
+}
+
+// reports a rejected connection
+func rejected(addr net.Addr, reason error) {
+	if rejectLog != nil {
+		rejectLog(addr.String(), reason)
+	}
+}
+
+// limits how many handshakes run at once, and how often each address can start one
+// it's shared by every listener, so that the limits hold across a daemon's repeated calls to AwaitPeer
+type handshakeGate struct {
+	active   int
+	attempts map[string][]time.Time // when each address recently started a handshake
+	mut      sync.Mutex
+}
+
+var gate = &handshakeGate{attempts: make(map[string][]time.Time)}
+
+// reserves a handshake slot for a connection from addr, failing if either limit has been reached
+// every admitted connection must be released
+func (g *handshakeGate) admit(addr net.Addr) error {
+	host := addr.String()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		host = tcpAddr.IP.String()
+	}
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	// forget attempts that have left the window, so that the map doesn't grow without bound
+	cutoff := time.Now().Add(-RATE_LIMIT_WINDOW)
+	for source, times := range g.attempts {
+		for len(times) != 0 && times[0].Before(cutoff) {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(g.attempts, source)
+		} else {
+			g.attempts[source] = times
+		}
+	}
+	if len(g.attempts[host]) >= MAX_SOURCE_HANDSHAKES {
+		return ErrRateLimited
+	}
+	g.attempts[host] = append(g.attempts[host], time.Now())
+	if g.active >= MAX_CONCURRENT_HANDSHAKES {
+		return ErrTooManyHandshakes
+	}
+	g.active++
+	return nil
+}
+
+// frees a slot reserved by admit
+func (g *handshakeGate) release() {
+	g.mut.Lock()
+	g.active--
+	g.mut.Unlock()
+}
+
+// gives the peer another HANDSHAKE_PHASE_TIMEOUT to complete the next step of the handshake
+func handshakePhase(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_PHASE_TIMEOUT))
+}
+
+// replaces the error from a missed deadline with ErrTimeout, leaving any other error untouched
+func timedOut(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// recieves a single handshake message, refusing any larger than MAX_HANDSHAKE_MSG_SIZE
+func recvHandshake(conn net.Conn) ([]byte, error) {
+	_, message, err := recvUpTo(conn, MAX_HANDSHAKE_MSG_SIZE)
+	if err == nil && len(message) == 0 {
+		err = invalid("handshake message", "empty")
+	}
+	return message, err
+}
+
+// accepts connections until one completes the handshake, returning the connection and the handshake's outcome
+// handshakes run concurrently, so a slow or malicious client can't hold up anyone else, and connections that fail
+// the handshake or exceed the limits are rejected without ending the wait
+func acceptPeer(listener net.Listener, accept func(conn net.Conn) (handshakeResult, error)) (net.Conn, handshakeResult, error) {
+	type handshake struct {
+		conn   net.Conn
+		result handshakeResult
+	}
+	completed := make(chan handshake)
+	failed := make(chan error, 1)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				failed <- err
+				return
+			}
+			err = gate.admit(conn.RemoteAddr())
+			if err != nil {
+				rejected(conn.RemoteAddr(), err)
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer gate.release()
+				// handshakes still running once a peer has been connected to are abandoned, rather than reported
+				handshakeDone := make(chan struct{})
+				go func() {
+					select {
+					case <-finished:
+						conn.Close()
+					case <-handshakeDone:
+					}
+				}()
+				result, err := accept(conn)
+				close(handshakeDone)
+				if err != nil {
+					select {
+					case <-finished:
+					default:
+						rejected(conn.RemoteAddr(), err)
+					}
+					conn.Close()
+					return
+				}
+				// only the first peer to complete the handshake is connected to
+				select {
+				case completed <- handshake{conn, result}:
+				case <-finished:
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	select {
+	case h := <-completed:
+		return h.conn, h.result, nil
+	case err := <-failed:
+		return nil, handshakeResult{}, err
+	}
+}
@@ -0,0 +1,190 @@
+package peerutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeGate(t *testing.T) {
+	source := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000}
+	tests := []struct {
+		name    string
+		prepare func(g *handshakeGate)
+		addr    net.Addr
+		err     error
+	}{
+		{
+			name:    "first handshake",
+			prepare: func(g *handshakeGate) {},
+			addr:    source,
+		},
+		{
+			name:    "eleventh handshake from one source within a minute",
+			prepare: func(g *handshakeGate) { admitFinished(t, g, source, MAX_SOURCE_HANDSHAKES) },
+			addr:    &net.TCPAddr{IP: source.IP, Port: 40001},
+			err:     ErrRateLimited,
+		},
+		{
+			name:    "another source",
+			prepare: func(g *handshakeGate) { admitFinished(t, g, source, MAX_SOURCE_HANDSHAKES) },
+			addr:    other,
+		},
+		{
+			name: "attempts older than the window",
+			prepare: func(g *handshakeGate) {
+				admitFinished(t, g, source, MAX_SOURCE_HANDSHAKES)
+				for i := range g.attempts[source.IP.String()] {
+					g.attempts[source.IP.String()][i] = time.Now().Add(-RATE_LIMIT_WINDOW - time.Second)
+				}
+			},
+			addr: source,
+		},
+		{
+			name: "too many handshakes at once",
+			prepare: func(g *handshakeGate) {
+				for i := 0; i < MAX_CONCURRENT_HANDSHAKES; i++ {
+					if err := g.admit(&net.TCPAddr{IP: net.IPv4(198, 51, 100, byte(i))}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			addr: source,
+			err:  ErrTooManyHandshakes,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := &handshakeGate{attempts: make(map[string][]time.Time)}
+			test.prepare(g)
+			err := g.admit(test.addr)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+// admits and releases count handshakes from addr
+func admitFinished(t *testing.T, g *handshakeGate, addr net.Addr, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := g.admit(addr); err != nil {
+			t.Fatalf("handshake %v was refused: %v", i+1, err)
+		}
+		g.release()
+	}
+}
+
+func TestRecvHandshakeLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		err  error
+	}{
+		{name: "small", size: 100},
+		{name: "largest accepted", size: MAX_HANDSHAKE_MSG_SIZE - 1},
+		{name: "too large", size: MAX_HANDSHAKE_MSG_SIZE + BUF_SIZE + 1, err: ErrMalformed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			go remote.Write(bytes.Repeat([]byte{'a'}, test.size))
+			message, err := recvHandshake(local)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, expected %v", err, test.err)
+			}
+			if err == nil && len(message) != test.size {
+				t.Fatalf("received %v bytes, expected %v", len(message), test.size)
+			}
+		})
+	}
+}
+
+func TestHandshakePhaseDeadlines(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the handshake deadline")
+	}
+	keyA, _ := testKeys(t)
+	tests := []struct {
+		name  string
+		stall func(conn net.Conn) // plays the part of an initiator that stops responding
+	}{
+		{name: "silent from the start", stall: func(conn net.Conn) {}},
+		{
+			name: "stalls after its key",
+			stall: func(conn net.Conn) {
+				conn.Write(keyMessage(MESSAGE_INIT, &keyA.PublicKey))
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			_, keyB := testKeys(t)
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			go func() {
+				test.stall(remote)
+				io.Copy(io.Discard, remote)
+			}()
+			start := time.Now()
+			_, err := acceptHandshake(local, "", keyB.PublicKey, *keyB, testUser(t, keyB, "b"))
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatalf("got %v, expected ErrTimeout", err)
+			}
+			if elapsed := time.Since(start); elapsed < HANDSHAKE_PHASE_TIMEOUT || elapsed > 2*HANDSHAKE_PHASE_TIMEOUT {
+				t.Fatalf("gave up after %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestAcceptPeerSkipsStalledHandshakes(t *testing.T) {
+	keyA, keyB := testKeys(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// a peer that never completes the handshake mustn't hold up one that does
+	stalled, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		initiateHandshake(conn, "", keyA.PublicKey, *keyA, testUser(t, keyA, "a"))
+		io.Copy(io.Discard, conn)
+	}()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, _, err := acceptPeer(listener, func(conn net.Conn) (handshakeResult, error) {
+			return acceptHandshake(conn, "", keyB.PublicKey, *keyB, testUser(t, keyB, "b"))
+		})
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(HANDSHAKE_PHASE_TIMEOUT / 2):
+		t.Fatal("the stalled handshake held up the listener")
+	}
+}
@@ -0,0 +1,421 @@
+package peerutils
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+const (
+	MAX_ENVELOPE_SIZE      = 64 * 1024
+	MAX_MAILBOX_SIZE       = 100               // the most envelopes held for a single recipient
+	MAX_MAILBOX_BOXES      = 10000             // the most recipients envelopes are held for at once
+	MAX_MAILBOX_BYTES      = 256 * 1024 * 1024 // the most bytes of envelopes held for every recipient together
+	MAILBOX_TTL            = 7 * 24 * time.Hour
+	MAILBOX_PRUNE_INTERVAL = time.Hour // how often envelopes older than MAILBOX_TTL are dropped from every box
+)
+
+// mailbox requests, these share the relay's request header, with the recipient's fingerprint in place of a token
+const (
+	MAILBOX_DEPOSIT byte = 0x3
+	MAILBOX_COLLECT byte = 0x4
+)
+
+// a message left for a peer who isn't online, encrypted to their public key and signed by the sender
+type Envelope struct {
+	Sender     []byte // the sender's pem-encoded public key
+	Recipient  string // the recipient's key fingerprint
+	Sent       int64
+	Key        []byte // the message key, encrypted with the recipient's public key
+	Ciphertext []byte
+	Signature  []byte
+}
+
+// the decrypted contents of an envelope
+type envelopeContent struct {
+	Sender User
+	Text   string
+}
+
+// a message collected from a mailbox, after its signature has been verified
+type DroppedMessage struct {
+	Sender      User
+	Fingerprint string
+	Text        string
+	Sent        time.Time
+}
+
+// returns the bytes of an envelope that are covered by its signature
+func (e *Envelope) signedBytes() []byte {
+	sent := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sent, uint64(e.Sent))
+	signed := append([]byte(e.Recipient), sent...)
+	signed = append(signed, e.Sender...)
+	signed = append(signed, e.Key...)
+	return append(signed, e.Ciphertext...)
+}
+
+// encrypts and signs a message for a recipient who may not currently be online
+func SealEnvelope(text string, recipientPub rsa.PublicKey, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, sender User) (*Envelope, error) {
+	contentJson, err := json.Marshal(envelopeContent{Sender: sender, Text: text})
+	if err != nil {
+		return nil, err
+	}
+	key := cryptoutils.GenAesKey()
+	ciphertext, err := cryptoutils.AesEncrypt(contentJson, key)
+	if err != nil {
+		return nil, err
+	}
+	keyCiphertext, err := cryptoutils.RsaEncrypt(&recipientPub, key)
+	if err != nil {
+		return nil, err
+	}
+	envelope := Envelope{
+		Sender:     cryptoutils.ExportRsaPub(&pubKey),
+		Recipient:  cryptoutils.Fingerprint(&recipientPub),
+		Sent:       time.Now().Unix(),
+		Key:        keyCiphertext,
+		Ciphertext: ciphertext,
+	}
+	envelope.Signature, err = cryptoutils.RsaSign(prvKey, envelope.signedBytes())
+	if err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// verifies the sender's signature on an envelope and decrypts it
+func OpenEnvelope(envelope *Envelope, prvKey rsa.PrivateKey) (*DroppedMessage, error) {
+	if envelope.Recipient != cryptoutils.Fingerprint(&prvKey.PublicKey) {
+		return nil, errors.New("mailbox: this message is addressed to somebody else")
+	}
+	senderPub, err := cryptoutils.ImportRsaPub(envelope.Sender)
+	if err != nil {
+		return nil, err
+	}
+	if !cryptoutils.RsaVerify(senderPub, envelope.signedBytes(), envelope.Signature) {
+		return nil, fmt.Errorf("mailbox: %w", ErrSignature)
+	}
+	key, err := cryptoutils.RsaDecrypt(&prvKey, envelope.Key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := cryptoutils.AesDecrypt(envelope.Ciphertext, key)
+	if err != nil {
+		return nil, err
+	}
+	var content envelopeContent
+	err = json.Unmarshal(plaintext, &content)
+	if err != nil {
+		return nil, err
+	}
+	// the sender's claimed identity must belong to the key that signed the envelope
+	if !ValidateId(content.Sender.Id, &senderPub) || len(content.Sender.Name) > 64 {
+		return nil, fmt.Errorf("mailbox: the sender's identity is invalid: %w", ErrPeerIdentityInvalid)
+	}
+	if !slices.Contains([]string{Red, Green, Blue, Yellow, Magenta, Cyan, Gray, White}, content.Sender.Color) {
+		content.Sender.Color = Gray
+	}
+	message := DroppedMessage{
+		Sender:      content.Sender,
+		Fingerprint: cryptoutils.Fingerprint(&senderPub),
+		Text:        content.Text,
+		Sent:        time.Unix(envelope.Sent, 0),
+	}
+	return &message, nil
+}
+
+// a store-and-forward node, holding envelopes until their recipients collect them
+type Mailbox struct {
+	boxes map[string][]storedEnvelope
+	size  int // the total size of every envelope held
+	mut   sync.Mutex
+}
+
+type storedEnvelope struct {
+	contents []byte
+	recieved time.Time
+}
+
+// creates a new, empty mailbox
+func NewMailbox() *Mailbox {
+	return &Mailbox{boxes: make(map[string][]storedEnvelope)}
+}
+
+// drops a recipient's envelopes that have been held for longer than MAILBOX_TTL, the caller must hold the mailbox's lock
+func (m *Mailbox) prune(fingerprint string) {
+	box := m.boxes[fingerprint]
+	box = slices.DeleteFunc(box, func(stored storedEnvelope) bool {
+		expired := time.Since(stored.recieved) > MAILBOX_TTL
+		if expired {
+			m.size -= len(stored.contents)
+		}
+		return expired
+	})
+	if len(box) == 0 {
+		delete(m.boxes, fingerprint)
+	} else {
+		m.boxes[fingerprint] = box
+	}
+}
+
+// drops every envelope that has been held for longer than MAILBOX_TTL, including those for recipients who never
+// return, the caller must hold the mailbox's lock
+func (m *Mailbox) pruneAll() {
+	for fingerprint := range m.boxes {
+		m.prune(fingerprint)
+	}
+}
+
+// prunes every box each interval until stop is closed
+func (m *Mailbox) pruneEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		m.mut.Lock()
+		m.pruneAll()
+		m.mut.Unlock()
+	}
+}
+
+// returns an error if an envelope of the given size can't be stored for a recipient without exceeding the mailbox's
+// limits, the caller must hold the mailbox's lock
+func (m *Mailbox) fits(fingerprint string, size int) error {
+	box, ok := m.boxes[fingerprint]
+	if len(box) >= MAX_MAILBOX_SIZE {
+		return errors.New("mailbox: the recipient's mailbox is full")
+	}
+	if !ok && len(m.boxes) >= MAX_MAILBOX_BOXES {
+		return errors.New("mailbox: holding messages for too many recipients")
+	}
+	if m.size+size > MAX_MAILBOX_BYTES {
+		return errors.New("mailbox: holding too many messages")
+	}
+	return nil
+}
+
+// stores an envelope for a recipient, refusing it once the recipient's box or the mailbox as a whole is full
+func (m *Mailbox) deposit(conn net.Conn, fingerprint string) error {
+	contents, err := readFrame(conn, MAX_ENVELOPE_SIZE)
+	if err != nil {
+		conn.Write([]byte{RES_ERR})
+		return err
+	}
+	m.mut.Lock()
+	m.prune(fingerprint)
+	err = m.fits(fingerprint, len(contents))
+	if err != nil {
+		// expired envelopes in other boxes may be all that's filling the mailbox
+		m.pruneAll()
+		err = m.fits(fingerprint, len(contents))
+	}
+	if err != nil {
+		m.mut.Unlock()
+		conn.Write([]byte{RES_ERR})
+		return err
+	}
+	m.boxes[fingerprint] = append(m.boxes[fingerprint], storedEnvelope{contents: contents, recieved: time.Now()})
+	m.size += len(contents)
+	m.mut.Unlock()
+	_, err = conn.Write([]byte{RES_OK})
+	return err
+}
+
+// hands a recipient their envelopes, once they've proven they hold the private key matching the fingerprint
+func (m *Mailbox) collect(conn net.Conn, fingerprint string) error {
+	pubPem, err := readFrame(conn, BUF_SIZE)
+	if err != nil {
+		return err
+	}
+	pubKey, err := cryptoutils.ImportRsaPub(pubPem)
+	if err != nil || cryptoutils.Fingerprint(&pubKey) != fingerprint {
+		conn.Write([]byte{RES_ERR})
+		return errors.New("mailbox: public key does not match the mailbox")
+	}
+	// challenge the recipient to decrypt a nonce
+	challenge := cryptoutils.GenNonce()
+	challengeCiphertext, err := cryptoutils.RsaEncrypt(&pubKey, challenge)
+	if err != nil {
+		return err
+	}
+	err = writeFrame(conn, challengeCiphertext)
+	if err != nil {
+		return err
+	}
+	response, err := readFrame(conn, BUF_SIZE)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(response, challenge) {
+		conn.Write([]byte{RES_ERR})
+		return fmt.Errorf("mailbox: the recipient failed the challenge: %w", ErrPeerIdentityInvalid)
+	}
+	m.mut.Lock()
+	m.prune(fingerprint)
+	box := m.boxes[fingerprint]
+	delete(m.boxes, fingerprint)
+	for _, stored := range box {
+		m.size -= len(stored.contents)
+	}
+	m.mut.Unlock()
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(box)))
+	_, err = conn.Write(append([]byte{RES_OK}, count...))
+	if err != nil {
+		return err
+	}
+	for _, stored := range box {
+		err = writeFrame(conn, stored.contents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes a length-prefixed frame to the connection
+func writeFrame(conn net.Conn, frame []byte) error {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(frame)))
+	_, err := conn.Write(append(size, frame...))
+	return err
+}
+
+// reads a length-prefixed frame from the connection, rejecting frames larger than maxSize
+func readFrame(conn net.Conn, maxSize int) ([]byte, error) {
+	sizeBuf := make([]byte, 4)
+	_, err := io.ReadFull(conn, sizeBuf)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(sizeBuf)
+	if size > uint32(maxSize) {
+		return nil, invalid("frame", "exceeds the maximum size")
+	}
+	frame := make([]byte, size)
+	_, err = io.ReadFull(conn, frame)
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// leaves a message for an offline peer at a mailbox
+func DepositMessage(mailboxAddr string, recipientPub rsa.PublicKey, text string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, sender User) error {
+	envelope, err := SealEnvelope(text, recipientPub, pubKey, prvKey, sender)
+	if err != nil {
+		return err
+	}
+	contents, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if len(contents) > MAX_ENVELOPE_SIZE {
+		return errors.New("mailbox: message is too large")
+	}
+	conn, err := dialMailbox(mailboxAddr, MAILBOX_DEPOSIT, envelope.Recipient)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = writeFrame(conn, contents)
+	if err != nil {
+		return err
+	}
+	response := make([]byte, 1)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return err
+	}
+	if response[0] != RES_OK {
+		return errors.New("mailbox: the mailbox refused the message")
+	}
+	return nil
+}
+
+// collects and verifies all messages waiting for this user at a mailbox
+// returns the messages that could be verified, and the number that could not
+func CollectMessages(mailboxAddr string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey) ([]DroppedMessage, int, error) {
+	conn, err := dialMailbox(mailboxAddr, MAILBOX_COLLECT, cryptoutils.Fingerprint(&pubKey))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	// prove ownership of the mailbox
+	err = writeFrame(conn, cryptoutils.ExportRsaPub(&pubKey))
+	if err != nil {
+		return nil, 0, err
+	}
+	challenge, err := readFrame(conn, BUF_SIZE)
+	if err != nil {
+		return nil, 0, err
+	}
+	challenge, err = cryptoutils.RsaDecrypt(&prvKey, challenge)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = writeFrame(conn, challenge)
+	if err != nil {
+		return nil, 0, err
+	}
+	response := make([]byte, 5)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response[0] != RES_OK {
+		return nil, 0, errors.New("mailbox: the mailbox refused the collection")
+	}
+	count := binary.LittleEndian.Uint32(response[1:])
+	var messages []DroppedMessage
+	rejected := 0
+	for i := uint32(0); i < count; i++ {
+		contents, err := readFrame(conn, MAX_ENVELOPE_SIZE)
+		if err != nil {
+			return messages, rejected, err
+		}
+		var envelope Envelope
+		err = json.Unmarshal(contents, &envelope)
+		if err != nil {
+			rejected++
+			continue
+		}
+		message, err := OpenEnvelope(&envelope, prvKey)
+		if err != nil {
+			rejected++
+			continue
+		}
+		messages = append(messages, *message)
+	}
+	return messages, rejected, nil
+}
+
+// connects to a mailbox and sends the request header
+func dialMailbox(mailboxAddr string, request byte, fingerprint string) (net.Conn, error) {
+	conn, err := dial(withPort(mailboxAddr, RELAY_PORT))
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{request, byte(len(fingerprint))}, []byte(fingerprint)...)
+	_, err = conn.Write(header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,92 @@
+package peerutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// deposits an envelope of the given size in the mailbox, returning the mailbox's response
+func testDeposit(t *testing.T, m *Mailbox, fingerprint string, size int) byte {
+	t.Helper()
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		m.deposit(remote, fingerprint)
+		remote.Close()
+	}()
+	frame := make([]byte, 4+size)
+	binary.LittleEndian.PutUint32(frame, uint32(size))
+	_, err := local.Write(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 1)
+	_, err = local.Read(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response[0]
+}
+
+// returns a mailbox holding the given number of envelopes of the given size for each of count recipients, all
+// received at the given time
+func filledMailbox(count int, envelopes int, size int, recieved time.Time) *Mailbox {
+	m := NewMailbox()
+	for i := 0; i < count; i++ {
+		for j := 0; j < envelopes; j++ {
+			m.boxes[fmt.Sprint(i)] = append(m.boxes[fmt.Sprint(i)], storedEnvelope{contents: make([]byte, size), recieved: recieved})
+			m.size += size
+		}
+	}
+	return m
+}
+
+// returns a mailbox with too little room left for another envelope, without holding that many bytes
+func nearlyFullMailbox() *Mailbox {
+	m := filledMailbox(1, 1, 0, time.Now())
+	m.size = MAX_MAILBOX_BYTES - 50
+	return m
+}
+
+func TestMailboxLimits(t *testing.T) {
+	expired := time.Now().Add(-MAILBOX_TTL - time.Minute)
+	tests := []struct {
+		name        string
+		mailbox     *Mailbox
+		fingerprint string
+		response    byte
+	}{
+		{name: "empty", mailbox: NewMailbox(), fingerprint: "new", response: RES_OK},
+		{name: "full recipient", mailbox: filledMailbox(1, MAX_MAILBOX_SIZE, 0, time.Now()), fingerprint: "0", response: RES_ERR},
+		{name: "too many recipients", mailbox: filledMailbox(MAX_MAILBOX_BOXES, 1, 0, time.Now()), fingerprint: "new", response: RES_ERR},
+		{name: "existing recipient of a full mailbox", mailbox: filledMailbox(MAX_MAILBOX_BOXES, 1, 0, time.Now()), fingerprint: "0", response: RES_OK},
+		{name: "too many bytes", mailbox: nearlyFullMailbox(), fingerprint: "0", response: RES_ERR},
+		{name: "full of expired envelopes", mailbox: filledMailbox(MAX_MAILBOX_BOXES, 1, 0, expired), fingerprint: "new", response: RES_OK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := testDeposit(t, test.mailbox, test.fingerprint, 100)
+			if response != test.response {
+				t.Fatalf("got response %v, expected %v", response, test.response)
+			}
+		})
+	}
+}
+
+func TestMailboxPruneAll(t *testing.T) {
+	m := filledMailbox(10, 1, 100, time.Now().Add(-MAILBOX_TTL-time.Minute))
+	m.boxes["recent"] = []storedEnvelope{{contents: make([]byte, 50), recieved: time.Now()}}
+	m.size += 50
+	stop := make(chan struct{})
+	go m.pruneEvery(10*time.Millisecond, stop)
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if len(m.boxes) != 1 || m.size != 50 {
+		t.Fatalf("%v boxes holding %v bytes remain, expected 1 holding 50", len(m.boxes), m.size)
+	}
+}
@@ -23,6 +23,7 @@ const ColorReset = "\033[0m"
 type Message struct {
 	content  string
 	timeSent string
+	sent     time.Time
 	sender   *User
 }
 
@@ -33,8 +34,8 @@ func (m Message) Display(stream io.Writer) {
 
 // constructs a new message, making a note of the current timestamp
 func NewMessage(content string, usr *User) *Message {
-	timeStr := time.Now().Format("15:04:05")
-	return &Message{content: content, sender: usr, timeSent: timeStr}
+	now := time.Now()
+	return &Message{content: content, sender: usr, timeSent: now.Format("15:04:05"), sent: now}
 }
 
 // parses a color's name into an ANSI color coe
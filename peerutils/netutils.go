@@ -1,18 +1,26 @@
 package peerutils
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"slices"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/DrewRoss5/courier/cryptoutils"
 )
 
-const BUF_SIZE = 1024
+const (
+	BUF_SIZE          = 1024
+	DEFAULT_PORT      = 54000
+	RECONNECT_TIMEOUT = 30 * time.Second
+	SHUTDOWN_TIMEOUT  = 5 * time.Second
+	MAX_KEY_MSG_SIZE  = 64 * 1024
+)
 
 // message codes wil be defined here
 const (
@@ -24,19 +32,178 @@ const (
 	MESSAGE_DELETE     byte = 0x4
 	MESSAGE_DISCONNECT byte = 0x5
 	CHAT_ARCHIVE       byte = 0x6
+	MESSAGE_EPHEMERAL  byte = 0x7
+	MESSAGE_REKEY      byte = 0x8
+	MESSAGE_HEARTBEAT  byte = 0x9
+	MESSAGE_FRAGMENT   byte = 0xA
+	MESSAGE_DUMMY      byte = 0xB
+	MESSAGE_NUMBERED   byte = 0xC // another message preceded by its 8 byte id, see FEATURE_MESSAGE_IDS
 )
 
+// optional protocol features, each only used once both peers have announced support for it during the handshake
+const (
+	FEATURE_REKEY       = "rekey"     // replacing the keys messages are encrypted with, see RekeyPolicy
+	FEATURE_PADDING     = "padding"   // padding messages before they're encrypted, see PaddingPolicy
+	FEATURE_HEARTBEAT   = "heartbeat" // sending heartbeats while the chat is idle, see HeartbeatPolicy
+	FEATURE_COVER       = "cover"     // sending fixed size frames at a constant rate, see CoverPolicy
+	FEATURE_MESSAGE_IDS = "ids"       // numbering chat messages, so that one resent after a reconnect is only shown once
+	// the initiator opening both of the tunnel's connections, rather than the peer connecting back to them, so that
+	// chats work through proxies and NAT
+	FEATURE_INITIATOR_DIALS = "initiator-dials"
+)
+
+// the optional features this version supports
+var supportedFeatures = []string{FEATURE_REKEY, FEATURE_PADDING, FEATURE_HEARTBEAT, FEATURE_COVER, FEATURE_MESSAGE_IDS, FEATURE_INITIATOR_DIALS}
+
+// the statements linking the user's earlier keys to their current one, sent to peers during handshakes
+var succession []cryptoutils.Succession
+
+// the outcome of a successful handshake
+type handshakeResult struct {
+	sessionKey []byte
+	peerPub    rsa.PublicKey
+	peer       User
+	succession []cryptoutils.Succession // the peer's verified succession chain, empty if they never rotated their key
+	features   []string                 // the optional features both peers support
+	padding    PaddingPolicy            // the padding both peers apply to their messages
+	heartbeat  time.Duration            // how often both peers send heartbeats
+	cover      CoverPolicy              // the cover traffic both peers send, if either asked for it
+	agreed     agreement                // the protocol version, cipher suite and features settled from both peers' hellos
+	peerHello  *hello                   // the hello the peer sent, nil if they predate hellos
+}
+
+// the information each peer sends about themselves during the handshake
+// older versions only read the user's fields, and don't send any features or hello
+type peerInfo struct {
+	User
+	Features  []string       `json:",omitempty"`
+	Hello     *hello         `json:",omitempty"` // the hello the peer sent before the session key, repeated so it can't be altered in transit
+	Padding   *PaddingPolicy `json:",omitempty"` // the padding the peer asks for
+	Heartbeat time.Duration  `json:",omitempty"` // how often the peer asks for heartbeats
+	Cover     *CoverPolicy   `json:",omitempty"` // the cover traffic the peer asks for
+}
+
+// returns the information sent to the peer about this user
+func localInfo(user User) peerInfo {
+	local := localHello()
+	return peerInfo{User: user, Features: supportedFeatures, Hello: &local, Padding: &padding, Heartbeat: heartbeat.withDefaults().Interval, Cover: &cover}
+}
+
+// settles the features, padding, heartbeat interval and cover traffic both peers agree on, given the information
+// the peer sent. A peer asking for padding or cover traffic this version can't apply is held to the local policy
+// fails with ErrHandshake if the peer's hello was altered, or removed, in transit
+func (r *handshakeResult) negotiate(info peerInfo) error {
+	r.features = commonFeatures(info.Features)
+	// a peer that repeats a hello sent one, so a missing hello means it was stripped to force the legacy protocol
+	if r.peerHello == nil && info.Hello != nil {
+		return fmt.Errorf("%w: the peer's hello was removed before the session key", ErrHandshake)
+	}
+	// peers that sent a hello have their features settled by it, once it's shown to be the one they sent
+	if r.peerHello != nil {
+		if info.Hello == nil || !info.Hello.equal(*r.peerHello) {
+			return fmt.Errorf("%w: the peer's hello doesn't match the one sent before the session key", ErrHandshake)
+		}
+		r.features = r.agreed.features
+	}
+	if slices.Contains(r.features, FEATURE_PADDING) {
+		r.padding = padding
+		if info.Padding != nil && info.Padding.Validate() == nil {
+			r.padding = strongerPadding(padding, *info.Padding)
+		}
+	}
+	if slices.Contains(r.features, FEATURE_HEARTBEAT) {
+		r.heartbeat = agreeInterval(heartbeat.withDefaults().Interval, info.Heartbeat)
+	}
+	// cover traffic relies on padding to make every frame the same size
+	if slices.Contains(r.features, FEATURE_COVER) && slices.Contains(r.features, FEATURE_PADDING) {
+		r.cover = cover
+		if info.Cover != nil && info.Cover.Validate() == nil {
+			r.cover = agreeCover(cover, *info.Cover)
+		}
+		if r.cover.Enabled() {
+			r.padding = PaddingPolicy{Mode: PADDING_BLOCK, Block: r.cover.Size}
+		}
+	}
+	return nil
+}
+
+// returns the features of a peer's that this version supports too
+func commonFeatures(features []string) []string {
+	var common []string
+	for _, feature := range features {
+		if slices.Contains(supportedFeatures, feature) && !slices.Contains(common, feature) {
+			common = append(common, feature)
+		}
+	}
+	return common
+}
+
+// sets the succession chain sent to peers during handshakes, which must end at the user's current key
+func SetSuccession(chain []cryptoutils.Succession) {
+	succession = chain
+}
+
+// creates a tunnel from the outcome of a handshake
+func (r handshakeResult) tunnel(prvKey rsa.PrivateKey, user User, incoming net.Conn, outgoing net.Conn, redial func() (*Tunnel, error)) *Tunnel {
+	// both directions start with the session key, and each is rekeyed independently by its sender
+	tunnel := &Tunnel{PeerPubKey: r.peerPub, PeerSuccession: r.succession, Version: r.agreed.version, Suite: r.agreed.suite, Features: r.features, Padding: r.padding, Heartbeat: HeartbeatPolicy{Interval: r.heartbeat, Limit: heartbeat.withDefaults().Limit}, userPrvKey: prvKey, Incoming: incoming, Outgoing: outgoing, Peer: r.peer, User: user, redial: redial, send: newTunnelKey(r.sessionKey), recv: newTunnelKey(r.sessionKey), live: newLiveness(), Cover: r.cover}
+	if r.cover.Enabled() {
+		tunnel.cover = newCoverQueue(r.cover)
+	}
+	return tunnel
+}
+
+// parses a peer's public key and the succession statements sent after it
+// statements that don't form a valid chain ending at the key are ignored, rather than failing the handshake
+func parsePeerKey(data []byte) (rsa.PublicKey, []cryptoutils.Succession, error) {
+	peerPub, err := cryptoutils.ImportRsaPub(data)
+	if err != nil {
+		return rsa.PublicKey{}, nil, invalid("public key", "malformed PEM or PKCS #1 encoding")
+	}
+	// signatures are read as SIGNATURE_SIZE bytes, so keys of any other size can't be used
+	if peerPub.Size() != cryptoutils.SIGNATURE_SIZE {
+		return rsa.PublicKey{}, nil, invalid("public key", "expected an RSA-4096 key")
+	}
+	chain, err := cryptoutils.DecodeSuccession(data)
+	if err != nil || cryptoutils.VerifySuccession(chain, &peerPub) != nil {
+		return peerPub, nil, nil
+	}
+	return peerPub, chain, nil
+}
+
+// recieves a message made of PEM blocks, continuing to read until the last block is complete
+func recvPem(conn net.Conn) ([]byte, error) {
+	message, err := recvHandshake(conn)
+	for err == nil && bytes.Count(message, []byte("-----BEGIN ")) > bytes.Count(message, []byte("-----END ")) {
+		if len(message) > MAX_KEY_MSG_SIZE {
+			return nil, invalid("handshake message", "too large")
+		}
+		var more []byte
+		more, err = recvHandshake(conn)
+		message = append(message, more...)
+	}
+	return message, err
+}
+
 // recieves data of unknown size from Conn object
 func RecvAll(conn net.Conn) (int, []byte, error) {
+	return recvUpTo(conn, 0)
+}
+
+// recieves data of unknown size from conn, failing once more than limit bytes have been read, a limit of zero reads any amount
+func recvUpTo(conn net.Conn, limit int) (int, []byte, error) {
 	message := make([]byte, 0, BUF_SIZE)
 	buf := make([]byte, BUF_SIZE)
 	totalRead := 0
 	for {
 		sizeRead, err := conn.Read(buf)
 		if err != nil {
-			return 0, nil, err
+			return 0, nil, timedOut(err)
 		}
 		totalRead += sizeRead
+		if limit != 0 && totalRead > limit {
+			return 0, nil, invalid("handshake message", "too large")
+		}
 		message = append(message, buf[:sizeRead]...)
 		if sizeRead < BUF_SIZE {
 			break
@@ -45,231 +212,363 @@ func RecvAll(conn net.Conn) (int, []byte, error) {
 	return totalRead, message, nil
 }
 
+// appends the default port to an address that doesn't specify one
+func withPort(addr string, port string) string {
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
+
+// splits an address into its host and base port, using the default port if none is given
+// peers use the base port for handshakes, and the two ports above it for the tunnel itself
+func splitAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(withPort(addr, strconv.Itoa(DEFAULT_PORT)))
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65533 {
+		return "", 0, errors.New("invalid port")
+	}
+	return host, port, nil
+}
+
 // attempts to connect to a peer, returning a tunnel if the peer can be reached
-func ConnectPeer(addr string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, initiator User) (*Tunnel, error) {
-	conn, err := net.Dial("tcp", addr+":54000")
+// if pinned is not empty, the connection is refused unless the peer's key has that fingerprint
+func ConnectPeer(addr string, pinned string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, initiator User) (*Tunnel, error) {
+	host, port, err := splitAddr(addr)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	// send this RSA key, and await the response
-	conn.Write(append([]byte{MESSAGE_INIT}, cryptoutils.ExportRsaPub(&pubKey)...))
-	_, response, err := RecvAll(conn)
+	conn, err := dial(net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		conn.Write([]byte{RES_ERR})
 		return nil, err
 	}
-	// peer does not initiate the connection
-	if response[0] != RES_OK {
-		return nil, errors.New("connection not established")
-	}
-	// parse the public key
-	peerPub, err := cryptoutils.ImportRsaPub(response[1:])
+	result, err := initiateHandshake(conn, pinned, pubKey, prvKey, initiator)
 	if err != nil {
-		conn.Write([]byte{RES_ERR})
+		conn.Close()
 		return nil, err
 	}
-	// generate, encrypt, and send the session key
-	sessionKey := cryptoutils.GenAesKey()
-	keyCiphertext, _ := cryptoutils.RsaEncrypt(&peerPub, sessionKey)
-	conn.Write(keyCiphertext)
-	conn.Read(response)
-	if response[0] != RES_OK {
+	redial := func() (*Tunnel, error) {
+		return ConnectPeer(addr, pinned, pubKey, prvKey, initiator)
+	}
+	// messages from the peer arrive over the handshake's connection, and messages to them over a second connection
+	// this user opens once they're listening for it
+	if slices.Contains(result.features, FEATURE_INITIATOR_DIALS) {
+		handshakePhase(conn)
+		err = readAck(conn, ErrHandshakeRejected)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		outgoing, err := dial(net.JoinHostPort(host, strconv.Itoa(port+2)))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return result.tunnel(prvKey, initiator, conn, outgoing, redial), nil
+	}
+	defer conn.Close()
+	// older peers connect back to the address they were reached from, which is the proxy's when one is used
+	if proxy != nil {
+		return nil, errors.New("proxy: the peer's version of Courier connects back to you, which doesn't work through a proxy")
+	}
+	// await a connection on this incoming port
+	incoming, err := acceptTunnel(port+1, nil)
+	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, errors.New("failed to verify the session key with peer")
+		return nil, err
 	}
-	// create and encrypt a challegene
-	checksum := cryptoutils.GenNonce()
-	checksumCiphertext, _ := cryptoutils.AesEncrypt(checksum, sessionKey)
-	_, err = conn.Write(checksumCiphertext)
+	// connect to the peer's incoming port
+	time.Sleep(time.Second) // this is a very hacky way of avoiding a race condition and needs to be fixed
+	outgoing, err := dial(net.JoinHostPort(host, strconv.Itoa(port+2)))
 	if err != nil {
+		incoming.Close()
 		conn.Write([]byte{RES_ERR})
 		return nil, err
 	}
-	_, checksumResponse, err := RecvAll(conn)
+	return result.tunnel(prvKey, initiator, incoming, outgoing, redial), nil
+}
+
+// listens on the given port for the peer to open one of the tunnel's connections, telling them it's listening through
+// ready when it isn't nil
+func acceptTunnel(port int, ready net.Conn) (net.Conn, error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
 		return nil, err
 	}
-	responsePlaintext, err := cryptoutils.RsaDecrypt(&prvKey, checksumResponse)
+	defer listener.Close()
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(HANDSHAKE_PHASE_TIMEOUT))
+	if ready != nil {
+		_, err = ready.Write([]byte{RES_OK})
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, timedOut(err)
+	}
+	return conn, nil
+}
+
+// awaits an incoming connection from a peer on the given base port, returning a tunnel once the handshake completes
+func AwaitPeer(port int, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, reciever User) (*Tunnel, error) {
+	return awaitPeer(port, pubKey, prvKey, reciever, 0)
+}
+
+// awaits a peer, giving up if nobody connects within the timeout. A timeout of zero waits indefinitely
+func awaitPeer(port int, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, reciever User, timeout time.Duration) (*Tunnel, error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
-		conn.Write([]byte{RES_ERR})
 		return nil, err
 	}
-	if slices.Compare(checksum, responsePlaintext) != 0 {
-		conn.Write([]byte{RES_ERR})
-		return nil, errors.New("failed to verify the session key with peer")
+	defer listener.Close()
+	if timeout != 0 {
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
 	}
-	// send the information of this user to the peer
-	userJson, err := json.Marshal(initiator)
+	conn, result, err := acceptPeer(listener, func(conn net.Conn) (handshakeResult, error) {
+		return acceptHandshake(conn, "", pubKey, prvKey, reciever)
+	})
+	if err != nil {
+		return nil, timedOut(err)
+	}
+	redial := func() (*Tunnel, error) {
+		return awaitPeer(port, pubKey, prvKey, reciever, RECONNECT_TIMEOUT)
+	}
+	// messages to the peer are sent over the handshake's connection, and the peer opens a second one for their messages
+	if slices.Contains(result.features, FEATURE_INITIATOR_DIALS) {
+		incoming, err := acceptTunnel(port+2, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return result.tunnel(prvKey, reciever, incoming, conn, redial), nil
+	}
+	defer conn.Close()
+	// connect to the peer's incoming port
+	peerAddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
 		return nil, err
 	}
-	userCiphertext, _ := cryptoutils.AesEncrypt(userJson, sessionKey)
-	_, err = conn.Write(append([]byte{RES_OK}, userCiphertext...))
+	time.Sleep(time.Second) // this is a very hacky way of avoiding a race condition and needs to be fixed
+	outgoing, err := dial(net.JoinHostPort(peerAddr, strconv.Itoa(port+1)))
 	if err != nil {
 		return nil, err
 	}
-	// recieve and decrypt the peer's info
-	_, peerCiphertext, err := RecvAll(conn)
-	if err != nil || peerCiphertext[0] != RES_OK {
+	// await the peer's connection to the incoming port
+	incoming, err := acceptTunnel(port+2, nil)
+	if err != nil {
+		outgoing.Close()
 		return nil, err
 	}
-	peerInfo, err := cryptoutils.AesDecrypt(peerCiphertext[1:], sessionKey)
+	return result.tunnel(prvKey, reciever, incoming, outgoing, redial), nil
+}
+
+// performs the initiating side of the handshake over conn, returning the session key and the peer's verified identity
+// a peer whose key doesn't match pinned is still accepted if they prove their pinned key was replaced by their current one
+func initiateHandshake(conn net.Conn, pinned string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, initiator User) (handshakeResult, error) {
+	// send this RSA key, and await the response
+	handshakePhase(conn)
+	conn.Write(keyMessage(MESSAGE_INIT, &pubKey))
+	response, err := recvPem(conn)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
+	}
+	// peer does not initiate the connection
+	if response[0] != RES_OK {
+		return handshakeResult{}, ErrHandshakeRejected
 	}
-	var peer User
-	err = json.Unmarshal(cryptoutils.StripZeroes(peerInfo), &peer)
+	// parse the public key, and settle the protocol both peers will speak
+	peerPub, chain, err := parsePeerKey(response[1:])
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
-	// validate the peer's ID
-	if !ValidateId(peer.Id, &peerPub) {
+	peerHello, err := decodeHello(response[1:])
+	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
-	// validate the peer's username and color
-	if !slices.Contains([]string{Red, Green, Blue, Yellow, Magenta, Cyan, Gray, White}, peer.Color) {
+	agreed, err := settle(peerHello, true)
+	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
-	if len(peer.Name) > 64 {
+	// refuse to continue if the peer's key isn't the one we expect
+	if pinned != "" && cryptoutils.Fingerprint(&peerPub) != pinned && !cryptoutils.SucceededFrom(chain, pinned) {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, ErrPinMismatch
 	}
-	_, err = conn.Write([]byte{RES_OK})
+	// generate, encrypt, and send the session key
+	sessionKey := cryptoutils.GenAesKey()
+	keyCiphertext, _ := cryptoutils.RsaEncrypt(&peerPub, sessionKey)
+	handshakePhase(conn)
+	conn.Write(keyCiphertext)
+	err = readAck(conn, ErrHandshakeRejected)
 	if err != nil {
-		return nil, err
+		conn.Write([]byte{RES_ERR})
+		return handshakeResult{}, err
 	}
-	// await a connection on this incoming port
-	listener, err := net.Listen("tcp", ":54001")
+	// create and encrypt a challegene
+	checksum := cryptoutils.GenNonce()
+	checksumCiphertext, _ := cryptoutils.AesEncrypt(checksum, sessionKey)
+	handshakePhase(conn)
+	_, err = conn.Write(checksumCiphertext)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
-	incoming, err := listener.Accept()
+	checksumResponse, err := recvHandshake(conn)
 	if err != nil {
-		return nil, err
+		return handshakeResult{}, err
 	}
-	// connect to the peer's incoming port
-	time.Sleep(time.Second) // this is a very hacky way of avoiding a race condition and needs to be fixed
-	outgoing, err := net.Dial("tcp", addr+":54002")
-	if err != nil {
+	// only the owner of the peer's key could have decrypted the session key, and so the challenge
+	responsePlaintext, err := cryptoutils.RsaDecrypt(&prvKey, checksumResponse)
+	if err != nil || slices.Compare(checksum, responsePlaintext) != 0 {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, ErrPeerIdentityInvalid
 	}
-	return &Tunnel{sessionKey: sessionKey, PeerPubKey: peerPub, userPrvKey: prvKey, Incoming: incoming, Outgoing: outgoing, Peer: peer, User: initiator}, nil
-}
-
-func AwaitPeer(pubKey rsa.PublicKey, prvKey rsa.PrivateKey, reciever User) (*Tunnel, error) {
-	listener, err := net.Listen("tcp", ":54000")
+	// send the information of this user to the peer
+	userJson, err := json.Marshal(localInfo(initiator))
 	if err != nil {
-		return nil, err
+		return handshakeResult{}, err
 	}
-	conn, err := listener.Accept()
+	userCiphertext, _ := cryptoutils.AesEncrypt(userJson, sessionKey)
+	handshakePhase(conn)
+	_, err = conn.Write(append([]byte{RES_OK}, userCiphertext...))
 	if err != nil {
-		return nil, err
+		return handshakeResult{}, err
 	}
-	defer conn.Close()
-	_, message, err := RecvAll(conn)
+	// recieve and decrypt the peer's info
+	peerCiphertext, err := recvHandshake(conn)
 	if err != nil {
-		return nil, err
+		return handshakeResult{}, err
 	}
-	// TODO: implement additional features for differing requests
-	if message[0] != MESSAGE_INIT {
-		return nil, errors.New("unrecognized request")
+	if peerCiphertext[0] != RES_OK {
+		return handshakeResult{}, ErrHandshakeRejected
 	}
-	peerPem := message[1:]
-	peerPub, err := cryptoutils.ImportRsaPub(peerPem)
+	// validate the peer's ID, username and color
+	info, err := decodePeerInfo(peerCiphertext[1:], sessionKey, &peerPub)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
+	}
+	result := handshakeResult{sessionKey: sessionKey, peerPub: peerPub, peer: info.User, succession: chain, agreed: agreed, peerHello: peerHello}
+	err = result.negotiate(info)
+	if err != nil {
+		conn.Write([]byte{RES_ERR})
+		return handshakeResult{}, err
+	}
+	_, err = conn.Write([]byte{RES_OK})
+	if err != nil {
+		return handshakeResult{}, err
+	}
+	conn.SetDeadline(time.Time{})
+	return result, nil
+}
+
+// performs the recieving side of the handshake over conn, returning the session key and the peer's verified identity
+// if pinned is not empty, a peer whose key doesn't match it is refused unless they prove their pinned key was replaced
+// by their current one
+func acceptHandshake(conn net.Conn, pinned string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, reciever User) (handshakeResult, error) {
+	handshakePhase(conn)
+	message, err := recvPem(conn)
+	if err != nil {
+		return handshakeResult{}, err
+	}
+	peerPub, chain, peerHello, err := decodeInit(message)
+	if err != nil {
+		conn.Write([]byte{RES_ERR})
+		return handshakeResult{}, err
+	}
+	// refuse to continue if the peer's key isn't the one we expect
+	if pinned != "" && cryptoutils.Fingerprint(&peerPub) != pinned && !cryptoutils.SucceededFrom(chain, pinned) {
+		conn.Write([]byte{RES_ERR})
+		return handshakeResult{}, ErrPinMismatch
+	}
+	// this user's hello is sent even to an incompatible peer, so that they can tell why the handshake failed
+	conn.Write(keyMessage(RES_OK, &pubKey))
+	agreed, err := settle(peerHello, false)
+	if err != nil {
+		return handshakeResult{}, err
 	}
-	conn.Write(append([]byte{RES_OK}, cryptoutils.ExportRsaPub(&pubKey)...))
 	// await the session key
-	_, keyCiphertext, err := RecvAll(conn)
+	handshakePhase(conn)
+	keyCiphertext, err := recvHandshake(conn)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
+	}
+	// an initiator that refuses this user's key, such as one whose pinned fingerprint doesn't match, says so in place of the key
+	if bytes.Equal(keyCiphertext, []byte{RES_ERR}) {
+		return handshakeResult{}, ErrHandshakeRejected
 	}
 	sessionKey, err := cryptoutils.RsaDecrypt(&prvKey, keyCiphertext)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
+	}
+	if len(sessionKey) != cryptoutils.AES_KEY_SIZE {
+		conn.Write([]byte{RES_ERR})
+		return handshakeResult{}, invalid("session key", "expected an encrypted AES key")
 	}
 	conn.Write([]byte{RES_OK})
 	// await the challenge
-	_, challenge, err := RecvAll(conn)
+	handshakePhase(conn)
+	challenge, err := recvHandshake(conn)
 	if err != nil {
-		return nil, err
+		return handshakeResult{}, err
 	}
-	challenge, err = cryptoutils.AesDecrypt(challenge, sessionKey)
-	challenge = challenge[len(challenge)-16:]
+	challenge, err = decodeChallenge(challenge, sessionKey)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
 	challengeResponse, err := cryptoutils.RsaEncrypt(&peerPub, challenge)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
 	conn.Write(challengeResponse)
 	// await the verification
-	_, response, err := RecvAll(conn)
+	handshakePhase(conn)
+	response, err := recvHandshake(conn)
 	if err != nil {
-		return nil, err
+		return handshakeResult{}, err
 	}
 	if response[0] != RES_OK {
-		return nil, errors.New("failed to verify the session with peer ")
+		return handshakeResult{}, ErrHandshakeRejected
 	}
-	response = response[1:]
-	// recieve the peer's information
-	peerInfo, err := cryptoutils.AesDecrypt(response, sessionKey)
+	// recieve the peer's information, and validate their ID, username and color
+	info, err := decodePeerInfo(response[1:], sessionKey, &peerPub)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
-	var peer User
-	err = json.Unmarshal(cryptoutils.StripZeroes(peerInfo), &peer)
+	result := handshakeResult{sessionKey: sessionKey, peerPub: peerPub, peer: info.User, succession: chain, agreed: agreed, peerHello: peerHello}
+	err = result.negotiate(info)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
-	}
-	// validate the peer's ID
-	if !ValidateId(peer.Id, &peerPub) {
-		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
 	// send the peer the user's information
-	userInfo, _ := json.Marshal(reciever)
+	userInfo, _ := json.Marshal(localInfo(reciever))
 	userCiphertext, _ := cryptoutils.AesEncrypt(userInfo, sessionKey)
+	handshakePhase(conn)
 	conn.Write(append([]byte{RES_OK}, userCiphertext...))
-	_, response, err = RecvAll(conn)
+	response, err = recvHandshake(conn)
 	if err != nil {
 		conn.Write([]byte{RES_ERR})
-		return nil, err
+		return handshakeResult{}, err
 	}
 	if response[0] != RES_OK {
-		return nil, errors.New("failed to initiate the connection")
-	}
-	// connect to the peer's incoming port
-	peerAddr := strings.Split(conn.RemoteAddr().String(), ":")[0]
-	time.Sleep(time.Second) // this is a very hacky way of avoiding a race condition and needs to be fixed
-	outgoing, err := net.Dial("tcp", peerAddr+":54001")
-	if err != nil {
-		return nil, err
-	}
-	// await the peer's connection to the incoming port
-	listener, err = net.Listen("tcp", ":54002")
-	if err != nil {
-		return nil, err
-	}
-	incoming, err := listener.Accept()
-	if err != nil {
-		return nil, err
+		return handshakeResult{}, ErrHandshakeRejected
 	}
-	return &Tunnel{sessionKey: sessionKey, PeerPubKey: peerPub, userPrvKey: prvKey, Incoming: incoming, Outgoing: outgoing, Peer: peer, User: reciever}, nil
+	conn.SetDeadline(time.Time{})
+	return result, nil
 }
@@ -0,0 +1,149 @@
+package peerutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+const (
+	PADDING_NONE          = "none"  // messages are only padded by their end marker
+	PADDING_POW2          = "pow2"  // messages are padded to the next power of two
+	PADDING_BLOCK         = "block" // messages are padded to a multiple of a fixed block size
+	DEFAULT_PADDING_BLOCK = 256
+	MIN_PADDING_BLOCK     = 16
+	MAX_PADDING_BLOCK     = 64 * 1024
+	PADDING_BLOCK_STEP    = 8 // block sizes must be a multiple of this, see frameSize
+	MIN_POW2_SIZE         = 32
+	PADDING_MARKER        = 0x80 // separates a message from the zeroes padding it
+)
+
+// how messages are padded before they're encrypted, so that their ciphertexts don't reveal their exact length
+type PaddingPolicy struct {
+	Mode  string `json:"mode"`
+	Block int    `json:"block,omitempty"` // the size messages are padded to a multiple of, in the block mode
+}
+
+// the padding this user asks peers to use, sent during handshakes
+var padding PaddingPolicy
+
+// sets the padding asked for during handshakes, a chat uses the stronger of its two peers' policies
+func SetPadding(policy PaddingPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	padding = policy
+	return nil
+}
+
+// creates a padding policy from a mode name, a block size of zero uses the default
+func ParsePadding(mode string, block int) (PaddingPolicy, error) {
+	if mode == "" {
+		mode = PADDING_NONE
+	}
+	policy := PaddingPolicy{Mode: mode}
+	if mode == PADDING_BLOCK {
+		policy.Block = block
+		if block == 0 {
+			policy.Block = DEFAULT_PADDING_BLOCK
+		}
+	}
+	return policy, policy.Validate()
+}
+
+// ensures the policy is one this version can apply
+func (p PaddingPolicy) Validate() error {
+	switch p.Mode {
+	case "", PADDING_NONE, PADDING_POW2:
+		return nil
+	case PADDING_BLOCK:
+		if p.Block < MIN_PADDING_BLOCK || p.Block > MAX_PADDING_BLOCK || p.Block%PADDING_BLOCK_STEP != 0 {
+			return fmt.Errorf("padding: the block size must be a multiple of %v between %v and %v", PADDING_BLOCK_STEP, MIN_PADDING_BLOCK, MAX_PADDING_BLOCK)
+		}
+		return nil
+	default:
+		return errors.New("padding: the mode must be none, pow2 or block")
+	}
+}
+
+// describes the policy as it's shown to users
+func (p PaddingPolicy) String() string {
+	switch p.Mode {
+	case PADDING_POW2:
+		return "padded to powers of two"
+	case PADDING_BLOCK:
+		return fmt.Sprintf("padded to %v byte blocks", p.Block)
+	default:
+		return "unpadded"
+	}
+}
+
+// ranks how well a policy hides message lengths, for choosing between two peers' policies
+func (p PaddingPolicy) strength() int {
+	switch p.Mode {
+	case PADDING_POW2:
+		return 1
+	case PADDING_BLOCK:
+		return 1 + p.Block
+	default:
+		return 0
+	}
+}
+
+// returns whichever of two policies hides message lengths best
+// a fixed block pads short chat messages most evenly, so it's preferred over powers of two, and larger blocks over smaller
+func strongerPadding(a PaddingPolicy, b PaddingPolicy) PaddingPolicy {
+	if b.strength() > a.strength() {
+		return b
+	}
+	return a
+}
+
+// returns the size a message of the given length is padded to, including its end marker
+func (p PaddingPolicy) size(length int) int {
+	length++
+	switch p.Mode {
+	case PADDING_POW2:
+		size := MIN_POW2_SIZE
+		for size < length {
+			size *= 2
+		}
+		return size
+	case PADDING_BLOCK:
+		return (length + p.Block - 1) / p.Block * p.Block
+	default:
+		return length
+	}
+}
+
+// returns the size of the frame a padded message is sent in, once it's encrypted and signed
+func frameSize(padded int) int {
+	return cryptoutils.SIGNATURE_SIZE + cryptoutils.AES_MIN_CIPHERTEXT_SIZE + padded
+}
+
+// appends the end marker and padding to a message, leaving the message itself untouched
+// the peer stops reading a frame at its first short read, so a frame that would fill its last read exactly is given an
+// extra byte of padding. Blocks are a multiple of PADDING_BLOCK_STEP, and powers of two at least MIN_POW2_SIZE, so
+// that only unpadded messages ever need it
+func (p PaddingPolicy) pad(message []byte) []byte {
+	size := p.size(len(message))
+	if frameSize(size)%BUF_SIZE == 0 {
+		size++
+	}
+	padded := make([]byte, size)
+	copy(padded, message)
+	padded[len(message)] = PADDING_MARKER
+	return padded
+}
+
+// removes the padding and end marker from a message padded by pad
+func unpad(padded []byte) ([]byte, error) {
+	end := bytes.LastIndexByte(padded, PADDING_MARKER)
+	if end == -1 || len(bytes.Trim(padded[end+1:], "\x00")) != 0 {
+		return nil, invalid("padding", "expected an end marker followed only by zeroes")
+	}
+	return padded[:end], nil
+}
@@ -0,0 +1,82 @@
+package peerutils
+
+import "testing"
+
+func TestPadRoundTrip(t *testing.T) {
+	policies := []PaddingPolicy{
+		{Mode: PADDING_NONE},
+		{Mode: PADDING_POW2},
+		{Mode: PADDING_BLOCK, Block: MIN_PADDING_BLOCK},
+		{Mode: PADDING_BLOCK, Block: 480},
+		{Mode: PADDING_BLOCK, Block: MAX_PADDING_BLOCK},
+	}
+	for _, policy := range policies {
+		for length := 0; length < 3*BUF_SIZE; length++ {
+			message := make([]byte, length)
+			for i := range message {
+				message[i] = byte(i)
+			}
+			padded := policy.pad(message)
+			if frameSize(len(padded))%BUF_SIZE == 0 {
+				t.Fatalf("%v padded %v bytes into a frame filling its last read", policy, length)
+			}
+			unpadded, err := unpad(padded)
+			if err != nil || len(unpadded) != length {
+				t.Fatalf("%v failed to unpad %v bytes: %v", policy, length, err)
+			}
+		}
+	}
+}
+
+func TestPaddingSize(t *testing.T) {
+	tests := []struct {
+		policy PaddingPolicy
+		length int
+		size   int
+	}{
+		{policy: PaddingPolicy{Mode: PADDING_NONE}, length: 10, size: 11},
+		{policy: PaddingPolicy{Mode: PADDING_POW2}, length: 0, size: MIN_POW2_SIZE},
+		{policy: PaddingPolicy{Mode: PADDING_POW2}, length: 63, size: 64},
+		{policy: PaddingPolicy{Mode: PADDING_POW2}, length: 64, size: 128},
+		{policy: PaddingPolicy{Mode: PADDING_BLOCK, Block: 256}, length: 0, size: 256},
+		{policy: PaddingPolicy{Mode: PADDING_BLOCK, Block: 256}, length: 255, size: 256},
+		{policy: PaddingPolicy{Mode: PADDING_BLOCK, Block: 256}, length: 256, size: 512},
+	}
+	for _, test := range tests {
+		if size := test.policy.size(test.length); size != test.size {
+			t.Errorf("%v padded %v bytes to %v, expected %v", test.policy, test.length, size, test.size)
+		}
+	}
+}
+
+func TestStrongerPadding(t *testing.T) {
+	none := PaddingPolicy{Mode: PADDING_NONE}
+	pow2 := PaddingPolicy{Mode: PADDING_POW2}
+	small := PaddingPolicy{Mode: PADDING_BLOCK, Block: 64}
+	large := PaddingPolicy{Mode: PADDING_BLOCK, Block: 512}
+	tests := [][3]PaddingPolicy{
+		{none, pow2, pow2},
+		{pow2, small, small},
+		{large, small, large},
+		{none, none, none},
+	}
+	for _, test := range tests {
+		for _, order := range [][2]PaddingPolicy{{test[0], test[1]}, {test[1], test[0]}} {
+			if chosen := strongerPadding(order[0], order[1]); chosen != test[2] {
+				t.Errorf("chose %v between %v and %v", chosen, order[0], order[1])
+			}
+		}
+	}
+}
+
+func TestParsePadding(t *testing.T) {
+	policy, err := ParsePadding(PADDING_BLOCK, 0)
+	if err != nil || policy.Block != DEFAULT_PADDING_BLOCK {
+		t.Fatalf("parsed %v, %v", policy, err)
+	}
+	for _, invalid := range []PaddingPolicy{{Mode: "random"}, {Mode: PADDING_BLOCK, Block: MIN_PADDING_BLOCK - 1}, {Mode: PADDING_BLOCK, Block: MAX_PADDING_BLOCK + 1}, {Mode: PADDING_BLOCK, Block: 100}} {
+		if _, err := ParsePadding(invalid.Mode, invalid.Block); err == nil {
+			t.Errorf("accepted %+v", invalid)
+		}
+	}
+}
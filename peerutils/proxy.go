@@ -0,0 +1,168 @@
+package peerutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const (
+	SOCKS_VERSION     byte = 0x5
+	SOCKS_PORT             = "1080"
+	SOCKS_NO_AUTH     byte = 0x0
+	SOCKS_USER_PASS   byte = 0x2
+	SOCKS_CONNECT     byte = 0x1
+	SOCKS_ATYP_IPV4   byte = 0x1
+	SOCKS_ATYP_DOMAIN byte = 0x3
+	SOCKS_ATYP_IPV6   byte = 0x4
+)
+
+// the SOCKS5 proxy all outbound connections are routed through, nil when dialing directly
+var proxy *url.URL
+
+// routes all outbound connections, including hostname resolution, through a SOCKS5 proxy given as socks5://[user:password@]host[:port]
+// an empty url disables the proxy
+func SetProxy(proxyUrl string) error {
+	if proxyUrl == "" {
+		proxy = nil
+		return nil
+	}
+	parsed, err := ParseProxy(proxyUrl)
+	if err != nil {
+		return err
+	}
+	proxy = parsed
+	return nil
+}
+
+// parses and validates a SOCKS5 proxy url
+func ParseProxy(proxyUrl string) (*url.URL, error) {
+	parsed, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	if (parsed.Scheme != "socks5" && parsed.Scheme != "socks5h") || parsed.Hostname() == "" {
+		return nil, errors.New("proxy: only socks5://host:port proxies are supported")
+	}
+	parsed.Host = withPort(parsed.Host, SOCKS_PORT)
+	return parsed, nil
+}
+
+// opens a TCP connection to addr, through the proxy if one is set
+func dial(addr string) (net.Conn, error) {
+	if proxy == nil {
+		return net.Dial("tcp", addr)
+	}
+	conn, err := net.Dial("tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	err = socksConnect(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// negotiates a SOCKS5 CONNECT to addr over a connection to the proxy
+// hostnames are sent to the proxy unresolved, so that no DNS lookups are made locally
+func socksConnect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	// greet the proxy, offering username/password authentication only if credentials were provided
+	method := SOCKS_NO_AUTH
+	if proxy.User != nil {
+		method = SOCKS_USER_PASS
+	}
+	_, err = conn.Write([]byte{SOCKS_VERSION, 1, method})
+	if err != nil {
+		return err
+	}
+	response := make([]byte, 2)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return err
+	}
+	if response[0] != SOCKS_VERSION || response[1] != method {
+		return errors.New("proxy: the proxy refused the authentication method")
+	}
+	if method == SOCKS_USER_PASS {
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("proxy: invalid proxy credentials")
+		}
+		auth := append([]byte{0x1, byte(len(username))}, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, response)
+		if err != nil {
+			return err
+		}
+		if response[1] != 0x0 {
+			return errors.New("proxy: the proxy rejected the credentials")
+		}
+	}
+	// request the connection
+	request := []byte{SOCKS_VERSION, SOCKS_CONNECT, 0x0}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, SOCKS_ATYP_IPV4)
+		request = append(request, ip4...)
+	} else if ip != nil {
+		request = append(request, SOCKS_ATYP_IPV6)
+		request = append(request, ip...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("proxy: hostname is too long")
+		}
+		request = append(request, SOCKS_ATYP_DOMAIN, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+	// read the reply, discarding the bound address
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != SOCKS_VERSION || reply[1] != 0x0 {
+		return errors.New("proxy: the proxy failed to connect to " + addr)
+	}
+	var boundSize int
+	switch reply[3] {
+	case SOCKS_ATYP_IPV4:
+		boundSize = net.IPv4len
+	case SOCKS_ATYP_IPV6:
+		boundSize = net.IPv6len
+	case SOCKS_ATYP_DOMAIN:
+		size := make([]byte, 1)
+		_, err = io.ReadFull(conn, size)
+		if err != nil {
+			return err
+		}
+		boundSize = int(size[0])
+	default:
+		return errors.New("proxy: invalid reply from the proxy")
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundSize+2))
+	return err
+}
@@ -0,0 +1,134 @@
+package peerutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a SOCKS5 proxy without authentication, recording every address it's asked to connect to
+type testProxy struct {
+	listener net.Listener
+	targets  []string
+	mut      sync.Mutex
+}
+
+func newTestProxy(t *testing.T) *testProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+// serves a single CONNECT request, then forwards traffic in both directions
+func (p *testProxy) handle(conn net.Conn) {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{SOCKS_VERSION, SOCKS_NO_AUTH})
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[3] != SOCKS_ATYP_IPV4 {
+		conn.Close()
+		return
+	}
+	addr := make([]byte, net.IPv4len+2)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		conn.Close()
+		return
+	}
+	target := net.JoinHostPort(net.IP(addr[:net.IPv4len]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(addr[net.IPv4len:]))))
+	p.mut.Lock()
+	p.targets = append(p.targets, target)
+	p.mut.Unlock()
+	remote, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{SOCKS_VERSION, 0x5, 0x0, SOCKS_ATYP_IPV4, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{SOCKS_VERSION, 0x0, 0x0, SOCKS_ATYP_IPV4, 0, 0, 0, 0, 0, 0})
+	go forward(remote, conn)
+	go forward(conn, remote)
+}
+
+// returns a base port whose two tunnel ports above it are also free
+func freeBasePort(t *testing.T) int {
+	t.Helper()
+	for port := 41000 + int(time.Now().UnixNano()%1000)*3; port < 65000; port += 3 {
+		free := true
+		for offset := 0; offset < 3 && free; offset++ {
+			listener, err := net.Listen("tcp", ":"+strconv.Itoa(port+offset))
+			if err != nil {
+				free = false
+				continue
+			}
+			listener.Close()
+		}
+		if free {
+			return port
+		}
+	}
+	t.Fatal("no free ports")
+	return 0
+}
+
+func TestConnectThroughProxy(t *testing.T) {
+	keyA, keyB := testKeys(t)
+	p := newTestProxy(t)
+	err := SetProxy("socks5://" + p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetProxy("")
+	port := freeBasePort(t)
+	type awaited struct {
+		tunnel *Tunnel
+		err    error
+	}
+	accepted := make(chan awaited, 1)
+	go func() {
+		tunnel, err := AwaitPeer(port, keyB.PublicKey, *keyB, testUser(t, keyB, "b"))
+		accepted <- awaited{tunnel, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	a, err := ConnectPeer(fmt.Sprintf("127.0.0.1:%v", port), "", keyA.PublicKey, *keyA, testUser(t, keyA, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b.err != nil {
+		t.Fatal(b.err)
+	}
+	defer a.Shutdown()
+	defer b.tunnel.Shutdown()
+	messages := [][]byte{append([]byte{MESSAGE_TXT}, "through the proxy"...)}
+	exchange(t, a, b.tunnel, messages)
+	exchange(t, b.tunnel, a, messages)
+	// both of the tunnel's connections were opened by the initiator, through the proxy
+	expected := []string{fmt.Sprintf("127.0.0.1:%v", port), fmt.Sprintf("127.0.0.1:%v", port+2)}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if fmt.Sprint(p.targets) != fmt.Sprint(expected) {
+		t.Fatalf("the proxy connected to %v, expected %v", p.targets, expected)
+	}
+}
@@ -0,0 +1,63 @@
+package peerutils
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_REKEY_MESSAGES = 1000
+	DEFAULT_REKEY_BYTES    = 16 * 1024 * 1024
+	DEFAULT_REKEY_INTERVAL = time.Hour
+)
+
+// when each direction of a tunnel has its key replaced, whichever limit is reached first triggers a new key
+// zero fields use the defaults
+type RekeyPolicy struct {
+	Messages int           // the most messages sent with one key
+	Bytes    int64         // the most bytes sent with one key
+	Interval time.Duration // the longest a key is used for, checked whenever a message is sent
+}
+
+// the key one direction of a tunnel is encrypted with, and how much it has been used
+type tunnelKey struct {
+	key      []byte
+	messages int
+	bytes    int64
+	created  time.Time
+	mut      sync.Mutex // held while sending, so that the key doesn't change part way through a message
+}
+
+// creates an unused key for one direction of a tunnel
+func newTunnelKey(key []byte) *tunnelKey {
+	return &tunnelKey{key: key, created: time.Now()}
+}
+
+// replaces the key, resetting its usage
+func (k *tunnelKey) reset(key []byte) {
+	k.key = key
+	k.messages = 0
+	k.bytes = 0
+	k.created = time.Now()
+}
+
+// records that a message was sent with the key
+func (k *tunnelKey) used(size int) {
+	k.messages++
+	k.bytes += int64(size)
+}
+
+// returns true once a key has been used enough that it should be replaced
+func (p RekeyPolicy) due(k *tunnelKey) bool {
+	messages, bytes, interval := p.Messages, p.Bytes, p.Interval
+	if messages == 0 {
+		messages = DEFAULT_REKEY_MESSAGES
+	}
+	if bytes == 0 {
+		bytes = DEFAULT_REKEY_BYTES
+	}
+	if interval == 0 {
+		interval = DEFAULT_REKEY_INTERVAL
+	}
+	return k.messages >= messages || k.bytes >= bytes || time.Since(k.created) >= interval
+}
@@ -0,0 +1,70 @@
+package peerutils
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// sends each message from one tunnel to the other, failing the test unless every one arrives intact
+func exchange(t *testing.T, from *Tunnel, to *Tunnel, messages [][]byte) {
+	t.Helper()
+	sent := make(chan error, 1)
+	go func() {
+		for _, message := range messages {
+			err := from.SendMessage(message)
+			if err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+	for i, message := range messages {
+		received, err := to.AwaitMessage()
+		if err != nil {
+			t.Fatalf("message %v failed: %v", i, err)
+		}
+		if !bytes.Equal(received, message) {
+			t.Fatalf("message %v arrived as %q", i, received)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRekeyMidConversation(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []string
+		policy   RekeyPolicy
+		rekeyed  bool
+	}{
+		{name: "every message", features: []string{FEATURE_REKEY, FEATURE_PADDING}, policy: RekeyPolicy{Messages: 1}, rekeyed: true},
+		{name: "every third message", features: []string{FEATURE_REKEY, FEATURE_PADDING}, policy: RekeyPolicy{Messages: 3}, rekeyed: true},
+		{name: "every 64 bytes", features: []string{FEATURE_REKEY, FEATURE_PADDING}, policy: RekeyPolicy{Bytes: 64}, rekeyed: true},
+		{name: "without padding", features: []string{FEATURE_REKEY}, policy: RekeyPolicy{Messages: 2}, rekeyed: true},
+		{name: "unsupported by the peer", features: []string{FEATURE_PADDING}, policy: RekeyPolicy{Messages: 1}, rekeyed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := testTunnels(t, handshakeResult{features: test.features, padding: PaddingPolicy{Mode: PADDING_BLOCK, Block: DEFAULT_PADDING_BLOCK}})
+			a.Rekey, b.Rekey = test.policy, test.policy
+			sessionKey := a.send.key
+			var messages [][]byte
+			for i := 0; i < 8; i++ {
+				messages = append(messages, append([]byte{MESSAGE_TXT}, fmt.Sprintf("message %v of the conversation", i)...))
+			}
+			// each direction is rekeyed independently, so both must keep decrypting
+			exchange(t, a, b, messages)
+			exchange(t, b, a, messages)
+			if rekeyed := !bytes.Equal(a.send.key, sessionKey); rekeyed != test.rekeyed {
+				t.Fatalf("rekeyed is %v, expected %v", rekeyed, test.rekeyed)
+			}
+			if !bytes.Equal(a.send.key, b.recv.key) || !bytes.Equal(b.send.key, a.recv.key) {
+				t.Fatal("the peers disagree on the current keys")
+			}
+		})
+	}
+}
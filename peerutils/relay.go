@@ -0,0 +1,220 @@
+package peerutils
+
+import (
+	"crypto/rsa"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RELAY_PORT         = "54100"
+	MAX_TOKEN_SIZE     = 255
+	RELAY_PAIR_TIMEOUT = 5 * time.Minute
+)
+
+// relay channels, each peer dials the relay once per channel, and connections are paired by token and channel
+const (
+	RELAY_HANDSHAKE byte = 0x0
+	RELAY_FORWARD   byte = 0x1 // carries messages from the initiator to the reciever
+	RELAY_BACKWARD  byte = 0x2 // carries messages from the reciever to the initiator
+)
+
+// a server that pairs peers who can't reach each other directly, and blindly forwards their (end-to-end encrypted) traffic
+// relays also act as mailboxes, holding messages for peers who aren't online
+type Relay struct {
+	waiting map[string]net.Conn
+	paired  map[string]bool // the channels being forwarded, which nobody else may join until the pair hangs up
+	mailbox *Mailbox
+	mut     sync.Mutex
+}
+
+// creates a new relay with no waiting peers
+func NewRelay() *Relay {
+	return &Relay{waiting: make(map[string]net.Conn), paired: make(map[string]bool), mailbox: NewMailbox()}
+}
+
+// accepts connections on the listener until it is closed
+func (r *Relay) Serve(listener net.Listener) error {
+	// envelopes are also pruned whenever their recipient's box is used, but some recipients never return
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.mailbox.pruneEvery(MAILBOX_PRUNE_INTERVAL, stop)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+// reads a peer's rendezvous request, and either pairs it with a waiting peer or waits for one
+func (r *Relay) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(RECONNECT_TIMEOUT))
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil || header[0] > MAILBOX_COLLECT || header[1] == 0 {
+		conn.Close()
+		return
+	}
+	token := make([]byte, header[1])
+	_, err = io.ReadFull(conn, token)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	switch header[0] {
+	case MAILBOX_DEPOSIT:
+		r.mailbox.deposit(conn, string(token))
+		conn.Close()
+		return
+	case MAILBOX_COLLECT:
+		r.mailbox.collect(conn, string(token))
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	key := string(header[0]) + string(token)
+	r.mut.Lock()
+	// a third peer holding the token of a pair that's already talking is turned away
+	if r.paired[key] {
+		r.mut.Unlock()
+		conn.Write([]byte{RES_ERR})
+		conn.Close()
+		return
+	}
+	peer, ok := r.waiting[key]
+	if !ok {
+		// wait for the other peer to arrive, giving up eventually so abandoned tokens don't pile up
+		r.waiting[key] = conn
+		r.mut.Unlock()
+		time.AfterFunc(RELAY_PAIR_TIMEOUT, func() {
+			r.mut.Lock()
+			if r.waiting[key] == conn {
+				delete(r.waiting, key)
+				conn.Close()
+			}
+			r.mut.Unlock()
+		})
+		return
+	}
+	delete(r.waiting, key)
+	r.paired[key] = true
+	r.mut.Unlock()
+	// inform both peers that they've been paired, and begin forwarding
+	_, err = peer.Write([]byte{RES_OK})
+	if err == nil {
+		_, err = conn.Write([]byte{RES_OK})
+	}
+	if err != nil {
+		peer.Close()
+		conn.Close()
+		r.unpair(key)
+		return
+	}
+	go forward(peer, conn)
+	go func() {
+		forward(conn, peer)
+		// both connections are closed by now, so the peers can pair again when they reconnect
+		r.unpair(key)
+	}()
+}
+
+// frees a channel once its pair has hung up
+func (r *Relay) unpair(key string) {
+	r.mut.Lock()
+	delete(r.paired, key)
+	r.mut.Unlock()
+}
+
+// copies everything from src to dst, closing both once either side hangs up
+func forward(dst net.Conn, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+}
+
+// connects to a relay on the given channel, and waits to be paired with the peer holding the same token
+func dialRelay(relayAddr string, token string, channel byte) (net.Conn, error) {
+	if len(token) == 0 || len(token) > MAX_TOKEN_SIZE {
+		return nil, errors.New("relay: tokens must be between 1 and 255 bytes long")
+	}
+	conn, err := dial(withPort(relayAddr, RELAY_PORT))
+	if err != nil {
+		return nil, err
+	}
+	request := append([]byte{channel, byte(len(token))}, []byte(token)...)
+	_, err = conn.Write(request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response := make([]byte, 1)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response[0] != RES_OK {
+		conn.Close()
+		return nil, errors.New("relay: the relay refused the connection, another pair may be using the token")
+	}
+	return conn, nil
+}
+
+// connects to a peer through a relay, returning a tunnel once the peer awaiting the same token is reached
+// if pinned is not empty, the connection is refused unless the peer's key has that fingerprint, or replaced the key that did
+func ConnectRelay(relayAddr string, token string, pinned string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, initiator User) (*Tunnel, error) {
+	conn, err := dialRelay(relayAddr, token, RELAY_HANDSHAKE)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	result, err := initiateHandshake(conn, pinned, pubKey, prvKey, initiator)
+	if err != nil {
+		return nil, err
+	}
+	outgoing, err := dialRelay(relayAddr, token, RELAY_FORWARD)
+	if err != nil {
+		return nil, err
+	}
+	incoming, err := dialRelay(relayAddr, token, RELAY_BACKWARD)
+	if err != nil {
+		outgoing.Close()
+		return nil, err
+	}
+	redial := func() (*Tunnel, error) {
+		return ConnectRelay(relayAddr, token, pinned, pubKey, prvKey, initiator)
+	}
+	return result.tunnel(prvKey, initiator, incoming, outgoing, redial), nil
+}
+
+// awaits a peer through a relay, returning a tunnel once a peer connects with the same token
+// if pinned is not empty, the peer is refused unless their key has that fingerprint, or replaced the key that did
+func AwaitRelay(relayAddr string, token string, pinned string, pubKey rsa.PublicKey, prvKey rsa.PrivateKey, reciever User) (*Tunnel, error) {
+	conn, err := dialRelay(relayAddr, token, RELAY_HANDSHAKE)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	result, err := acceptHandshake(conn, pinned, pubKey, prvKey, reciever)
+	if err != nil {
+		return nil, err
+	}
+	incoming, err := dialRelay(relayAddr, token, RELAY_FORWARD)
+	if err != nil {
+		return nil, err
+	}
+	outgoing, err := dialRelay(relayAddr, token, RELAY_BACKWARD)
+	if err != nil {
+		incoming.Close()
+		return nil, err
+	}
+	redial := func() (*Tunnel, error) {
+		return AwaitRelay(relayAddr, token, pinned, pubKey, prvKey, reciever)
+	}
+	return result.tunnel(prvKey, reciever, incoming, outgoing, redial), nil
+}
@@ -0,0 +1,165 @@
+package peerutils
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// starts a relay on a free local port, returning its address
+func testRelay(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go NewRelay().Serve(listener)
+	return listener.Addr().String()
+}
+
+// the outcome of awaiting a peer through a relay
+type relayOutcome struct {
+	tunnel *Tunnel
+	err    error
+}
+
+// closes both of a tunnel's connections without waiting on the peer
+func closeTunnel(tunnel *Tunnel) {
+	tunnel.Incoming.Close()
+	tunnel.Outgoing.Close()
+}
+
+func TestRelayPairsByToken(t *testing.T) {
+	keyA, keyB := testKeys(t)
+	userA, userB := testUser(t, keyA, "a"), testUser(t, keyB, "b")
+	addr := testRelay(t)
+	awaited := make(chan relayOutcome)
+	go func() {
+		tunnel, err := AwaitRelay(addr, "token", "", keyB.PublicKey, *keyB, userB)
+		awaited <- relayOutcome{tunnel, err}
+	}()
+	initiator, err := ConnectRelay(addr, "token", "", keyA.PublicKey, *keyA, userA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTunnel(initiator)
+	reciever := <-awaited
+	if reciever.err != nil {
+		t.Fatal(reciever.err)
+	}
+	defer closeTunnel(reciever.tunnel)
+	if reciever.tunnel.Peer.Id != userA.Id || initiator.Peer.Id != userB.Id {
+		t.Fatal("the peers were paired with the wrong identities")
+	}
+	// messages are forwarded in both directions
+	for _, pair := range [][2]*Tunnel{{initiator, reciever.tunnel}, {reciever.tunnel, initiator}} {
+		recieved := make(chan []byte)
+		go func() {
+			message, _ := pair[1].AwaitMessage()
+			recieved <- message
+		}()
+		err = pair[0].SendMessage([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message := <-recieved; !bytes.Equal(message, []byte("hello")) {
+			t.Fatalf("recieved %q", message)
+		}
+	}
+}
+
+func TestRelayKeepsMismatchedTokensApart(t *testing.T) {
+	addr := testRelay(t)
+	paired := make(chan error, 2)
+	for _, token := range []string{"one", "two"} {
+		go func() {
+			conn, err := dialRelay(addr, token, RELAY_HANDSHAKE)
+			if err == nil {
+				conn.Close()
+			}
+			paired <- err
+		}()
+	}
+	select {
+	case err := <-paired:
+		t.Fatalf("a peer was paired with a different token: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestRelayChecksPinnedKey(t *testing.T) {
+	keyA, keyB := testKeys(t)
+	userA, userB := testUser(t, keyA, "a"), testUser(t, keyB, "b")
+	wrong := cryptoutils.Fingerprint(&keyA.PublicKey)
+	for _, awaiterPin := range []bool{true, false} {
+		addr := testRelay(t)
+		awaitPin, connectPin := "", ""
+		if awaiterPin {
+			// the awaiting peer expects its own key, which the connecting peer doesn't have
+			awaitPin = cryptoutils.Fingerprint(&keyB.PublicKey)
+		} else {
+			connectPin = wrong
+		}
+		awaited := make(chan relayOutcome, 1)
+		go func() {
+			tunnel, err := AwaitRelay(addr, "token", awaitPin, keyB.PublicKey, *keyB, userB)
+			awaited <- relayOutcome{tunnel, err}
+		}()
+		initiator, err := ConnectRelay(addr, "token", connectPin, keyA.PublicKey, *keyA, userA)
+		if err == nil {
+			closeTunnel(initiator)
+			t.Fatal("connected to a peer with the wrong key")
+		}
+		reciever := <-awaited
+		if reciever.err == nil {
+			closeTunnel(reciever.tunnel)
+			t.Fatal("accepted a peer with the wrong key")
+		}
+		if awaiterPin && (!errors.Is(reciever.err, ErrPinMismatch) || !errors.Is(err, ErrHandshakeRejected)) {
+			t.Fatalf("the peers failed with %v and %v", err, reciever.err)
+		}
+		if !awaiterPin && !errors.Is(err, ErrPinMismatch) {
+			t.Fatalf("the connecting peer failed with %v", err)
+		}
+	}
+}
+
+func TestRelayRejectsThirdClient(t *testing.T) {
+	addr := testRelay(t)
+	paired := make(chan net.Conn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := dialRelay(addr, "token", RELAY_HANDSHAKE)
+			if err != nil {
+				t.Error(err)
+			}
+			paired <- conn
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if conn := <-paired; conn != nil {
+			defer conn.Close()
+		}
+	}
+	refused := make(chan error, 1)
+	go func() {
+		conn, err := dialRelay(addr, "token", RELAY_HANDSHAKE)
+		if err == nil {
+			conn.Close()
+		}
+		refused <- err
+	}()
+	select {
+	case err := <-refused:
+		if err == nil {
+			t.Fatal("a third client joined a paired token")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a third client was left waiting on a paired token")
+	}
+}
@@ -0,0 +1,284 @@
+package peerutils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+const EVENT_BUFFER_SIZE = 64
+
+// the kinds of changes a chat reports
+const (
+	EVENT_MESSAGE   = iota // a message from either user was added to the history
+	EVENT_NOTICE           // the chatroom itself added a message, such as an alert or an error
+	EVENT_DELETE           // a message was removed from the history
+	EVENT_CLEAR            // the whole history was cleared
+	EVENT_EPHEMERAL        // the disappearing message timer changed
+	EVENT_CLOSED           // the chat ended, this is always the last event
+	EVENT_PREVIOUS         // a message from an earlier chat with the peer, only returned by History
+	EVENT_STATUS           // the peer became unresponsive, or started responding again
+)
+
+// a change to a chat
+type Event struct {
+	Type         int
+	Id           uint32        // the id of the message the event concerns, if any
+	Sender       User          // the sender of a new message
+	Text         string        // the contents of a new message
+	Time         time.Time     // when the event happened
+	Ttl          time.Duration // the new disappearing message timer
+	Err          error         // the reason the chat ended, nil if it was closed normally
+	Unresponsive bool          // whether the peer has missed several heartbeats in a row
+	Rtt          time.Duration // the most recent round trip time to the peer
+}
+
+// a chat with a peer over an established tunnel, which receives messages in the background and reports every change
+// to the chat as an Event, without any output of its own
+type Session struct {
+	room     *Chatroom
+	events   chan Event
+	closing  chan struct{} // closed once the session starts shutting down, unblocking any pending events
+	stopOnce sync.Once
+	mut      sync.RWMutex
+	finished bool
+}
+
+// optional behaviour for a session, the zero value runs no hooks, saves no history, and rekeys by the default policy
+type SessionOptions struct {
+	Hooks   Hooks         // user commands run on the chat's events
+	History *HistoryStore // saves the chat's messages, and supplies the messages of earlier chats with the peer
+	Rekey   RekeyPolicy   // when the tunnel's keys are replaced, overriding the tunnel's own policy unless it's the zero value
+}
+
+// starts a chat session over a tunnel, which the session takes over, the session is closed when ctx is cancelled
+func NewSession(ctx context.Context, tunnel *Tunnel, opts SessionOptions) *Session {
+	s := &Session{
+		room:    NewChatroom(tunnel),
+		events:  make(chan Event, EVENT_BUFFER_SIZE),
+		closing: make(chan struct{}),
+	}
+	s.room.Hooks = opts.Hooks
+	s.room.History = opts.History
+	if opts.History != nil {
+		s.room.Previous = opts.History.messages()
+	}
+	if opts.Rekey != (RekeyPolicy{}) {
+		tunnel.Rekey = opts.Rekey
+	}
+	s.room.OnEvent = s.emit
+	s.room.fireHooks(newHookEvent(HOOK_PEER_CONNECTED, tunnel))
+	go s.receive()
+	if tunnel.Supports(FEATURE_HEARTBEAT) {
+		go s.heartbeat()
+	}
+	if tunnel.cover != nil {
+		go s.room.runCover(s.closing)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.closing:
+		}
+	}()
+	return s
+}
+
+// returns the channel events are delivered on, it's closed after the EVENT_CLOSED event
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+// returns the underlying chatroom, for access to its history and commands
+func (s *Session) Chatroom() *Chatroom {
+	return s.room
+}
+
+// returns the peer the session is with
+func (s *Session) Peer() User {
+	return s.room.Tunnel().Peer
+}
+
+// returns the fingerprint of the peer's public key
+func (s *Session) PeerFingerprint() string {
+	return cryptoutils.Fingerprint(&s.room.Tunnel().PeerPubKey)
+}
+
+// returns the most recent messages in the chat's history (at most MAX_MSG_COUNT), as EVENT_MESSAGE and EVENT_NOTICE events
+// these are preceded by the messages of earlier chats with the peer, as EVENT_PREVIOUS events
+func (s *Session) History() []Event {
+	s.room.Mut.Lock()
+	defer s.room.Mut.Unlock()
+	var history []Event
+	for _, message := range s.room.Previous {
+		history = append(history, Event{Type: EVENT_PREVIOUS, Sender: *message.sender, Text: message.content, Time: message.sent})
+	}
+	// messages older than oldest have been spilled to disk, and are left to Search
+	for i := s.room.oldest; i < s.room.MaxId; i++ {
+		message, ok := s.room.Messages[i]
+		if !ok {
+			continue
+		}
+		eventType := EVENT_MESSAGE
+		if message.sender.Id == "" {
+			eventType = EVENT_NOTICE
+		}
+		history = append(history, Event{Type: eventType, Id: i, Sender: *message.sender, Text: message.content, Time: message.sent})
+	}
+	return history
+}
+
+// returns every message in the chat containing query, ignoring case, as EVENT_MESSAGE events
+// unlike History, this includes the older messages that have been moved out of memory
+func (s *Session) Search(query string) ([]Event, error) {
+	messages, err := s.room.Search(query)
+	if err != nil {
+		return nil, err
+	}
+	var found []Event
+	for _, message := range messages {
+		found = append(found, Event{Type: EVENT_MESSAGE, Sender: *message.sender, Text: message.content, Time: message.sent})
+	}
+	return found, nil
+}
+
+// returns the most recent round trip time to the peer, zero if it hasn't been measured
+func (s *Session) RTT() time.Duration {
+	return s.room.Tunnel().RTT()
+}
+
+// returns true while the peer has missed several heartbeats in a row
+func (s *Session) Unresponsive() bool {
+	return s.room.Unresponsive()
+}
+
+// returns true until the chat ends
+func (s *Session) Active() bool {
+	return s.room.Active.Load()
+}
+
+// sends a message to the peer, and returns its id
+func (s *Session) Send(text string) (uint32, error) {
+	if !s.room.Active.Load() {
+		return 0, ErrClosed
+	}
+	return s.room.sendText(text)
+}
+
+// deletes one of the user's own messages on both ends of the chat
+func (s *Session) Delete(id uint32) error {
+	message, ok := s.room.message(id)
+	if !ok || message.sender.Id != s.room.Tunnel().User.Id {
+		return errors.New("session: invalid message id")
+	}
+	return s.room.DeleteMessage(id)
+}
+
+// sets the disappearing message timer on both ends of the chat, a ttl of zero disables it
+func (s *Session) SetEphemeral(ttl time.Duration) error {
+	if ttl < 0 || (ttl != 0 && ttl < time.Second) {
+		return errors.New("session: the timer must be at least one second")
+	}
+	if ttl/time.Second > MAX_EPHEMERAL_SECONDS {
+		return errors.New("session: the timer can't be longer than 0xffffffff seconds")
+	}
+	return s.room.SetEphemeral(ttl)
+}
+
+// saves an encrypted archive of the chat to the directory at path
+func (s *Session) Archive(password []byte, path string, rounds int) error {
+	return s.room.Archive(password, path, rounds)
+}
+
+// ends the session, letting the peer know the chat is over if they haven't left already
+// the tunnel's connections are always closed, and closing a session more than once does nothing
+func (s *Session) Close() error {
+	err := s.room.Close()
+	s.stop()
+	return err
+}
+
+// receives messages until the chat ends
+func (s *Session) receive() {
+	var err error
+	for s.room.Active.Load() || s.room.closed.Load() {
+		err = s.room.AwaitMessage()
+		if err != nil {
+			break
+		}
+	}
+	// errors caused by closing the chat locally aren't reported
+	if s.room.closed.Load() {
+		err = nil
+	}
+	s.room.Active.Store(false)
+	hookEvent := newHookEvent(HOOK_PEER_DISCONNECTED, s.room.Tunnel())
+	if err != nil {
+		hookEvent.Error = err.Error()
+	}
+	// this is all done before the chat is reported as closed, since programs may exit as soon as it is
+	s.room.discardSpill()
+	s.room.Hooks.Run(hookEvent)
+	s.emit(Event{Type: EVENT_CLOSED, Time: time.Now(), Err: err})
+	s.stop()
+	s.mut.Lock()
+	s.finished = true
+	close(s.events)
+	s.mut.Unlock()
+}
+
+// sends the peer a heartbeat every interval until the chat ends, checking whether they're still responding
+// a heartbeat waiting on its acknowledgement isn't followed by another, and one that fails is left to the receiving
+// goroutine, which notices the same failure
+func (s *Session) heartbeat() {
+	ticker := time.NewTicker(s.room.Tunnel().Heartbeat.Interval)
+	defer ticker.Stop()
+	var sending atomic.Bool
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		if !s.room.Active.Load() {
+			return
+		}
+		s.room.checkPeer()
+		if sending.CompareAndSwap(false, true) {
+			go func() {
+				s.room.Tunnel().SendHeartbeat()
+				sending.Store(false)
+			}()
+		}
+	}
+}
+
+// marks the session as shutting down
+func (s *Session) stop() {
+	s.stopOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
+// delivers an event, waiting for it to be consumed unless the session is shutting down
+func (s *Session) emit(event Event) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	if s.finished {
+		return
+	}
+	select {
+	case s.events <- event:
+		return
+	default:
+	}
+	select {
+	case s.events <- event:
+	case <-s.closing:
+	}
+}
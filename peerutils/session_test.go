@@ -0,0 +1,131 @@
+package peerutils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// the handshake outcome sessions are tested with, using every feature
+var sessionTemplate = handshakeResult{features: supportedFeatures, heartbeat: DEFAULT_HEARTBEAT_INTERVAL}
+
+// starts a session on each end of a pair of in-memory tunnels created from template
+func testSessions(t *testing.T, ctx context.Context, template handshakeResult) (*Session, *Session) {
+	t.Helper()
+	a, b := testTunnels(t, template)
+	return NewSession(ctx, a, SessionOptions{}), NewSession(ctx, b, SessionOptions{})
+}
+
+// returns the next event of the given type, failing if the events end or none arrives in time
+func nextEvent(t *testing.T, s *Session, eventType int) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("the events ended before an event of type %v", eventType)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no event of type %v arrived", eventType)
+		}
+	}
+}
+
+// waits for the events of a session to end
+func awaitEventsClosed(t *testing.T, s *Session) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-s.Events():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the events never ended")
+		}
+	}
+}
+
+func TestSessionSend(t *testing.T) {
+	a, b := testSessions(t, context.Background(), sessionTemplate)
+	defer a.Close()
+	id, err := a.Send("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := nextEvent(t, a, EVENT_MESSAGE)
+	if sent.Id != id || sent.Text != "hello" || sent.Sender.Id != a.room.Tunnel().User.Id {
+		t.Fatalf("the sender saw %+v", sent)
+	}
+	recieved := nextEvent(t, b, EVENT_MESSAGE)
+	if recieved.Text != "hello" || recieved.Sender.Id != a.room.Tunnel().User.Id {
+		t.Fatalf("the reciever saw %+v", recieved)
+	}
+	if b.Peer().Id != a.room.Tunnel().User.Id || b.PeerFingerprint() == "" {
+		t.Fatal("the reciever doesn't know who the peer is")
+	}
+}
+
+func TestSessionEndsWhenPeerLeaves(t *testing.T) {
+	a, b := testSessions(t, context.Background(), sessionTemplate)
+	err := a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := nextEvent(t, b, EVENT_CLOSED)
+	if closed.Err != nil {
+		t.Fatalf("the peer leaving was reported as %v", closed.Err)
+	}
+	awaitEventsClosed(t, a)
+	awaitEventsClosed(t, b)
+	if _, err := b.Send("hello?"); err == nil {
+		t.Fatal("sent a message after the chat ended")
+	}
+}
+
+func TestSessionCloseAfterPeerLeaves(t *testing.T) {
+	a, b := testSessions(t, context.Background(), sessionTemplate)
+	err := a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, b, EVENT_CLOSED)
+	awaitEventsClosed(t, b)
+	// there's nobody left to notify, but the connections are still closed, however many times the session is closed
+	for i := 0; i < 2; i++ {
+		if err := b.Close(); err != nil {
+			t.Fatalf("closing the session after the peer left failed with %v", err)
+		}
+	}
+	tunnel := b.room.Tunnel()
+	for _, conn := range []net.Conn{tunnel.Incoming, tunnel.Outgoing} {
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("reading from the connection failed with %v rather than being closed", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("closing the session twice failed with %v", err)
+	}
+	awaitEventsClosed(t, a)
+}
+
+func TestSessionClosedByContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a, b := testSessions(t, ctx, sessionTemplate)
+	cancel()
+	for _, s := range []*Session{a, b} {
+		closed := nextEvent(t, s, EVENT_CLOSED)
+		if closed.Err != nil {
+			t.Fatalf("cancelling the session was reported as %v", closed.Err)
+		}
+		awaitEventsClosed(t, s)
+	}
+}
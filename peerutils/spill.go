@@ -0,0 +1,134 @@
+package peerutils
+
+import (
+	"os"
+	"slices"
+	"time"
+
+	"github.com/DrewRoss5/courier/cryptoutils"
+)
+
+// messages pushed out of a chat's memory, kept in an encrypted temporary file until the chat ends
+// the file's key only exists in memory, so the file can't be read once the chat is over
+type spillSegment struct {
+	file  *os.File
+	key   []byte
+	index []spillRecord // where each message is in the file, ordered by id
+	size  int64
+}
+
+// the location of a spilled message in the segment's file
+type spillRecord struct {
+	id     uint32
+	offset int64
+	size   int64
+}
+
+// a spilled message, as it's stored in the file
+type spilledMessage struct {
+	Id       uint32    `json:"id"`
+	Sender   string    `json:"sender"`
+	SenderId string    `json:"sender_id"`
+	Color    string    `json:"color"`
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+	Stored   *uint64   `json:"stored,omitempty"` // the id of the message's history entry, if it was saved
+}
+
+// creates an empty segment in a new temporary file
+func newSpillSegment() (*spillSegment, error) {
+	file, err := os.CreateTemp("", "courier-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	return &spillSegment{file: file, key: cryptoutils.GenAesKey()}, nil
+}
+
+// writes a message to the end of the segment
+// messages must be added in order of their ids
+func (s *spillSegment) add(id uint32, message Message, stored *uint64) error {
+	record, err := sealRecord(spilledMessage{Id: id, Sender: message.sender.Name, SenderId: message.sender.Id, Color: message.sender.Color, Text: message.content, Time: message.sent, Stored: stored}, s.key)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.WriteAt(record, s.size)
+	if err != nil {
+		return err
+	}
+	s.index = append(s.index, spillRecord{id: id, offset: s.size, size: int64(len(record))})
+	s.size += int64(len(record))
+	return nil
+}
+
+// reads the message at a location in the file
+func (s *spillSegment) read(record spillRecord) (spilledMessage, error) {
+	buf := make([]byte, record.size)
+	_, err := s.file.ReadAt(buf, record.offset)
+	if err != nil {
+		return spilledMessage{}, err
+	}
+	var message spilledMessage
+	err = openRecord(buf, s.key, &message)
+	return message, err
+}
+
+// returns the location of the message with the given id
+func (s *spillSegment) find(id uint32) (int, bool) {
+	return slices.BinarySearchFunc(s.index, id, func(record spillRecord, id uint32) int {
+		return int(int64(record.id) - int64(id))
+	})
+}
+
+// returns the message with the given id
+func (s *spillSegment) get(id uint32) (spilledMessage, bool) {
+	i, ok := s.find(id)
+	if !ok {
+		return spilledMessage{}, false
+	}
+	message, err := s.read(s.index[i])
+	return message, err == nil
+}
+
+// erases a message from the segment, returning it if it existed
+func (s *spillSegment) remove(id uint32) (spilledMessage, bool) {
+	i, ok := s.find(id)
+	if !ok {
+		return spilledMessage{}, false
+	}
+	record := s.index[i]
+	message, err := s.read(record)
+	s.index = slices.Delete(s.index, i, i+1)
+	// the message's ciphertext is overwritten, rather than just forgotten
+	s.file.WriteAt(make([]byte, record.size), record.offset)
+	return message, err == nil
+}
+
+// calls fn with every message in the segment, oldest first, until it returns false
+func (s *spillSegment) each(fn func(message spilledMessage) bool) error {
+	for _, record := range s.index {
+		message, err := s.read(record)
+		if err != nil {
+			return err
+		}
+		if !fn(message) {
+			break
+		}
+	}
+	return nil
+}
+
+// returns the number of messages in the segment
+func (s *spillSegment) count() int {
+	return len(s.index)
+}
+
+// closes and deletes the segment's file
+func (s *spillSegment) discard() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// converts a spilled message back to the form it's displayed in
+func (m spilledMessage) message() Message {
+	return Message{content: m.Text, sender: &User{Name: m.Sender, Id: m.SenderId, Color: m.Color}, timeSent: m.Time.Format("15:04:05"), sent: m.Time}
+}
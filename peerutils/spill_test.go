@@ -0,0 +1,146 @@
+package peerutils
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// points temporary files at a directory of the test's own, and returns it
+func testSpillDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	return dir
+}
+
+// fails the test unless dir holds exactly count files
+func expectFiles(t *testing.T, dir string, count int) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != count {
+		t.Fatalf("found %v files, expected %v", len(entries), count)
+	}
+}
+
+func TestSpillSegment(t *testing.T) {
+	dir := testSpillDir(t)
+	segment, err := newSpillSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := User{Name: "a", Id: "a-id", Color: Cyan}
+	entry := uint64(7)
+	for id := uint32(0); id < 3; id++ {
+		var stored *uint64
+		if id == 1 {
+			stored = &entry
+		}
+		err = segment.add(id, *NewMessage(fmt.Sprint("message ", id), &sender), stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	message, ok := segment.get(1)
+	if !ok || message.Text != "message 1" || message.Sender != sender.Name || message.SenderId != sender.Id || message.Stored == nil || *message.Stored != entry {
+		t.Fatalf("got %+v, %v", message, ok)
+	}
+	if converted := message.message(); converted.content != "message 1" || *converted.sender != sender {
+		t.Fatalf("converted the message to %+v", converted)
+	}
+	removed, ok := segment.remove(1)
+	if !ok || removed.Text != "message 1" {
+		t.Fatalf("removed %+v, %v", removed, ok)
+	}
+	if _, ok := segment.get(1); ok {
+		t.Fatal("got a removed message")
+	}
+	if _, ok := segment.remove(1); ok {
+		t.Fatal("removed a message twice")
+	}
+	var texts []string
+	err = segment.each(func(message spilledMessage) bool {
+		texts = append(texts, message.Text)
+		return true
+	})
+	if err != nil || !slices.Equal(texts, []string{"message 0", "message 2"}) || segment.count() != 2 {
+		t.Fatalf("the segment holds %v, %v", texts, err)
+	}
+	expectFiles(t, dir, 1)
+	segment.discard()
+	expectFiles(t, dir, 0)
+}
+
+func TestChatroomSpillsOldMessages(t *testing.T) {
+	dir := testSpillDir(t)
+	c := Chatroom{Messages: make(map[uint32]Message)}
+	c.Active.Store(true)
+	sender := User{Name: "a", Id: "a-id", Color: Cyan}
+	total := MAX_MSG_COUNT + 10
+	for i := 0; i < total; i++ {
+		text := fmt.Sprint("message ", i)
+		c.pushMessage(&text, &sender)
+	}
+	if len(c.Messages) != MAX_MSG_COUNT || c.spill.count() != total-MAX_MSG_COUNT {
+		t.Fatalf("%v messages were kept in memory and %v spilled", len(c.Messages), c.spill.count())
+	}
+	// spilled and in memory messages are both found by their id
+	for _, id := range []uint32{0, 9, 10, uint32(total - 1)} {
+		message, ok := c.message(id)
+		if !ok || message.content != fmt.Sprint("message ", id) {
+			t.Fatalf("got message %v as %+v, %v", id, message, ok)
+		}
+	}
+	if !c.remove(3) {
+		t.Fatal("failed to remove a spilled message")
+	}
+	if _, ok := c.message(3); ok {
+		t.Fatal("got a removed message")
+	}
+	c.discardSpill()
+	expectFiles(t, dir, 0)
+	if _, ok := c.message(0); ok {
+		t.Fatal("got a spilled message after the spill was discarded")
+	}
+}
+
+func TestChatroomMessageLimit(t *testing.T) {
+	dir := testSpillDir(t)
+	c := Chatroom{Messages: make(map[uint32]Message)}
+	c.Active.Store(true)
+	sender := User{Name: "a", Id: "a-id", Color: Cyan}
+	// start just short of the limit, with enough messages that some have been spilled
+	c.MaxId = 0xffffffff - MAX_MSG_COUNT - 10
+	c.oldest = c.MaxId
+	pushed := make(chan struct{})
+	go func() {
+		for i := 0; i < MAX_MSG_COUNT+10; i++ {
+			text := fmt.Sprint("message ", i)
+			c.pushMessage(&text, &sender)
+		}
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaching the message limit deadlocked")
+	}
+	// the history is cleared, leaving only the notice, and the ids start over
+	if len(c.Messages) != 1 || c.MaxId != 1 || c.spill != nil {
+		t.Fatalf("%v messages were kept, the next id is %v", len(c.Messages), c.MaxId)
+	}
+	if notice, ok := c.message(0); !ok || notice.sender.Id != "" || !strings.Contains(notice.content, "Message limit reached") {
+		t.Fatalf("the notice was %+v, %v", notice, ok)
+	}
+	expectFiles(t, dir, 0)
+	text := "after"
+	if id := c.pushMessage(&text, &sender); id != 1 {
+		t.Fatalf("the next message was given id %v", id)
+	}
+}
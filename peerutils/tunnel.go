@@ -3,25 +3,123 @@ package peerutils
 import (
 	"crypto/rsa"
 	"errors"
+	"io"
 	"net"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/DrewRoss5/courier/cryptoutils"
 )
 
 type Tunnel struct {
-	sessionKey []byte
-	PeerPubKey rsa.PublicKey
-	userPrvKey rsa.PrivateKey
-	Incoming   net.Conn
-	Outgoing   net.Conn
-	Peer       User
-	User       User
+	PeerPubKey     rsa.PublicKey
+	PeerSuccession []cryptoutils.Succession // statements linking the peer's earlier keys to PeerPubKey
+	Version        int                      // the protocol version both peers agreed on
+	Suite          string                   // the cipher suite both peers agreed on
+	Features       []string                 // the optional protocol features both peers support
+	Rekey          RekeyPolicy              // when the keys messages are encrypted with are replaced
+	Padding        PaddingPolicy            // how messages are padded in both directions, agreed during the handshake
+	Heartbeat      HeartbeatPolicy          // the agreed heartbeat interval, and how many may be missed, when both peers support heartbeats
+	Cover          CoverPolicy              // the cover traffic both peers send, disabled unless either peer asked for it
+	userPrvKey     rsa.PrivateKey
+	Incoming       net.Conn
+	Outgoing       net.Conn
+	Peer           User
+	User           User
+	redial         func() (*Tunnel, error) // re-runs the handshake that created this tunnel
+	send           *tunnelKey              // the key messages to the peer are encrypted with
+	recv           *tunnelKey              // the key messages from the peer are encrypted with
+	live           *liveness               // when the peer was last heard from
+	cover          *coverQueue             // the messages waiting for a slot in cover traffic mode, nil when it's disabled
+}
+
+// returns true if the peer has proven that the key with the given fingerprint was replaced by their current key
+func (t *Tunnel) SucceededFrom(fingerprint string) bool {
+	return cryptoutils.SucceededFrom(t.PeerSuccession, fingerprint)
+}
+
+// returns true if both peers support an optional protocol feature
+func (t *Tunnel) Supports(feature string) bool {
+	return slices.Contains(t.Features, feature)
+}
+
+// returns when the peer was last heard from
+func (t *Tunnel) LastHeard() time.Time {
+	return time.Unix(0, t.live.lastHeard.Load())
+}
+
+// returns the time the peer took to acknowledge the most recent message or heartbeat, zero if none has been acknowledged
+func (t *Tunnel) RTT() time.Duration {
+	return time.Duration(t.live.rtt.Load())
+}
+
+// returns how long the peer can stay silent before they're considered gone, zero if they don't send heartbeats
+func (t *Tunnel) silenceLimit() time.Duration {
+	if !t.Supports(FEATURE_HEARTBEAT) {
+		return 0
+	}
+	return t.Heartbeat.Interval * time.Duration(t.Heartbeat.Limit)
+}
+
+// sends a heartbeat to the peer, measuring the round trip time from their acknowledgement
+func (t *Tunnel) SendHeartbeat() error {
+	if !t.Supports(FEATURE_HEARTBEAT) {
+		return errors.New("tunnel: the peer doesn't support heartbeats")
+	}
+	return t.SendMessage([]byte{MESSAGE_HEARTBEAT})
 }
 
 // encrypts and sends the provided message through this Tunnel
-func (t Tunnel) SendMessage(message []byte) error {
-	// encrypt the plaintext
-	ciphertext, err := cryptoutils.AesEncrypt(message, t.sessionKey)
+// in cover traffic mode, the message waits for the next free slot, and is split across several if it's too large
+func (t *Tunnel) SendMessage(message []byte) error {
+	if t.cover != nil {
+		return t.cover.send(message)
+	}
+	return t.sendNow(message)
+}
+
+// sends a message immediately, replacing the key first if the rekey policy calls for it, and the peer supports rekeying
+// a peer that supports heartbeats is only waited on for an acknowledgement until they're considered gone
+func (t *Tunnel) sendNow(message []byte) error {
+	t.send.mut.Lock()
+	defer t.send.mut.Unlock()
+	if limit := t.silenceLimit(); limit != 0 {
+		t.Outgoing.SetReadDeadline(time.Now().Add(limit))
+	}
+	if t.Supports(FEATURE_REKEY) && t.Rekey.due(t.send) {
+		err := t.rekey()
+		if err != nil {
+			return err
+		}
+	}
+	return t.sendFrame(message)
+}
+
+// sends a new key for messages to the peer, encrypted with their public key, and switches to it once they
+// acknowledge it. The caller must hold send.mut
+func (t *Tunnel) rekey() error {
+	key := cryptoutils.GenAesKey()
+	keyCiphertext, err := cryptoutils.RsaEncrypt(&t.PeerPubKey, key)
+	if err != nil {
+		return err
+	}
+	err = t.sendFrame(append([]byte{MESSAGE_REKEY}, keyCiphertext...))
+	if err != nil {
+		return err
+	}
+	t.send.reset(key)
+	return nil
+}
+
+// encrypts, signs and sends a single message with the current key, the caller must hold send.mut
+func (t *Tunnel) sendFrame(message []byte) error {
+	// pad and encrypt the plaintext
+	plaintext := message
+	if t.Supports(FEATURE_PADDING) {
+		plaintext = t.Padding.pad(message)
+	}
+	ciphertext, err := cryptoutils.AesEncrypt(plaintext, t.send.key)
 	if err != nil {
 		return err
 	}
@@ -30,48 +128,159 @@ func (t Tunnel) SendMessage(message []byte) error {
 	if err != nil {
 		return err
 	}
+	t.send.used(len(message))
 	message = append(signature, ciphertext...)
 	// send the message and get the response
 	responseBuf := make([]byte, 1)
-	t.Outgoing.Write(message)
-	t.Outgoing.Read(responseBuf)
-	if responseBuf[0] != 0x0 {
-		return errors.New("message not validated")
-	}
-	return nil
-}
-
-func (t Tunnel) AwaitMessage() ([]byte, error) {
-	_, messageRaw, err := RecvAll(t.Incoming)
+	sent := time.Now()
+	_, err = t.Outgoing.Write(message)
 	if err != nil {
-		t.Incoming.Write([]byte{RES_ERR})
-		return nil, err
+		return err
 	}
-	signature := messageRaw[:cryptoutils.SIGNATURE_SIZE]
-	cipherext := messageRaw[cryptoutils.SIGNATURE_SIZE:]
-	message, err := cryptoutils.AesDecrypt(cipherext, t.sessionKey)
+	_, err = t.Outgoing.Read(responseBuf)
 	if err != nil {
-		t.Incoming.Write([]byte{RES_ERR})
-		return nil, err
+		return timedOut(err)
 	}
-	message = cryptoutils.StripZeroes(message)
-	if !cryptoutils.RsaVerify(t.PeerPubKey, message, signature) {
-		t.Incoming.Write([]byte{RES_ERR})
-		return nil, errors.New("failed to verify RSA signature")
+	if responseBuf[0] != RES_OK {
+		return ErrMessageRejected
+	}
+	// every acknowledgement shows the peer is still there, and how long a round trip takes
+	t.live.heard()
+	t.live.rtt.Store(int64(time.Since(sent)))
+	return nil
+}
+
+// awaits the next message from the peer, handling any new keys they send along the way, and reassembling messages
+// they split into fragments
+func (t *Tunnel) AwaitMessage() ([]byte, error) {
+	var fragmented []byte
+	reassembling := false
+	for {
+		// a peer that sends heartbeats is never silent for long, unless they're gone
+		if limit := t.silenceLimit(); limit != 0 {
+			t.Incoming.SetReadDeadline(time.Now().Add(limit))
+		}
+		_, messageRaw, err := RecvAll(t.Incoming)
+		if errors.Is(err, ErrTimeout) {
+			return nil, err
+		}
+		if err != nil {
+			t.Incoming.Write([]byte{RES_ERR})
+			return nil, err
+		}
+		signature, ciphertext, err := decodeFrame(messageRaw)
+		if err != nil {
+			t.Incoming.Write([]byte{RES_ERR})
+			return nil, err
+		}
+		message, err := cryptoutils.AesDecrypt(ciphertext, t.recv.key)
+		if err != nil {
+			t.Incoming.Write([]byte{RES_ERR})
+			return nil, err
+		}
+		if t.Supports(FEATURE_PADDING) {
+			message, err = unpad(message)
+			if err != nil {
+				t.Incoming.Write([]byte{RES_ERR})
+				return nil, err
+			}
+		}
+		if !cryptoutils.RsaVerify(t.PeerPubKey, message, signature) {
+			t.Incoming.Write([]byte{RES_ERR})
+			return nil, ErrSignature
+		}
+		t.live.heard()
+		code, body, err := decodeMessage(message)
+		if err != nil {
+			t.Incoming.Write([]byte{RES_ERR})
+			return nil, err
+		}
+		// a split message's fragments are sent one after another, only new keys and the peer leaving come between them
+		if reassembling && code != MESSAGE_FRAGMENT && code != MESSAGE_REKEY && code != MESSAGE_DISCONNECT {
+			t.Incoming.Write([]byte{RES_ERR})
+			return nil, invalid("fragment", "interrupted by another message")
+		}
+		if code == MESSAGE_FRAGMENT && t.Supports(FEATURE_COVER) {
+			more, chunk, err := decodeFragment(body)
+			if err == nil && len(fragmented)+len(chunk) > MAX_FRAGMENTED_SIZE {
+				err = invalid("fragment", "the message is too large")
+			}
+			if err != nil {
+				t.Incoming.Write([]byte{RES_ERR})
+				return nil, err
+			}
+			fragmented = append(fragmented, chunk...)
+			reassembling = more
+			if more {
+				t.Incoming.Write([]byte{RES_OK})
+				continue
+			}
+			// only chat messages are ever large enough to be split
+			message, fragmented = fragmented, nil
+			code, _, err = decodeMessage(message)
+			if err == nil && (code == MESSAGE_REKEY || code == MESSAGE_FRAGMENT) {
+				err = invalid("fragment", "only chat messages can be split")
+			}
+			if err != nil {
+				t.Incoming.Write([]byte{RES_ERR})
+				return nil, err
+			}
+			t.Incoming.Write([]byte{RES_OK})
+			return message, nil
+		}
+		// heartbeats only show that the peer is still there
+		if code == MESSAGE_HEARTBEAT && t.Supports(FEATURE_HEARTBEAT) {
+			t.Incoming.Write([]byte{RES_OK})
+			continue
+		}
+		// a new key takes effect from the peer's next message, and isn't passed on to the chat
+		if code == MESSAGE_REKEY && t.Supports(FEATURE_REKEY) {
+			key, err := decodeRekey(&t.userPrvKey, body)
+			if err != nil {
+				t.Incoming.Write([]byte{RES_ERR})
+				return nil, err
+			}
+			t.recv.reset(key)
+			t.Incoming.Write([]byte{RES_OK})
+			continue
+		}
+		// send the response to the peer
+		t.Incoming.Write([]byte{RES_OK})
+		return message, nil
 	}
-	// send the response to the peer
-	t.Incoming.Write([]byte{RES_OK})
-	return message, nil
 }
 
 // quits the connection and sends a message to the peer indicating such
-func (t Tunnel) Shutdown() error {
-	// send a message to the peer indicating that this Tunnel is being closed
-	err := t.SendMessage([]byte{MESSAGE_DISCONNECT})
-	if err != nil {
-		return err
+func (t *Tunnel) Shutdown() error {
+	// send a message to the peer indicating that this Tunnel is being closed, without waiting indefinitely on a peer that isn't reading
+	t.send.mut.Lock()
+	t.Outgoing.SetDeadline(time.Now().Add(SHUTDOWN_TIMEOUT))
+	err := t.sendFrame([]byte{MESSAGE_DISCONNECT})
+	t.send.mut.Unlock()
+	t.Incoming.Close()
+	t.Outgoing.Close()
+	// a peer that closed its end at the same time has already left, which isn't a failure
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return nil
+	}
+	return err
+}
+
+// re-establishes a dropped tunnel with the same peer, failing if the peer's identity has changed
+func (t *Tunnel) Reconnect() (*Tunnel, error) {
+	if t.redial == nil {
+		return nil, errors.New("tunnel: this tunnel can't be reconnected")
 	}
 	t.Incoming.Close()
 	t.Outgoing.Close()
-	return nil
+	tunnel, err := t.redial()
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.Peer.Id != t.Peer.Id || !tunnel.PeerPubKey.Equal(&t.PeerPubKey) {
+		tunnel.Incoming.Close()
+		tunnel.Outgoing.Close()
+		return nil, ErrIdentityChanged
+	}
+	return tunnel, nil
 }
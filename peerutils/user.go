@@ -32,9 +32,8 @@ func GenId(prvKey *rsa.PrivateKey) (string, error) {
 // verifies a peer's ID given their public key
 func ValidateId(id string, pubKey *rsa.PublicKey) bool {
 	// decode the base64-encoded signature
-	idBytes := make([]byte, ID_SIZE)
-	_, err := base64.StdEncoding.Decode(idBytes, []byte(id))
-	if err != nil {
+	idBytes, err := base64.StdEncoding.DecodeString(id)
+	if err != nil || len(idBytes) != ID_SIZE {
 		return false
 	}
 	// validate the signature